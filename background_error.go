@@ -0,0 +1,193 @@
+// Copyright 2018 The LevelDB-Go and Pebble Authors. All rights reserved. Use
+// of this source code is governed by a BSD-style license that can be found in
+// the LICENSE file.
+
+package pebble
+
+import (
+	"fmt"
+	"os"
+	"syscall"
+	"time"
+
+	"github.com/petermattis/pebble/internal/record"
+	"github.com/petermattis/pebble/sstable"
+)
+
+const (
+	// backgroundErrorInitialBackoff is the delay before retrying a flush or
+	// compaction after its first consecutive transient error. The delay
+	// doubles with each subsequent consecutive error.
+	backgroundErrorInitialBackoff = 100 * time.Millisecond
+	// backgroundErrorMaxBackoff is the maximum delay before retrying a flush
+	// or compaction after a transient error.
+	backgroundErrorMaxBackoff = 30 * time.Second
+	// backgroundErrorMaxRetries is the number of consecutive transient errors
+	// after which a flush or compaction is no longer retried, and the DB
+	// becomes read-only.
+	backgroundErrorMaxRetries = 10
+)
+
+// ReadOnlyError is returned by writes to a DB which has stopped accepting
+// writes because a background flush or compaction encountered an error which
+// cannot be retried, such as running out of disk space. Reads continue to be
+// served. DB.Resume clears an error caused by running out of disk space, or by
+// a transient error which persisted, once its cause has been resolved. An
+// error indicating corruption or a failed disk cannot be cleared.
+type ReadOnlyError struct {
+	// Err is the background error which caused the DB to become read-only.
+	Err error
+}
+
+func (e *ReadOnlyError) Error() string {
+	return fmt.Sprintf("pebble: read-only after background error: %v", e.Err)
+}
+
+type errorSeverity int
+
+const (
+	// severityTransient errors are retried with exponential backoff.
+	severityTransient errorSeverity = iota
+	// severityNoSpace errors indicate that the disk is full. The DB becomes
+	// read-only until space is freed and DB.Resume is called.
+	severityNoSpace
+	// severityFatal errors indicate corruption or a failed disk. The DB
+	// becomes read-only.
+	severityFatal
+)
+
+// classifyError determines how an error encountered by a background flush or
+// compaction is handled.
+func classifyError(err error) errorSeverity {
+	// Unwrap the errors returned by the os package to find the errno.
+	for {
+		switch e := err.(type) {
+		case *os.PathError:
+			err = e.Err
+			continue
+		case *os.LinkError:
+			err = e.Err
+			continue
+		case *os.SyscallError:
+			err = e.Err
+			continue
+		}
+		break
+	}
+	switch err {
+	case syscall.ENOSPC, syscall.EDQUOT:
+		return severityNoSpace
+	case syscall.EIO, syscall.EROFS, errCorruptManifest:
+		return severityFatal
+	}
+	switch err.(type) {
+	case sstable.CorruptionError, record.CorruptionError:
+		return severityFatal
+	}
+	return severityTransient
+}
+
+// readOnlyError returns the error which made the DB read-only, or nil if the
+// DB accepts writes. It returns ErrReadOnly if the DB was opened with
+// OpenReadOnly. It may be called without holding d.mu.
+func (d *DB) readOnlyError() error {
+	if d.openedReadOnly {
+		return ErrReadOnly
+	}
+	if err, _ := d.readOnly.Load().(*ReadOnlyError); err != nil {
+		return err
+	}
+	return nil
+}
+
+// handleBackgroundErrorLocked handles an error encountered by a background
+// flush or compaction. Transient errors are retried after a delay which grows
+// with the number of consecutive failures, up to backgroundErrorMaxRetries
+// times. Other errors, and transient errors which persist, make the DB
+// read-only.
+//
+// d.mu must be held when calling this.
+func (d *DB) handleBackgroundErrorLocked(err error, failures *int, retry **time.Timer) {
+	if d.opts.EventListener != nil && d.opts.EventListener.BackgroundError != nil {
+		d.opts.EventListener.BackgroundError(err)
+	}
+	if classifyError(err) != severityTransient {
+		d.setReadOnlyLocked(err)
+		return
+	}
+
+	*failures++
+	if *failures > backgroundErrorMaxRetries {
+		d.opts.Logger.Infof("background error (attempt %d, giving up): %v", *failures, err)
+		d.setReadOnlyLocked(err)
+		return
+	}
+	backoff := backgroundErrorInitialBackoff
+	for i := 1; i < *failures && backoff < backgroundErrorMaxBackoff; i++ {
+		backoff *= 2
+	}
+	if backoff > backgroundErrorMaxBackoff {
+		backoff = backgroundErrorMaxBackoff
+	}
+	d.opts.Logger.Infof("background error (attempt %d, retrying in %s): %v", *failures, backoff, err)
+	*retry = time.AfterFunc(backoff, func() {
+		d.mu.Lock()
+		defer d.mu.Unlock()
+		*retry = nil
+		d.maybeScheduleFlush()
+		d.maybeScheduleCompaction()
+	})
+}
+
+// setReadOnlyLocked makes the DB read-only. Pending manual compactions and
+// waiters for flushes are failed with the resulting ReadOnlyError.
+//
+// d.mu must be held when calling this.
+func (d *DB) setReadOnlyLocked(err error) {
+	if d.readOnlyError() != nil {
+		return
+	}
+	d.opts.Logger.Infof("background error, DB is now read-only: %v", err)
+	roErr := &ReadOnlyError{Err: err}
+	d.readOnly.Store(roErr)
+	close(d.mu.bgError.readOnlyC)
+	for _, manual := range d.mu.compact.manual {
+		manual.done <- roErr
+	}
+	d.mu.compact.manual = nil
+	// Wake up writers waiting for a flush or compaction.
+	d.mu.compact.cond.Broadcast()
+}
+
+// Resume clears the error which made the DB read-only and retries the
+// background flushes and compactions which failed. It waits for the retried
+// flushes to complete, returning the resulting error if the DB becomes
+// read-only again. Only an error caused by running out of disk space, or by a
+// transient error which persisted, is cleared: the ReadOnlyError caused by
+// corruption or a failed disk is returned unchanged, and the DB remains
+// read-only. Resume does nothing if the DB is not read-only, and returns
+// ErrReadOnly if the DB was opened with OpenReadOnly.
+func (d *DB) Resume() error {
+	if d.openedReadOnly {
+		return ErrReadOnly
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	roErr, _ := d.readOnly.Load().(*ReadOnlyError)
+	if roErr == nil {
+		return nil
+	}
+	if classifyError(roErr.Err) == severityFatal {
+		return roErr
+	}
+	d.readOnly.Store((*ReadOnlyError)(nil))
+	d.mu.bgError.readOnlyC = make(chan struct{})
+	d.mu.bgError.flushFailures = 0
+	d.mu.bgError.compactFailures = 0
+	d.maybeScheduleFlush()
+	d.maybeScheduleCompaction()
+	for d.mu.compact.flushing {
+		d.mu.compact.cond.Wait()
+	}
+	return d.readOnlyError()
+}
@@ -0,0 +1,240 @@
+// Copyright 2018 The LevelDB-Go and Pebble Authors. All rights reserved. Use
+// of this source code is governed by a BSD-style license that can be found in
+// the LICENSE file.
+
+package pebble
+
+import (
+	"errors"
+	"os"
+	"strings"
+	"sync"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/petermattis/pebble/db"
+	"github.com/petermattis/pebble/internal/record"
+	"github.com/petermattis/pebble/sstable"
+	"github.com/petermattis/pebble/storage"
+)
+
+func TestClassifyError(t *testing.T) {
+	testCases := []struct {
+		err      error
+		expected errorSeverity
+	}{
+		{errors.New("something"), severityTransient},
+		{storage.ErrInjected, severityTransient},
+		{&os.PathError{Op: "write", Path: "foo", Err: syscall.EINTR}, severityTransient},
+		{&os.PathError{Op: "write", Path: "foo", Err: syscall.ENOSPC}, severityNoSpace},
+		{&os.LinkError{Op: "link", Old: "a", New: "b", Err: syscall.EDQUOT}, severityNoSpace},
+		{&os.PathError{Op: "read", Path: "foo", Err: syscall.EIO}, severityFatal},
+		{errCorruptManifest, severityFatal},
+		{sstable.CorruptionError("pebble/table: corrupt index entry"), severityFatal},
+		{record.CorruptionError("pebble/record: invalid chunk (checksum mismatch)"), severityFatal},
+		// Errors are not classified by their messages.
+		{errors.New("corrupt"), severityTransient},
+	}
+	for _, c := range testCases {
+		if s := classifyError(c.err); s != c.expected {
+			t.Errorf("%v: expected %d, but found %d", c.err, c.expected, s)
+		}
+	}
+}
+
+// sstInjector fails the creation of sstables with an error which may be
+// changed concurrently.
+type sstInjector struct {
+	mu  sync.Mutex
+	err error
+	// remaining is the number of failures to inject, or -1 for no limit.
+	remaining int
+}
+
+func (i *sstInjector) set(err error, n int) {
+	i.mu.Lock()
+	i.err, i.remaining = err, n
+	i.mu.Unlock()
+}
+
+func (i *sstInjector) inject(op storage.FaultOp, name string) error {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+	if op != storage.FaultCreate || !strings.HasSuffix(name, ".sst") || i.remaining == 0 {
+		return nil
+	}
+	if i.remaining > 0 {
+		i.remaining--
+	}
+	return i.err
+}
+
+func TestBackgroundErrorTransient(t *testing.T) {
+	var injector sstInjector
+	fs := storage.NewFaultMem()
+	fs.SetInjector(injector.inject)
+
+	var mu sync.Mutex
+	var bgErrors []error
+	d, err := Open("", &db.Options{
+		Storage: fs,
+		EventListener: &db.EventListener{
+			BackgroundError: func(err error) {
+				mu.Lock()
+				bgErrors = append(bgErrors, err)
+				mu.Unlock()
+			},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The flush fails twice and is retried with backoff.
+	injector.set(storage.ErrInjected, 2)
+	if err := d.Set([]byte("a"), []byte("a"), nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := d.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	mu.Lock()
+	if len(bgErrors) != 2 || bgErrors[0] != storage.ErrInjected || bgErrors[1] != storage.ErrInjected {
+		t.Fatalf("expected 2 injected errors, but found %v", bgErrors)
+	}
+	mu.Unlock()
+	d.mu.Lock()
+	n := len(d.mu.versions.currentVersion().files[0])
+	d.mu.Unlock()
+	if n != 1 {
+		t.Fatalf("expected 1 L0 table, but found %d", n)
+	}
+	if err := d.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestBackgroundErrorMaxRetries(t *testing.T) {
+	d, err := Open("", &db.Options{Storage: storage.NewMem()})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// A transient error which persists makes the DB read-only rather than
+	// being retried forever.
+	d.mu.Lock()
+	failures := backgroundErrorMaxRetries - 1
+	var retry *time.Timer
+	d.handleBackgroundErrorLocked(storage.ErrInjected, &failures, &retry)
+	if retry == nil || d.readOnlyError() != nil {
+		t.Fatalf("expected the error to be retried")
+	}
+	retry.Stop()
+	retry = nil
+	d.handleBackgroundErrorLocked(storage.ErrInjected, &failures, &retry)
+	d.mu.Unlock()
+	if retry != nil {
+		t.Fatalf("expected the error not to be retried")
+	}
+	if roErr, ok := d.readOnlyError().(*ReadOnlyError); !ok || roErr.Err != storage.ErrInjected {
+		t.Fatalf("expected ReadOnlyError, but found %v", d.readOnlyError())
+	}
+	if err := d.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestBackgroundErrorFatal(t *testing.T) {
+	d, err := Open("", &db.Options{Storage: storage.NewMem()})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Resume does not clear an error indicating corruption.
+	corruptErr := sstable.CorruptionError("pebble/table: invalid table (checksum mismatch)")
+	d.mu.Lock()
+	var failures int
+	var retry *time.Timer
+	d.handleBackgroundErrorLocked(corruptErr, &failures, &retry)
+	d.mu.Unlock()
+	roErr, ok := d.readOnlyError().(*ReadOnlyError)
+	if !ok || roErr.Err != corruptErr {
+		t.Fatalf("expected ReadOnlyError, but found %v", d.readOnlyError())
+	}
+	if err := d.Resume(); err != roErr {
+		t.Fatalf("expected %v, but found %v", roErr, err)
+	}
+	if err := d.Set([]byte("a"), []byte("a"), nil); err != roErr {
+		t.Fatalf("expected %v, but found %v", roErr, err)
+	}
+	if err := d.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestBackgroundErrorNoSpace(t *testing.T) {
+	var injector sstInjector
+	fs := storage.NewFaultMem()
+	fs.SetInjector(injector.inject)
+
+	d, err := Open("", &db.Options{Storage: fs})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := d.Set([]byte("a"), []byte("a"), nil); err != nil {
+		t.Fatal(err)
+	}
+
+	// Running out of space makes the DB read-only.
+	noSpace := &os.PathError{Op: "open", Path: "foo.sst", Err: syscall.ENOSPC}
+	injector.set(noSpace, -1)
+	checkReadOnly := func(err error) {
+		t.Helper()
+		roErr, ok := err.(*ReadOnlyError)
+		if !ok {
+			t.Fatalf("expected ReadOnlyError, but found %v", err)
+		}
+		if roErr.Err != noSpace {
+			t.Fatalf("expected %v, but found %v", noSpace, roErr.Err)
+		}
+	}
+	checkReadOnly(d.Flush())
+
+	// Writes fail fast with the cause, while reads continue.
+	checkReadOnly(d.Set([]byte("b"), []byte("b"), nil))
+	checkReadOnly(d.Flush())
+	checkReadOnly(d.Compact([]byte("a"), []byte("b")))
+	if v, err := d.Get([]byte("a")); err != nil {
+		t.Fatal(err)
+	} else if string(v) != "a" {
+		t.Fatalf("expected a, but found %s", v)
+	}
+
+	// Resume fails while the disk remains full.
+	checkReadOnly(d.Resume())
+
+	// Once space has been freed, Resume retries the flush and writes succeed.
+	injector.set(nil, 0)
+	if err := d.Resume(); err != nil {
+		t.Fatal(err)
+	}
+	d.mu.Lock()
+	n := len(d.mu.versions.currentVersion().files[0])
+	d.mu.Unlock()
+	if n != 1 {
+		t.Fatalf("expected 1 L0 table, but found %d", n)
+	}
+	if err := d.Set([]byte("b"), []byte("b"), nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := d.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	if err := d.Resume(); err != nil {
+		t.Fatal(err)
+	}
+	if err := d.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -20,6 +20,7 @@ It is MIT licensed, like the original.
 package cache
 
 import (
+	"runtime"
 	"sync"
 	"sync/atomic"
 	"unsafe"
@@ -147,8 +148,7 @@ type WeakHandle interface {
 	Get() []byte
 }
 
-// Cache ...
-type Cache struct {
+type shard struct {
 	mu sync.Mutex
 
 	maxSize  int64
@@ -163,26 +163,19 @@ type Cache struct {
 	countHot  int64
 	countCold int64
 	countTest int64
-}
 
-// New creates a new cache of the specified size. Memory for the cache is
-// allocated on demand, not during initialization.
-func New(size int64) *Cache {
-	return &Cache{
-		maxSize:  size,
-		coldSize: size,
-		blocks:   make(map[key]*entry),
-		files:    make(map[uint64]*entry),
-	}
+	// onEvict is called with each value evicted by the cold hand.
+	onEvict func(fileNum, offset uint64, value []byte)
 }
 
-// Get retrieves the cache value for the specified file and offset, returning
-// nil if no value is present.
-func (c *Cache) Get(fileNum, offset uint64) []byte {
-	if c == nil {
-		return nil
-	}
+func (c *shard) init(size int64) {
+	c.maxSize = size
+	c.coldSize = size
+	c.blocks = make(map[key]*entry)
+	c.files = make(map[uint64]*entry)
+}
 
+func (c *shard) Get(fileNum, offset uint64) []byte {
 	c.mu.Lock()
 	defer c.mu.Unlock()
 
@@ -193,15 +186,7 @@ func (c *Cache) Get(fileNum, offset uint64) []byte {
 	return e.Get()
 }
 
-// Set sets the cache value for the specified file and offset, overwriting an
-// existing value if present. A WeakHandle is returned which provides faster
-// retrieval of the cached value than Get (lock-free and avoidance of the map
-// lookup).
-func (c *Cache) Set(fileNum, offset uint64, value []byte) WeakHandle {
-	if c == nil {
-		return nil
-	}
-
+func (c *shard) Set(fileNum, offset uint64, value []byte) WeakHandle {
 	c.mu.Lock()
 	defer c.mu.Unlock()
 
@@ -247,12 +232,7 @@ func (c *Cache) Set(fileNum, offset uint64, value []byte) WeakHandle {
 	return e
 }
 
-// EvictFile evicts all of the cache values for the specified file.
-func (c *Cache) EvictFile(fileNum uint64) {
-	if c == nil {
-		return
-	}
-
+func (c *shard) EvictFile(fileNum uint64) {
 	c.mu.Lock()
 	defer c.mu.Unlock()
 
@@ -277,23 +257,14 @@ func (c *Cache) EvictFile(fileNum uint64) {
 	}
 }
 
-// MaxSize returns the max size of the cache.
-func (c *Cache) MaxSize() int64 {
-	if c == nil {
-		return 0
-	}
-	return c.maxSize
-}
-
-// Size returns the current space used by the cache.
-func (c *Cache) Size() int64 {
+func (c *shard) Size() int64 {
 	c.mu.Lock()
 	size := c.countHot + c.countCold
 	c.mu.Unlock()
 	return size
 }
 
-func (c *Cache) metaAdd(key key, e *entry) {
+func (c *shard) metaAdd(key key, e *entry) {
 	c.evict()
 
 	c.blocks[key] = e
@@ -318,7 +289,7 @@ func (c *Cache) metaAdd(key key, e *entry) {
 	}
 }
 
-func (c *Cache) metaDel(e *entry) {
+func (c *shard) metaDel(e *entry) {
 	delete(c.blocks, e.key)
 
 	if e == c.handHot {
@@ -345,13 +316,15 @@ func (c *Cache) metaDel(e *entry) {
 	}
 }
 
-func (c *Cache) evict() {
-	for c.maxSize <= c.countHot+c.countCold {
+func (c *shard) evict() {
+	// The loop stops once the shard is empty, as a shard whose maxSize is 0
+	// can never be brought below it.
+	for c.maxSize <= c.countHot+c.countCold && c.countHot+c.countCold > 0 {
 		c.runHandCold()
 	}
 }
 
-func (c *Cache) runHandCold() {
+func (c *shard) runHandCold() {
 	if c.handCold == nil {
 		return
 	}
@@ -364,6 +337,11 @@ func (c *Cache) runHandCold() {
 			c.countCold -= e.size
 			c.countHot += e.size
 		} else {
+			if c.onEvict != nil {
+				if v := e.val.get(); v != nil {
+					c.onEvict(e.key.fileNum, e.key.offset, v)
+				}
+			}
 			e.val.set(nil)
 			e.ptype = etTest
 			c.countCold -= e.size
@@ -374,14 +352,18 @@ func (c *Cache) runHandCold() {
 		}
 	}
 
+	if c.handCold == nil {
+		// Running the test hand removed the last entry.
+		return
+	}
 	c.handCold = c.handCold.next()
 
-	for c.maxSize-c.coldSize <= c.countHot {
+	for c.maxSize-c.coldSize <= c.countHot && (c.maxSize > 0 || c.countHot > 0) {
 		c.runHandHot()
 	}
 }
 
-func (c *Cache) runHandHot() {
+func (c *shard) runHandHot() {
 	if c.handHot == c.handTest {
 		c.runHandTest()
 	}
@@ -403,7 +385,7 @@ func (c *Cache) runHandHot() {
 	c.handHot = c.handHot.next()
 }
 
-func (c *Cache) runHandTest() {
+func (c *shard) runHandTest() {
 	if c.countCold > 0 && c.handTest == c.handCold {
 		c.runHandCold()
 	}
@@ -426,3 +408,196 @@ func (c *Cache) runHandTest() {
 
 	c.handTest = c.handTest.next()
 }
+
+// Priority is the priority class of a cache entry.
+type Priority int8
+
+const (
+	// LowPriority is the priority of entries which are cheap to reload, such
+	// as sstable data blocks.
+	LowPriority Priority = iota
+	// HighPriority is the priority of entries which are needed by every
+	// lookup, such as sstable index and filter blocks. High priority entries
+	// are stored in a separate pool, if the cache has one, so that they are
+	// not evicted by a large number of low priority entries.
+	HighPriority
+)
+
+func (p Priority) String() string {
+	switch p {
+	case LowPriority:
+		return "low"
+	case HighPriority:
+		return "high"
+	}
+	return "unknown"
+}
+
+// Options holds the optional parameters for a Cache.
+type Options struct {
+	// Shards is the number of shards the cache is split into. Each shard is an
+	// independent CLOCK-Pro cache protected by its own mutex.
+	//
+	// The default value is 4 times the number of CPUs, limited so that each
+	// shard holds at least 1 MB. A shard must be able to hold several blocks
+	// for the cache to be effective, as a block larger than a shard is evicted
+	// as soon as it is added.
+	Shards int
+
+	// HighPriorityPoolRatio is the fraction of the cache capacity which is
+	// reserved for high priority entries. High priority entries only compete
+	// with each other for the capacity of the high priority pool, and low
+	// priority entries only compete for the remaining capacity.
+	//
+	// The default value (0) disables the high priority pool, in which case
+	// entries of all priorities compete equally.
+	HighPriorityPoolRatio float64
+
+	// OnEvict is called with each value which is evicted from the cache to
+	// make room for other values, such as to add it to a PersistentCache. It
+	// is not called for values removed by EvictFile. OnEvict is called with
+	// the mutex of a shard held, so it must not block or call into the cache.
+	//
+	// The default value (nil) discards evicted values.
+	OnEvict func(fileNum, offset uint64, value []byte)
+}
+
+// Cache implements the CLOCK-Pro caching algorithm. The cache is split into
+// shards, each of which is an independent CLOCK-Pro cache protected by its own
+// mutex, reducing lock contention between concurrent readers. A cache entry
+// is assigned to a shard by hashing its file number and offset.
+//
+// A nil *Cache is valid and caches nothing.
+type Cache struct {
+	maxSize int64
+	shards  []shard
+	// highPri holds the shards of the high priority pool. It is nil if the
+	// cache does not have a high priority pool.
+	highPri []shard
+}
+
+// New creates a new cache of the specified size with default options. Memory
+// for the cache is allocated on demand, not during initialization.
+func New(size int64) *Cache {
+	return NewWithOptions(size, Options{})
+}
+
+// minShardSize is the minimum capacity of each of the default number of
+// shards of a cache.
+const minShardSize = 1 << 20
+
+// NewWithOptions creates a new cache of the specified size. Memory for the
+// cache is allocated on demand, not during initialization.
+func NewWithOptions(size int64, opts Options) *Cache {
+	if opts.Shards <= 0 {
+		opts.Shards = 4 * runtime.NumCPU()
+		if max := size / minShardSize; int64(opts.Shards) > max {
+			opts.Shards = int(max)
+		}
+	}
+	c := &Cache{maxSize: size}
+	lowPriSize := size
+	if opts.HighPriorityPoolRatio > 0 {
+		highPriSize := int64(float64(size) * opts.HighPriorityPoolRatio)
+		if highPriSize > size {
+			highPriSize = size
+		}
+		lowPriSize -= highPriSize
+		c.highPri = newShards(highPriSize, opts.Shards, opts.OnEvict)
+	}
+	c.shards = newShards(lowPriSize, opts.Shards, opts.OnEvict)
+	return c
+}
+
+func newShards(size int64, n int, onEvict func(fileNum, offset uint64, value []byte)) []shard {
+	if int64(n) > size {
+		// Each shard must have a non-zero capacity.
+		n = int(size)
+	}
+	if n < 1 {
+		n = 1
+	}
+	shards := make([]shard, n)
+	for i := range shards {
+		shards[i].init(size / int64(n))
+		shards[i].onEvict = onEvict
+	}
+	return shards
+}
+
+func getShard(shards []shard, fileNum, offset uint64) *shard {
+	// Mix the file number and offset using the 64-bit finalizer from
+	// MurmurHash3 so that the blocks of a file are spread across the shards.
+	h := fileNum*0x9e3779b97f4a7c15 ^ offset
+	h ^= h >> 33
+	h *= 0xff51afd7ed558ccd
+	h ^= h >> 33
+	h *= 0xc4ceb9fe1a85ec53
+	h ^= h >> 33
+	return &shards[h%uint64(len(shards))]
+}
+
+// Get retrieves the cache value for the specified file and offset, returning
+// nil if no value is present.
+func (c *Cache) Get(fileNum, offset uint64) []byte {
+	if c == nil {
+		return nil
+	}
+	if c.highPri != nil {
+		if v := getShard(c.highPri, fileNum, offset).Get(fileNum, offset); v != nil {
+			return v
+		}
+	}
+	return getShard(c.shards, fileNum, offset).Get(fileNum, offset)
+}
+
+// Set sets the cache value for the specified file and offset, overwriting an
+// existing value if present. The value is stored in the pool for the
+// specified priority. A WeakHandle is returned which provides faster
+// retrieval of the cached value than Get (lock-free and avoidance of the map
+// lookup).
+func (c *Cache) Set(fileNum, offset uint64, value []byte, pri Priority) WeakHandle {
+	if c == nil {
+		return nil
+	}
+	if c.highPri != nil && pri == HighPriority {
+		return getShard(c.highPri, fileNum, offset).Set(fileNum, offset, value)
+	}
+	return getShard(c.shards, fileNum, offset).Set(fileNum, offset, value)
+}
+
+// EvictFile evicts all of the cache values for the specified file.
+func (c *Cache) EvictFile(fileNum uint64) {
+	if c == nil {
+		return
+	}
+	for i := range c.shards {
+		c.shards[i].EvictFile(fileNum)
+	}
+	for i := range c.highPri {
+		c.highPri[i].EvictFile(fileNum)
+	}
+}
+
+// MaxSize returns the max size of the cache.
+func (c *Cache) MaxSize() int64 {
+	if c == nil {
+		return 0
+	}
+	return c.maxSize
+}
+
+// Size returns the current space used by the cache.
+func (c *Cache) Size() int64 {
+	if c == nil {
+		return 0
+	}
+	var size int64
+	for i := range c.shards {
+		size += c.shards[i].Size()
+	}
+	for i := range c.highPri {
+		size += c.highPri[i].Size()
+	}
+	return size
+}
@@ -6,8 +6,10 @@ package cache
 import (
 	"bufio"
 	"bytes"
+	"fmt"
 	"os"
 	"strconv"
+	"sync"
 	"testing"
 )
 
@@ -18,7 +20,7 @@ func TestCache(t *testing.T) {
 		t.Fatal(err)
 	}
 
-	cache := New(200)
+	cache := NewWithOptions(200, Options{Shards: 1})
 	scanner := bufio.NewScanner(f)
 
 	for scanner.Scan() {
@@ -33,7 +35,7 @@ func TestCache(t *testing.T) {
 		var hit bool
 		v := cache.Get(uint64(key), 0)
 		if v == nil {
-			cache.Set(uint64(key), 0, append([]byte(nil), fields[0][0]))
+			cache.Set(uint64(key), 0, append([]byte(nil), fields[0][0]), LowPriority)
 		} else {
 			hit = true
 			if !bytes.Equal(v, fields[0][:1]) {
@@ -47,25 +49,25 @@ func TestCache(t *testing.T) {
 }
 
 func TestWeakHandle(t *testing.T) {
-	cache := New(5)
-	cache.Set(1, 0, bytes.Repeat([]byte("a"), 5))
-	h := cache.Set(0, 0, bytes.Repeat([]byte("b"), 5))
+	cache := NewWithOptions(5, Options{Shards: 1})
+	cache.Set(1, 0, bytes.Repeat([]byte("a"), 5), LowPriority)
+	h := cache.Set(0, 0, bytes.Repeat([]byte("b"), 5), LowPriority)
 	if v := h.Get(); string(v) != "bbbbb" {
 		t.Fatalf("expected bbbbb, but found %v", v)
 	}
-	cache.Set(2, 0, bytes.Repeat([]byte("a"), 5))
+	cache.Set(2, 0, bytes.Repeat([]byte("a"), 5), LowPriority)
 	if v := h.Get(); v != nil {
 		t.Fatalf("expected nil, but found %s", v)
 	}
 }
 
 func TestEvictFile(t *testing.T) {
-	cache := New(100)
-	cache.Set(0, 0, bytes.Repeat([]byte("a"), 5))
-	cache.Set(1, 0, bytes.Repeat([]byte("a"), 5))
-	cache.Set(2, 0, bytes.Repeat([]byte("a"), 5))
-	cache.Set(2, 1, bytes.Repeat([]byte("a"), 5))
-	cache.Set(2, 2, bytes.Repeat([]byte("a"), 5))
+	cache := NewWithOptions(100, Options{Shards: 4})
+	cache.Set(0, 0, bytes.Repeat([]byte("a"), 5), LowPriority)
+	cache.Set(1, 0, bytes.Repeat([]byte("a"), 5), LowPriority)
+	cache.Set(2, 0, bytes.Repeat([]byte("a"), 5), LowPriority)
+	cache.Set(2, 1, bytes.Repeat([]byte("a"), 5), LowPriority)
+	cache.Set(2, 2, bytes.Repeat([]byte("a"), 5), LowPriority)
 	if expected, size := int64(25), cache.Size(); expected != size {
 		t.Fatalf("expected cache size %d, but found %d", expected, size)
 	}
@@ -82,3 +84,118 @@ func TestEvictFile(t *testing.T) {
 		t.Fatalf("expected cache size %d, but found %d", expected, size)
 	}
 }
+
+func TestOnEvict(t *testing.T) {
+	evicted := make(map[key][]byte)
+	cache := NewWithOptions(100, Options{
+		Shards: 1,
+		OnEvict: func(fileNum, offset uint64, value []byte) {
+			evicted[key{fileNum: fileNum, offset: offset}] = value
+		},
+	})
+	for i := uint64(0); i < 20; i++ {
+		cache.Set(1, i, bytes.Repeat([]byte{byte(i)}, 10), LowPriority)
+	}
+	if len(evicted) == 0 {
+		t.Fatalf("expected values to be evicted")
+	}
+	for k, v := range evicted {
+		if cache.Get(k.fileNum, k.offset) != nil {
+			t.Fatalf("expected %d/%d to not be in the cache", k.fileNum, k.offset)
+		}
+		if expected := bytes.Repeat([]byte{byte(k.offset)}, 10); !bytes.Equal(expected, v) {
+			t.Fatalf("expected %x, but found %x", expected, v)
+		}
+	}
+
+	// Values removed by EvictFile are not passed to OnEvict.
+	n := len(evicted)
+	cache.EvictFile(1)
+	if len(evicted) != n {
+		t.Fatalf("expected %d evicted values, but found %d", n, len(evicted))
+	}
+}
+
+func TestShards(t *testing.T) {
+	const shards = 8
+	cache := NewWithOptions(1<<20, Options{Shards: shards})
+
+	var wg sync.WaitGroup
+	for i := 0; i < shards; i++ {
+		wg.Add(1)
+		go func(fileNum uint64) {
+			defer wg.Done()
+			for offset := uint64(0); offset < 100; offset++ {
+				v := []byte(fmt.Sprintf("%d-%d", fileNum, offset))
+				cache.Set(fileNum, offset, v, LowPriority)
+				if got := cache.Get(fileNum, offset); !bytes.Equal(v, got) {
+					t.Errorf("expected %s, but found %s", v, got)
+				}
+			}
+		}(uint64(i))
+	}
+	wg.Wait()
+
+	// The blocks of each file should be spread across the shards.
+	for i := range cache.shards {
+		if len(cache.shards[i].blocks) == 0 {
+			t.Fatalf("shard %d is empty", i)
+		}
+	}
+
+	size := cache.Size()
+	cache.EvictFile(0)
+	if newSize := cache.Size(); newSize >= size {
+		t.Fatalf("expected cache size to shrink: %d >= %d", newSize, size)
+	}
+	for offset := uint64(0); offset < 100; offset++ {
+		if v := cache.Get(0, offset); v != nil {
+			t.Fatalf("expected nil, but found %s", v)
+		}
+	}
+}
+
+func TestHighPriority(t *testing.T) {
+	cache := NewWithOptions(100, Options{Shards: 1, HighPriorityPoolRatio: 0.5})
+	cache.Set(0, 0, bytes.Repeat([]byte("a"), 10), HighPriority)
+	for i := uint64(1); i < 100; i++ {
+		cache.Set(i, 0, bytes.Repeat([]byte("b"), 10), LowPriority)
+		cache.Get(i, 0)
+	}
+	// The low priority entries do not compete with the high priority entry.
+	if v := cache.Get(0, 0); string(v) != "aaaaaaaaaa" {
+		t.Fatalf("expected aaaaaaaaaa, but found %s", v)
+	}
+	if size := cache.Size(); size > cache.MaxSize() {
+		t.Fatalf("cache size %d exceeds max size %d", size, cache.MaxSize())
+	}
+	cache.EvictFile(0)
+	if v := cache.Get(0, 0); v != nil {
+		t.Fatalf("expected nil, but found %s", v)
+	}
+}
+
+func TestSmallCache(t *testing.T) {
+	// The shards of a small cache must not be so small that adding a block
+	// fails to terminate or immediately evicts it.
+	for _, c := range []*Cache{
+		NewWithOptions(10, Options{Shards: 64}),
+		NewWithOptions(0, Options{}),
+		New(1 << 20),
+	} {
+		for i := uint64(0); i < 10; i++ {
+			c.Set(i, 0, bytes.Repeat([]byte("a"), 5), LowPriority)
+		}
+		c.Set(10, 0, bytes.Repeat([]byte("a"), 100), LowPriority)
+	}
+
+	c := New(1 << 20)
+	if n := len(c.shards); n != 1 {
+		t.Fatalf("expected 1 shard, but found %d", n)
+	}
+	v := bytes.Repeat([]byte("a"), 64<<10)
+	c.Set(1, 0, v, LowPriority)
+	if got := c.Get(1, 0); !bytes.Equal(v, got) {
+		t.Fatal("expected the block to be cached")
+	}
+}
@@ -0,0 +1,461 @@
+// Copyright 2018 The LevelDB-Go and Pebble Authors. All rights reserved. Use
+// of this source code is governed by a BSD-style license that can be found in
+// the LICENSE file.
+
+package cache
+
+import (
+	"errors"
+	"fmt"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"github.com/golang/snappy"
+	"github.com/petermattis/pebble/internal/crc"
+	"github.com/petermattis/pebble/storage"
+)
+
+// persistentCacheSegments is the target number of segments the capacity of a
+// PersistentCache is divided into. Space is reclaimed a segment at a time, so
+// more segments waste less capacity, at the cost of more files.
+const persistentCacheSegments = 8
+
+const persistentCacheSuffix = ".pcache"
+
+// persistentCacheMaxPending is the maximum number of bytes of blocks waiting
+// to be written to a PersistentCache. Blocks added while the limit is reached
+// are dropped rather than blocking the reader adding them.
+const persistentCacheMaxPending = 4 << 20
+
+// PersistentCache is a secondary block cache which stores blocks in files on
+// a local device, typically a fast SSD. It is intended to sit below a Cache
+// when sstables are stored on slower (e.g. network attached) storage: blocks
+// evicted from the Cache are compressed and stored in the persistent cache,
+// and are read from the persistent cache rather than the sstable when they
+// are next needed. Blocks are added to the persistent cache by creating the
+// Cache with Options.OnEvict set to the persistent cache's Set method:
+//
+//	pc, err := cache.NewPersistentCache(storage.Default, dir, size)
+//	...
+//	c := cache.NewWithOptions(size, cache.Options{OnEvict: pc.Set})
+//	opts := &db.Options{Cache: c, SecondaryCache: pc}
+//
+// Blocks are only written to the device once they have been evicted from the
+// Cache, so the device's capacity and write endurance are not spent on blocks
+// which are still held in memory.
+//
+// The cache is log structured: blocks are appended to the current segment
+// file, and once the capacity of the cache has been reached the oldest
+// segment is removed along with the blocks it contains. The index of the
+// cache is kept in memory, so the cache is empty each time it is created.
+//
+// Blocks are written to the segment files by a background goroutine so that
+// adding a block does not perform I/O on the read path. Blocks waiting to be
+// written are served from memory.
+//
+// A PersistentCache is safe for concurrent use.
+type PersistentCache struct {
+	fs          storage.Storage
+	dirname     string
+	maxSize     int64
+	segmentSize int64
+
+	// writeCh is signaled when blocks are queued for writing, and closeCh is
+	// closed to stop the writer goroutine.
+	writeCh chan struct{}
+	closeCh chan struct{}
+	wg      sync.WaitGroup
+
+	mu struct {
+		sync.Mutex
+		// pending holds the blocks waiting to be written, keyed by file
+		// number and offset, and queue holds their keys in the order they
+		// were added.
+		pending      map[key][]byte
+		queue        []key
+		pendingBytes int
+		closed       bool
+		// index maps file numbers to the blocks of that file in the cache,
+		// keyed by offset.
+		index map[uint64]map[uint64]persistentEntry
+		// segments holds the live segments, oldest first. The last segment is
+		// the one currently being written.
+		segments       []*persistentSegment
+		nextSegmentNum uint64
+		size           int64
+	}
+}
+
+type persistentEntry struct {
+	segment *persistentSegment
+	offset  int64
+	// length and checksum are the length and checksum of the compressed
+	// block stored in the segment.
+	length   int
+	checksum uint32
+}
+
+type persistentSegment struct {
+	num  uint64
+	name string
+	// size is the number of bytes written to the segment. It is only
+	// modified by the writer goroutine with PersistentCache.mu held.
+	size int64
+	// keys holds the keys of the blocks written to the segment. It is only
+	// accessed with PersistentCache.mu held.
+	keys []key
+
+	// mu protects the segment files. Reads hold mu in read mode and writes
+	// and removal of the segment hold mu in write mode.
+	mu      sync.RWMutex
+	w       storage.File
+	r       storage.File
+	removed bool
+}
+
+// NewPersistentCache creates a persistent cache of the specified size in
+// dirname, which is created if it does not exist. Any segment files left in
+// dirname by a previous persistent cache are removed.
+func NewPersistentCache(fs storage.Storage, dirname string, size int64) (*PersistentCache, error) {
+	if size <= 0 {
+		return nil, errors.New("pebble/cache: persistent cache size must be positive")
+	}
+	if err := fs.MkdirAll(dirname, 0755); err != nil {
+		return nil, err
+	}
+	names, err := fs.List(dirname)
+	if err != nil {
+		return nil, err
+	}
+	for _, name := range names {
+		if strings.HasSuffix(name, persistentCacheSuffix) {
+			if err := fs.Remove(filepath.Join(dirname, name)); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	c := &PersistentCache{
+		fs:          fs,
+		dirname:     dirname,
+		maxSize:     size,
+		segmentSize: size / persistentCacheSegments,
+	}
+	if c.segmentSize == 0 {
+		c.segmentSize = size
+	}
+	c.writeCh = make(chan struct{}, 1)
+	c.closeCh = make(chan struct{})
+	c.mu.index = make(map[uint64]map[uint64]persistentEntry)
+	c.mu.pending = make(map[key][]byte)
+	c.wg.Add(1)
+	go c.writeLoop()
+	return c, nil
+}
+
+// Get retrieves the block for the specified file and offset, returning nil if
+// the block is not present. Errors reading the block, and blocks which fail
+// their checksum, are treated as a miss.
+func (c *PersistentCache) Get(fileNum, offset uint64) []byte {
+	if c == nil {
+		return nil
+	}
+
+	c.mu.Lock()
+	if b, ok := c.mu.pending[key{fileNum: fileNum, offset: offset}]; ok {
+		c.mu.Unlock()
+		return b
+	}
+	e, ok := c.mu.index[fileNum][offset]
+	c.mu.Unlock()
+	if !ok {
+		return nil
+	}
+
+	s := e.segment
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	if s.removed {
+		return nil
+	}
+	b := make([]byte, e.length)
+	if n, _ := s.r.ReadAt(b, e.offset); n != len(b) {
+		return nil
+	}
+	if crc.New(b).Value() != e.checksum {
+		return nil
+	}
+	v, err := snappy.Decode(nil, b)
+	if err != nil {
+		return nil
+	}
+	return v
+}
+
+// Set queues the block for the specified file and offset to be compressed and
+// written to the cache by the background writer. It is intended to be called
+// with the blocks evicted from a Cache (see Options.OnEvict), and does not
+// block. The value is retained by the cache and must not be modified by the
+// caller. Blocks already present in the cache, blocks larger than a segment
+// and blocks added while too many blocks are waiting to be written are
+// ignored.
+func (c *PersistentCache) Set(fileNum, offset uint64, value []byte) {
+	if c == nil || int64(len(value)) > c.segmentSize {
+		return
+	}
+
+	k := key{fileNum: fileNum, offset: offset}
+	c.mu.Lock()
+	if c.mu.closed || c.mu.pendingBytes+len(value) > persistentCacheMaxPending {
+		c.mu.Unlock()
+		return
+	}
+	if _, ok := c.mu.pending[k]; ok {
+		c.mu.Unlock()
+		return
+	}
+	if _, ok := c.mu.index[fileNum][offset]; ok {
+		c.mu.Unlock()
+		return
+	}
+	c.mu.pending[k] = value
+	c.mu.queue = append(c.mu.queue, k)
+	c.mu.pendingBytes += len(value)
+	c.mu.Unlock()
+
+	select {
+	case c.writeCh <- struct{}{}:
+	default:
+	}
+}
+
+// writeLoop writes the pending blocks to the cache until the cache is closed.
+func (c *PersistentCache) writeLoop() {
+	defer c.wg.Done()
+	for {
+		select {
+		case <-c.closeCh:
+			return
+		case <-c.writeCh:
+		}
+		for {
+			c.mu.Lock()
+			if c.mu.closed || len(c.mu.queue) == 0 {
+				c.mu.Unlock()
+				break
+			}
+			k := c.mu.queue[0]
+			c.mu.queue = c.mu.queue[1:]
+			value, ok := c.mu.pending[k]
+			c.mu.Unlock()
+			if ok {
+				c.write(k, value)
+			}
+		}
+	}
+}
+
+// write compresses a pending block, writes it to the current segment and adds
+// it to the index. The block is removed from the pending blocks whether or not
+// the write succeeds. Only called by the writer goroutine.
+func (c *PersistentCache) write(k key, value []byte) {
+	data := snappy.Encode(nil, value)
+	s, err := c.segmentForWrite(int64(len(data)))
+	if err == nil {
+		s.mu.Lock()
+		_, err = s.w.Write(data)
+		s.mu.Unlock()
+		if err != nil {
+			// The segment may contain a partial write. Seal it so that the
+			// next write starts a new segment.
+			c.sealSegment(s)
+		}
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if _, ok := c.mu.pending[k]; !ok {
+		// The file was evicted while the block was being written. The space
+		// is reclaimed when the segment is removed.
+		if err == nil {
+			s.size += int64(len(data))
+			c.mu.size += int64(len(data))
+		}
+		return
+	}
+	delete(c.mu.pending, k)
+	c.mu.pendingBytes -= len(value)
+	if err != nil {
+		return
+	}
+	e := persistentEntry{
+		segment:  s,
+		offset:   s.size,
+		length:   len(data),
+		checksum: crc.New(data).Value(),
+	}
+	s.size += int64(len(data))
+	blocks := c.mu.index[k.fileNum]
+	if blocks == nil {
+		blocks = make(map[uint64]persistentEntry)
+		c.mu.index[k.fileNum] = blocks
+	}
+	blocks[k.offset] = e
+	s.keys = append(s.keys, k)
+	c.mu.size += int64(len(data))
+}
+
+// segmentForWrite returns the segment to which a block of the specified size
+// should be written, removing the oldest segments and creating a new segment
+// as necessary. Only called by the writer goroutine.
+func (c *PersistentCache) segmentForWrite(n int64) (*persistentSegment, error) {
+	c.mu.Lock()
+	var removed []*persistentSegment
+	for len(c.mu.segments) > 0 && c.mu.size+n > c.maxSize {
+		removed = append(removed, c.removeOldestLocked())
+	}
+	var cur *persistentSegment
+	if len(c.mu.segments) > 0 {
+		cur = c.mu.segments[len(c.mu.segments)-1]
+	}
+	c.mu.Unlock()
+
+	for _, s := range removed {
+		c.removeSegment(s)
+	}
+	if cur != nil {
+		if cur.w != nil && cur.size+n <= c.segmentSize {
+			return cur, nil
+		}
+		c.sealSegment(cur)
+	}
+
+	c.mu.Lock()
+	s := &persistentSegment{num: c.mu.nextSegmentNum}
+	c.mu.nextSegmentNum++
+	c.mu.Unlock()
+
+	s.name = filepath.Join(c.dirname, fmt.Sprintf("%06d%s", s.num, persistentCacheSuffix))
+	w, err := c.fs.Create(s.name)
+	if err != nil {
+		return nil, err
+	}
+	r, err := c.fs.Open(s.name)
+	if err != nil {
+		w.Close()
+		_ = c.fs.Remove(s.name)
+		return nil, err
+	}
+	s.w, s.r = w, r
+
+	c.mu.Lock()
+	c.mu.segments = append(c.mu.segments, s)
+	c.mu.Unlock()
+	return s, nil
+}
+
+// sealSegment closes the writer of a segment. No further blocks are written
+// to a sealed segment. Only called by the writer goroutine.
+func (c *PersistentCache) sealSegment(s *persistentSegment) {
+	s.mu.Lock()
+	if s.w != nil {
+		_ = s.w.Close()
+		s.w = nil
+	}
+	s.mu.Unlock()
+}
+
+// removeOldestLocked removes the oldest segment and the blocks it contains
+// from the index. The caller is responsible for calling removeSegment on the
+// returned segment after releasing c.mu. c.mu must be held.
+func (c *PersistentCache) removeOldestLocked() *persistentSegment {
+	s := c.mu.segments[0]
+	c.mu.segments = c.mu.segments[1:]
+	for _, k := range s.keys {
+		blocks := c.mu.index[k.fileNum]
+		if e, ok := blocks[k.offset]; ok && e.segment == s {
+			delete(blocks, k.offset)
+			if len(blocks) == 0 {
+				delete(c.mu.index, k.fileNum)
+			}
+		}
+	}
+	s.keys = nil
+	c.mu.size -= s.size
+	return s
+}
+
+// removeSegment closes and removes the files of a segment, waiting for
+// concurrent reads of the segment to complete.
+func (c *PersistentCache) removeSegment(s *persistentSegment) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.removed {
+		return
+	}
+	s.removed = true
+	if s.w != nil {
+		_ = s.w.Close()
+		s.w = nil
+	}
+	_ = s.r.Close()
+	s.r = nil
+	_ = c.fs.Remove(s.name)
+}
+
+// EvictFile evicts all of the blocks for the specified file. The space used by
+// the blocks is reclaimed when the segments containing them are removed.
+func (c *PersistentCache) EvictFile(fileNum uint64) {
+	if c == nil {
+		return
+	}
+	c.mu.Lock()
+	delete(c.mu.index, fileNum)
+	for k, v := range c.mu.pending {
+		if k.fileNum == fileNum {
+			delete(c.mu.pending, k)
+			c.mu.pendingBytes -= len(v)
+		}
+	}
+	c.mu.Unlock()
+}
+
+// Size returns the space used by the segment files of the cache.
+func (c *PersistentCache) Size() int64 {
+	if c == nil {
+		return 0
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.mu.size
+}
+
+// Close stops the background writer, discarding the blocks waiting to be
+// written, and closes and removes the segment files of the cache.
+func (c *PersistentCache) Close() error {
+	c.mu.Lock()
+	if c.mu.closed {
+		c.mu.Unlock()
+		return nil
+	}
+	c.mu.closed = true
+	c.mu.Unlock()
+	close(c.closeCh)
+	c.wg.Wait()
+
+	c.mu.Lock()
+	segments := c.mu.segments
+	c.mu.segments = nil
+	c.mu.index = make(map[uint64]map[uint64]persistentEntry)
+	c.mu.pending = make(map[key][]byte)
+	c.mu.queue = nil
+	c.mu.pendingBytes = 0
+	c.mu.size = 0
+	c.mu.Unlock()
+
+	for _, s := range segments {
+		c.removeSegment(s)
+	}
+	return nil
+}
@@ -0,0 +1,178 @@
+// Copyright 2018 The LevelDB-Go and Pebble Authors. All rights reserved. Use
+// of this source code is governed by a BSD-style license that can be found in
+// the LICENSE file.
+
+package cache
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"math/rand"
+	"os"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/golang/snappy"
+	"github.com/petermattis/pebble/storage"
+)
+
+// waitForWrites waits for the blocks queued by Set to be written.
+func (c *PersistentCache) waitForWrites() {
+	for {
+		c.mu.Lock()
+		n := len(c.mu.pending)
+		c.mu.Unlock()
+		if n == 0 {
+			return
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestPersistentCache(t *testing.T) {
+	fs := storage.NewMem()
+	c, err := NewPersistentCache(fs, "/pcache", 800)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The values are incompressible, so that each compressed value is 47
+	// bytes.
+	value := func(fileNum, offset uint64) []byte {
+		v := make([]byte, 39)
+		rand.New(rand.NewSource(int64(fileNum<<32 | offset))).Read(v)
+		return append([]byte(fmt.Sprintf("%02d-%02d-", fileNum, offset)), v...)
+	}
+	if n := len(snappy.Encode(nil, value(1, 0))); n != 47 {
+		t.Fatalf("expected compressed size 47, but found %d", n)
+	}
+
+	// Each segment holds 100 bytes, which is two values.
+	for i := uint64(0); i < 8; i++ {
+		c.Set(1, i, value(1, i))
+	}
+	c.waitForWrites()
+	if size := c.Size(); size != 8*47 {
+		t.Fatalf("expected size %d, but found %d", 8*47, size)
+	}
+	for i := uint64(0); i < 8; i++ {
+		if v := c.Get(1, i); !bytes.Equal(v, value(1, i)) {
+			t.Fatalf("expected %s, but found %s", value(1, i), v)
+		}
+	}
+	if v := c.Get(2, 0); v != nil {
+		t.Fatalf("expected nil, but found %s", v)
+	}
+
+	// Filling the cache removes the oldest segments.
+	for i := uint64(0); i < 16; i++ {
+		c.Set(2, i, value(2, i))
+	}
+	c.waitForWrites()
+	if size := c.Size(); size > 800 {
+		t.Fatalf("expected size <= 800, but found %d", size)
+	}
+	if v := c.Get(1, 0); v != nil {
+		t.Fatalf("expected nil, but found %s", v)
+	}
+	if v := c.Get(2, 15); !bytes.Equal(v, value(2, 15)) {
+		t.Fatalf("expected %s, but found %s", value(2, 15), v)
+	}
+	names, err := fs.List("/pcache")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(names) > persistentCacheSegments+1 {
+		t.Fatalf("expected at most %d segments, but found %d", persistentCacheSegments+1, len(names))
+	}
+
+	c.EvictFile(2)
+	for i := uint64(0); i < 16; i++ {
+		if v := c.Get(2, i); v != nil {
+			t.Fatalf("expected nil, but found %s", v)
+		}
+	}
+
+	if err := c.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if names, err := fs.List("/pcache"); err != nil {
+		t.Fatal(err)
+	} else if len(names) != 0 {
+		t.Fatalf("expected no segments, but found %s", names)
+	}
+}
+
+func TestPersistentCacheChecksum(t *testing.T) {
+	c, err := NewPersistentCache(storage.NewMem(), "/pcache", 1<<20)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	value := bytes.Repeat([]byte("a"), 100)
+	c.Set(1, 0, value)
+	c.waitForWrites()
+	if v := c.Get(1, 0); !bytes.Equal(v, value) {
+		t.Fatalf("expected %s, but found %s", value, v)
+	}
+
+	// A block which does not match its checksum is treated as a miss.
+	c.mu.Lock()
+	e := c.mu.index[1][0]
+	e.checksum++
+	c.mu.index[1][0] = e
+	c.mu.Unlock()
+	if v := c.Get(1, 0); v != nil {
+		t.Fatalf("expected nil, but found %s", v)
+	}
+}
+
+func TestPersistentCacheRemovesStaleSegments(t *testing.T) {
+	fs := storage.NewMem()
+	if err := fs.MkdirAll("/pcache", 0755); err != nil {
+		t.Fatal(err)
+	}
+	f, err := fs.Create("/pcache/000003.pcache")
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.Close()
+	if _, err := NewPersistentCache(fs, "/pcache", 1<<20); err != nil {
+		t.Fatal(err)
+	}
+	if names, err := fs.List("/pcache"); err != nil {
+		t.Fatal(err)
+	} else if len(names) != 0 {
+		t.Fatalf("expected no segments, but found %s", names)
+	}
+}
+
+func TestPersistentCacheConcurrent(t *testing.T) {
+	dir, err := ioutil.TempDir("", "pebble-pcache")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	c, err := NewPersistentCache(storage.Default, dir, 64<<10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func(fileNum uint64) {
+			defer wg.Done()
+			for offset := uint64(0); offset < 1000; offset++ {
+				v := bytes.Repeat([]byte{byte(offset)}, 100)
+				c.Set(fileNum, offset, v)
+				if got := c.Get(fileNum, offset); got != nil && !bytes.Equal(v, got) {
+					t.Errorf("expected %x, but found %x", v, got)
+				}
+			}
+		}(uint64(i))
+	}
+	wg.Wait()
+}
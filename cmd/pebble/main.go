@@ -28,6 +28,7 @@ func main() {
 	rootCmd.AddCommand(
 		scanCmd,
 		syncCmd,
+		repairCmd,
 	)
 
 	for _, cmd := range []*cobra.Command{scanCmd, syncCmd} {
@@ -0,0 +1,61 @@
+// Copyright 2018 The LevelDB-Go and Pebble Authors. All rights reserved. Use
+// of this source code is governed by a BSD-style license that can be found in
+// the LICENSE file.
+
+package main
+
+import (
+	"fmt"
+	"log"
+	"path/filepath"
+
+	"github.com/petermattis/pebble"
+	"github.com/petermattis/pebble/bloom"
+	"github.com/petermattis/pebble/db"
+	"github.com/petermattis/pebble/storage"
+	"github.com/spf13/cobra"
+)
+
+var repairCmd = &cobra.Command{
+	Use:   "repair <dir>",
+	Short: "rebuild the MANIFEST of a DB from its tables and logs",
+	Long: `
+Rebuild the MANIFEST of a DB which cannot be opened because its MANIFEST is
+missing or corrupt. All of the recovered tables are placed in L0. Tables which
+cannot be read are moved to the "lost" subdirectory. The DB must not be open.
+
+The DB is repaired with the options recorded in its OPTIONS file, if it has
+one. Only DBs using the default comparer and merger can be repaired.
+`,
+	Args: cobra.ExactArgs(1),
+	Run:  runRepair,
+}
+
+// repairParseHooks construct the filter policies recorded in an OPTIONS
+// file. The bloom filter policy is the only one known to this tool, and is
+// recreated with the default number of bits per key.
+var repairParseHooks = &db.ParseHooks{
+	NewFilterPolicy: func(name string) (db.FilterPolicy, error) {
+		if p := bloom.FilterPolicy(10); name == p.Name() {
+			return p, nil
+		}
+		return nil, fmt.Errorf("unknown filter policy %q", name)
+	},
+}
+
+func runRepair(cmd *cobra.Command, args []string) {
+	dir := args[0]
+	opts := &db.Options{}
+	if names, err := filepath.Glob(filepath.Join(dir, "OPTIONS-*")); err != nil {
+		log.Fatal(err)
+	} else if len(names) > 0 {
+		if opts, err = pebble.LoadOptions(dir, storage.Default, repairParseHooks); err != nil {
+			log.Fatal(err)
+		}
+	}
+	report, err := pebble.Repair(dir, opts)
+	if err != nil {
+		log.Fatal(err)
+	}
+	fmt.Print(report)
+}
@@ -125,10 +125,10 @@ type commitEnv struct {
 	apply func(b *Batch, mem *memTable) error
 	// Sync the WAL. Called serially by the sync goroutine.
 	sync func() error
-	// Write the batch to the WAL. The data is not persisted until a call to
-	// sync() is performed. Returns the memtable the batch should be applied
-	// to. Called serially.
-	write func(b *Batch) (*memTable, error)
+	// Write the batch to the WAL, if writeWAL is true. The data is not
+	// persisted until a call to sync() is performed. Returns the memtable the
+	// batch should be applied to. Called serially.
+	write func(b *Batch, writeWAL bool) (*memTable, error)
 }
 
 // A commitPipeline manages the commit commitPipeline: writing batches to the
@@ -212,10 +212,10 @@ func (p *commitPipeline) Close() {
 	p.syncer.Unlock()
 }
 
-// Commit the specified batch, writing it to the WAL, optionally syncing the
+// Commit the specified batch, optionally writing it to the WAL and syncing the
 // WAL, and applying the batch to the memtable. Upon successful return the
 // batch's mutations will be visible for reading.
-func (p *commitPipeline) Commit(b *Batch, syncWAL bool) error {
+func (p *commitPipeline) Commit(b *Batch, writeWAL, syncWAL bool) error {
 	if len(b.data) == 0 {
 		return nil
 	}
@@ -223,7 +223,7 @@ func (p *commitPipeline) Commit(b *Batch, syncWAL bool) error {
 	// Prepare the batch for committing: enqueuing the batch in the pending
 	// queue, determining the batch sequence number and writing the data to the
 	// WAL.
-	mem, err := p.prepare(b, true /* writeWAL */, syncWAL)
+	mem, err := p.prepare(b, writeWAL, syncWAL)
 	if err != nil {
 		// TODO(peter): what to do on error? the pipeline will be horked at this
 		// point.
@@ -298,6 +298,11 @@ func (p *commitPipeline) prepare(b *Batch, writeWAL, syncWAL bool) (*memTable, e
 	if n == invalidBatchCount {
 		return nil, ErrInvalidBatch
 	}
+	if !writeWAL {
+		// There is nothing to sync for a batch which is not written to the
+		// WAL.
+		syncWAL = false
+	}
 	count := 1
 	if syncWAL {
 		count++
@@ -316,12 +321,9 @@ func (p *commitPipeline) prepare(b *Batch, writeWAL, syncWAL bool) (*memTable, e
 	// Assign the batch a sequence number.
 	b.setSeqNum(atomic.AddUint64(p.env.logSeqNum, n) - n)
 
-	// Write the data to the WAL.
-	var mem *memTable
-	var err error
-	if writeWAL {
-		mem, err = p.env.write(b)
-	}
+	// Write the data to the WAL, and determine the memtable the batch is
+	// applied to.
+	mem, err := p.env.write(b, writeWAL)
 
 	p.env.mu.Unlock()
 
@@ -52,7 +52,7 @@ func (e *testCommitEnv) sync() error {
 	return nil
 }
 
-func (e *testCommitEnv) write(b *Batch) (*memTable, error) {
+func (e *testCommitEnv) write(b *Batch, writeWAL bool) (*memTable, error) {
 	n := int64(len(b.data))
 	atomic.AddInt64(&e.writePos, n)
 	atomic.AddUint64(&e.writeCount, 1)
@@ -71,7 +71,7 @@ func TestCommitPipeline(t *testing.T) {
 			defer wg.Done()
 			var b Batch
 			_ = b.Set([]byte(fmt.Sprint(i)), nil, nil)
-			_ = p.Commit(&b, false)
+			_ = p.Commit(&b, true /* writeWAL */, false /* syncWAL */)
 		}(i)
 	}
 	wg.Wait()
@@ -150,7 +150,7 @@ func BenchmarkCommitPipeline(b *testing.B) {
 				sync: func() error {
 					return wal.Sync()
 				},
-				write: func(b *Batch) (*memTable, error) {
+				write: func(b *Batch, writeWAL bool) (*memTable, error) {
 					for {
 						err := mem.prepare(b)
 						if err == arenaskl.ErrArenaFull {
@@ -163,6 +163,9 @@ func BenchmarkCommitPipeline(b *testing.B) {
 						break
 					}
 
+					if !writeWAL {
+						return mem, nil
+					}
 					_, err := wal.WriteRecord(b.data)
 					return mem, err
 				},
@@ -181,7 +184,7 @@ func BenchmarkCommitPipeline(b *testing.B) {
 					batch := newBatch(nil)
 					binary.BigEndian.PutUint64(buf, rng.Uint64())
 					batch.Set(buf, buf, nil)
-					if err := p.Commit(batch, true /* sync */); err != nil {
+					if err := p.Commit(batch, true /* writeWAL */, true /* syncWAL */); err != nil {
 						b.Fatal(err)
 					}
 					batch.release()
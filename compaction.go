@@ -185,6 +185,9 @@ func (d *DB) maybeScheduleFlush() {
 	if d.mu.compact.flushing || d.mu.closed {
 		return
 	}
+	if d.mu.bgError.flushRetry != nil || d.readOnlyError() != nil {
+		return
+	}
 	if len(d.mu.mem.queue) <= 1 {
 		return
 	}
@@ -199,11 +202,13 @@ func (d *DB) maybeScheduleFlush() {
 func (d *DB) flush() {
 	d.mu.Lock()
 	defer d.mu.Unlock()
-	if err := d.flush1(); err != nil {
-		// TODO(peter): count consecutive compaction errors and backoff.
-		_ = err
-	}
+	err := d.flush1()
 	d.mu.compact.flushing = false
+	if err != nil {
+		d.handleBackgroundErrorLocked(err, &d.mu.bgError.flushFailures, &d.mu.bgError.flushRetry)
+	} else {
+		d.mu.bgError.flushFailures = 0
+	}
 	// More flush work may have arrived while we were flushing, so schedule
 	// another flush if needed.
 	d.maybeScheduleFlush()
@@ -418,6 +423,9 @@ func (d *DB) maybeScheduleCompaction() {
 	if d.mu.compact.compacting || d.mu.closed {
 		return
 	}
+	if d.mu.bgError.compactRetry != nil || d.readOnlyError() != nil {
+		return
+	}
 
 	if len(d.mu.compact.manual) > 0 {
 		d.mu.compact.compacting = true
@@ -438,11 +446,13 @@ func (d *DB) maybeScheduleCompaction() {
 func (d *DB) compact() {
 	d.mu.Lock()
 	defer d.mu.Unlock()
-	if err := d.compact1(); err != nil {
-		// TODO(peter): count consecutive compaction errors and backoff.
-		_ = err
-	}
+	err := d.compact1()
 	d.mu.compact.compacting = false
+	if err != nil {
+		d.handleBackgroundErrorLocked(err, &d.mu.bgError.compactFailures, &d.mu.bgError.compactRetry)
+	} else {
+		d.mu.bgError.compactFailures = 0
+	}
 	// The previous compaction may have produced too many files in a
 	// level, so reschedule another compaction if needed.
 	d.maybeScheduleCompaction()
@@ -695,7 +705,23 @@ func (d *DB) deleteObsoleteFiles(jobID int) {
 	defer d.mu.Lock()
 
 	fs := d.opts.Storage
-	list, err := fs.List(d.dirname)
+	d.deleteObsoleteFilesInDir(jobID, fs, d.dirname, liveFileNums, logNumber, manifestFileNumber)
+	if d.walDirname != d.dirname {
+		d.deleteObsoleteFilesInDir(jobID, fs, d.walDirname, liveFileNums, logNumber, manifestFileNumber)
+	}
+}
+
+// deleteObsoleteFilesInDir deletes the obsolete files in dir, which is either
+// the DB directory or the WAL directory. Only log files are deleted from the
+// WAL directory.
+func (d *DB) deleteObsoleteFilesInDir(
+	jobID int,
+	fs storage.Storage,
+	dir string,
+	liveFileNums map[uint64]struct{},
+	logNumber, manifestFileNumber uint64,
+) {
+	list, err := fs.List(dir)
 	if err != nil {
 		// Ignore any filesystem errors.
 		return
@@ -706,7 +732,7 @@ func (d *DB) deleteObsoleteFiles(jobID int) {
 
 	for _, filename := range list {
 		fileType, fileNum, ok := parseDBFilename(filename)
-		if !ok {
+		if !ok || (dir != d.dirname && fileType != fileTypeLog) {
 			continue
 		}
 		keep := true
@@ -714,6 +740,10 @@ func (d *DB) deleteObsoleteFiles(jobID int) {
 		case fileTypeLog:
 			// TODO(peter): also look at prevLogNumber?
 			keep = fileNum >= logNumber
+			if !keep {
+				// Keep the obsolete log for recycling.
+				keep = d.logRecycler.add(fileNum)
+			}
 		case fileTypeManifest:
 			keep = fileNum >= manifestFileNumber
 		case fileTypeOptions:
@@ -727,7 +757,7 @@ func (d *DB) deleteObsoleteFiles(jobID int) {
 		if fileType == fileTypeTable {
 			d.tableCache.evict(fileNum)
 		}
-		path := filepath.Join(d.dirname, filename)
+		path := filepath.Join(dir, filename)
 		err := fs.Remove(path)
 
 		if fileType == fileTypeTable {
@@ -15,6 +15,7 @@ import (
 	"github.com/petermattis/pebble/db"
 	"github.com/petermattis/pebble/internal/arenaskl"
 	"github.com/petermattis/pebble/internal/record"
+	"github.com/petermattis/pebble/storage"
 )
 
 const (
@@ -109,6 +110,27 @@ type DB struct {
 	largeBatchThreshold int
 	optionsFileNum      uint64
 
+	// walDirname is the directory in which new log files are created, which is
+	// dirname unless Options.WALDir is set. logDirs holds the directories
+	// which were searched for log files when the DB was opened, starting with
+	// walDirname.
+	walDirname string
+	logDirs    []string
+
+	// logRecycler holds the obsolete log files which may be reused for new
+	// logs. Logs are only recycled if the WAL recovery mode stops replaying a
+	// log at the stale data left in a recycled log file.
+	logRecycler logRecycler
+
+	// openedReadOnly is true if the DB was opened with OpenReadOnly, in which
+	// case fileLock and mu.log.LogWriter are nil.
+	openedReadOnly bool
+
+	// readOnly holds the *ReadOnlyError which made the DB read-only, or a nil
+	// *ReadOnlyError if the DB accepts writes. It is only modified with mu
+	// held, but may be loaded without it.
+	readOnly atomic.Value
+
 	// Rate limiter for how much bandwidth to allow for commits, compactions, and
 	// flushes.
 	//
@@ -156,8 +178,28 @@ type DB struct {
 			manual         []*manualCompaction
 		}
 
+		// bgError holds the state of the handling of errors encountered by
+		// background flushes and compactions.
+		bgError struct {
+			// readOnlyC is closed when the DB becomes read-only.
+			readOnlyC chan struct{}
+			// The number of consecutive transient errors encountered by flushes
+			// and compactions.
+			flushFailures   int
+			compactFailures int
+			// The timers which retry flushes and compactions after a transient
+			// error. Flushes or compactions are not scheduled while their timer
+			// is non-nil.
+			flushRetry   *time.Timer
+			compactRetry *time.Timer
+		}
+
 		// The list of active snapshots.
 		snapshots snapshotList
+
+		// The log files whose contents have been replayed into memtables by a
+		// DB opened read-only, in increasing order of file number.
+		replayedLogs []*replayedLog
 	}
 }
 
@@ -270,10 +312,13 @@ func (d *DB) Merge(key, value []byte, opts *db.WriteOptions) error {
 //
 // It is safe to modify the contents of the arguments after Apply returns.
 func (d *DB) Apply(batch *Batch, opts *db.WriteOptions) error {
+	if err := d.readOnlyError(); err != nil {
+		return err
+	}
 	if int(batch.memTableSize) >= d.largeBatchThreshold {
 		batch.flushable = newFlushableBatch(batch, d.opts.Comparer)
 	}
-	err := d.commit.Commit(batch, opts.GetSync())
+	err := d.commit.Commit(batch, !opts.GetDisableWAL(), opts.GetSync())
 	if err == nil {
 		// If this is a large batch wait for it to flush. This is necessary as the
 		// caller might mutate the contents of the batch (or reuse it) after this
@@ -312,7 +357,7 @@ func (d *DB) commitSync() error {
 	return log.Sync()
 }
 
-func (d *DB) commitWrite(b *Batch) (*memTable, error) {
+func (d *DB) commitWrite(b *Batch, writeWAL bool) (*memTable, error) {
 	// NB: commitWrite is called with d.mu locked.
 
 	// Throttle writes if there are too many L0 tables.
@@ -328,6 +373,9 @@ func (d *DB) commitWrite(b *Batch) (*memTable, error) {
 		return nil, err
 	}
 
+	if !writeWAL {
+		return d.mu.mem.mutable, nil
+	}
 	_, err := d.mu.log.WriteRecord(b.data)
 	if err != nil {
 		panic(err)
@@ -476,9 +524,17 @@ func (d *DB) Close() error {
 	for d.mu.compact.compacting || d.mu.compact.flushing {
 		d.mu.compact.cond.Wait()
 	}
+	if d.mu.bgError.flushRetry != nil {
+		d.mu.bgError.flushRetry.Stop()
+	}
+	if d.mu.bgError.compactRetry != nil {
+		d.mu.bgError.compactRetry.Stop()
+	}
 	err := d.tableCache.Close()
-	err = firstError(err, d.mu.log.Close())
-	err = firstError(err, d.fileLock.Close())
+	if !d.openedReadOnly {
+		err = firstError(err, d.mu.log.Close())
+		err = firstError(err, d.fileLock.Close())
+	}
 	d.commit.Close()
 	d.mu.closed = true
 
@@ -507,6 +563,10 @@ func (d *DB) Compact(start, end []byte /* CompactionOptions */) error {
 	meta := []*fileMetadata{&fileMetadata{smallest: iStart, largest: iEnd}}
 
 	d.mu.Lock()
+	if err := d.readOnlyError(); err != nil {
+		d.mu.Unlock()
+		return err
+	}
 	maxLevelWithFiles := 1
 	cur := d.mu.versions.currentVersion()
 	for level := 0; level < numLevels; level++ {
@@ -534,13 +594,18 @@ func (d *DB) Compact(start, end []byte /* CompactionOptions */) error {
 		return nil, nil
 	}()
 
+	readOnlyC := d.mu.bgError.readOnlyC
 	d.mu.Unlock()
 
 	if err != nil {
 		return err
 	}
 	if mem != nil {
-		<-mem.flushed()
+		select {
+		case <-mem.flushed():
+		case <-readOnlyC:
+			return d.readOnlyError()
+		}
 	}
 
 	for level := 0; level < maxLevelWithFiles; level++ {
@@ -559,6 +624,10 @@ func (d *DB) Compact(start, end []byte /* CompactionOptions */) error {
 
 func (d *DB) manualCompact(manual *manualCompaction) error {
 	d.mu.Lock()
+	if err := d.readOnlyError(); err != nil {
+		d.mu.Unlock()
+		return err
+	}
 	d.mu.compact.manual = append(d.mu.compact.manual, manual)
 	d.maybeScheduleCompaction()
 	d.mu.Unlock()
@@ -570,14 +639,23 @@ func (d *DB) manualCompact(manual *manualCompaction) error {
 // TODO(peter): untested
 func (d *DB) Flush() error {
 	d.mu.Lock()
+	if err := d.readOnlyError(); err != nil {
+		d.mu.Unlock()
+		return err
+	}
 	mem := d.mu.mem.mutable
 	err := d.makeRoomForWrite(nil)
+	readOnlyC := d.mu.bgError.readOnlyC
 	d.mu.Unlock()
 	if err != nil {
 		return err
 	}
-	<-mem.flushed()
-	return nil
+	select {
+	case <-mem.flushed():
+		return nil
+	case <-readOnlyC:
+		return d.readOnlyError()
+	}
 }
 
 func (d *DB) throttleWrite() {
@@ -596,6 +674,22 @@ func (d *DB) throttleWrite() {
 	d.mu.Lock()
 }
 
+// newLogWriter returns a LogWriter for the log with the given number. Logs
+// are written in the recyclable format if they may be recycled, and their
+// records are compressed if Options.WALCompression is set.
+func (d *DB) newLogWriter(file storage.File, logNum uint64) *record.LogWriter {
+	var w *record.LogWriter
+	if d.logRecycler.limit > 0 {
+		w = record.NewRecyclableLogWriter(file, logNum)
+	} else {
+		w = record.NewLogWriter(file)
+	}
+	if d.opts.WALCompression == db.SnappyCompression {
+		w.EnableCompression()
+	}
+	return w
+}
+
 func (d *DB) makeRoomForWrite(b *Batch) error {
 	force := b == nil || b.flushable != nil
 	for {
@@ -614,14 +708,18 @@ func (d *DB) makeRoomForWrite(b *Batch) error {
 		} else if !force {
 			return nil
 		}
-		if len(d.mu.mem.queue) >= d.opts.MemTableStopWritesThreshold {
+		// NB: Flushes and compactions do not run while the DB is read-only, so
+		// there is no point waiting for them. A write which raced with the DB
+		// becoming read-only is allowed to proceed.
+		readOnly := d.readOnlyError() != nil
+		if len(d.mu.mem.queue) >= d.opts.MemTableStopWritesThreshold && !readOnly {
 			// We have filled up the current memtable, but the previous one is still
 			// being compacted, so we wait.
 			// fmt.Printf("memtable stop writes threshold\n")
 			d.mu.compact.cond.Wait()
 			continue
 		}
-		if len(d.mu.versions.currentVersion().files[0]) > d.opts.L0StopWritesThreshold {
+		if len(d.mu.versions.currentVersion().files[0]) > d.opts.L0StopWritesThreshold && !readOnly {
 			// There are too many level-0 files, so we wait.
 			// fmt.Printf("L0 stop writes threshold\n")
 			d.mu.compact.cond.Wait()
@@ -632,9 +730,28 @@ func (d *DB) makeRoomForWrite(b *Batch) error {
 		d.mu.mem.switching = true
 		d.mu.Unlock()
 
-		newLogFile, err := d.opts.Storage.Create(dbFilename(d.dirname, fileTypeLog, newLogNumber))
+		newLogName := dbFilename(d.walDirname, fileTypeLog, newLogNumber)
+		var newLogFile storage.File
+		var err error
+		if recycleLogNum, ok := d.logRecycler.peek(); ok {
+			recycleLogName := dbFilename(d.walDirname, fileTypeLog, recycleLogNum)
+			newLogFile, err = d.opts.Storage.ReuseForWrite(recycleLogName, newLogName)
+			// The log is no longer available for recycling, even if reusing it
+			// failed, in which case a new log file is created instead.
+			if popErr := d.logRecycler.pop(recycleLogNum); popErr != nil {
+				panic(popErr)
+			}
+		}
+		if newLogFile == nil {
+			newLogFile, err = d.opts.Storage.Create(newLogName)
+		}
 		if err == nil {
-			err = d.mu.log.Close()
+			// The new log must be durably present in the directory before writes
+			// to it are acknowledged.
+			err = syncDir(d.opts.Storage, d.walDirname)
+			if err == nil {
+				err = d.mu.log.Close()
+			}
 			if err != nil {
 				newLogFile.Close()
 			}
@@ -657,7 +774,7 @@ func (d *DB) makeRoomForWrite(b *Batch) error {
 		// versionEdit to the manifest telling it that log files < d.mu.log.number
 		// have been applied.
 		d.mu.log.number = newLogNumber
-		d.mu.log.LogWriter = record.NewLogWriter(newLogFile)
+		d.mu.log.LogWriter = d.newLogWriter(newLogFile, newLogNumber)
 		imm := d.mu.mem.mutable
 		var scheduleFlush bool
 		if b != nil && b.flushable != nil {
@@ -4,6 +4,8 @@
 
 package db
 
+import "time"
+
 // TableInfo contains the common information for table related events.
 type TableInfo struct {
 	// Path is the location of the file on disk.
@@ -45,6 +47,17 @@ type CompactionInfo struct {
 	Err error
 }
 
+// DiskSlowInfo contains the info for a disk slowness event.
+type DiskSlowInfo struct {
+	// Path is the file on which the operation was performed.
+	Path string
+	// OpType is the operation which was slow: "write" or "sync".
+	OpType string
+	// Duration is how long the operation took, or has been in progress if it
+	// has not yet completed.
+	Duration time.Duration
+}
+
 // FlushInfo contains the info for a flush event.
 type FlushInfo struct {
 	// JobID is the ID of the flush job.
@@ -79,6 +92,19 @@ type TableIngestInfo struct {
 	Err          error
 }
 
+// WALCorruptionInfo contains the info for a WAL corruption event, which
+// reports the records dropped from a log file while replaying it when a DB is
+// opened. Which records are dropped depends on Options.WALRecoveryMode.
+type WALCorruptionInfo struct {
+	// Path is the log file from which records were dropped.
+	Path string
+	// Offset is the offset in the log file of the first dropped record. Offset
+	// is 0 if the log file was dropped in its entirety.
+	Offset int64
+	// Err is the error which caused the records to be dropped.
+	Err error
+}
+
 // EventListener contains a set of functions that will be invoked when various
 // significant DB events occur. Note that the functions should not run for an
 // excessive amount of time as they are invokved synchronously by the DB and
@@ -97,6 +123,11 @@ type EventListener struct {
 	// has been installed.
 	CompactionEnd func(CompactionInfo)
 
+	// DiskSlow is invoked after a write or sync to a file has been in progress
+	// for longer than Options.DiskSlowThreshold. The operation may still be in
+	// progress.
+	DiskSlow func(DiskSlowInfo)
+
 	// FlushBegin is invoked after the inputs to a flush have been determined,
 	// but before the flush has produced any output.
 	FlushBegin func(FlushInfo)
@@ -111,4 +142,8 @@ type EventListener struct {
 	// TableIngested is invoked after an externally created table has been
 	// ingested via a call to DB.Ingest().
 	TableIngested func(TableIngestInfo)
+
+	// WALCorruption is invoked when records are dropped from a log file being
+	// replayed because they are corrupt or incomplete.
+	WALCorruption func(WALCorruptionInfo)
 }
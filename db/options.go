@@ -6,7 +6,11 @@ package db
 
 import (
 	"bytes"
+	"errors"
 	"fmt"
+	"strconv"
+	"strings"
+	"time"
 
 	"github.com/petermattis/pebble/cache"
 	"github.com/petermattis/pebble/storage"
@@ -19,6 +23,8 @@ const (
 	DefaultCompression Compression = iota
 	NoCompression
 	SnappyCompression
+	ZstdCompression
+	LZ4Compression
 	nCompression
 )
 
@@ -30,6 +36,33 @@ func (c Compression) String() string {
 		return "NoCompression"
 	case SnappyCompression:
 		return "Snappy"
+	case ZstdCompression:
+		return "ZSTD"
+	case LZ4Compression:
+		return "LZ4"
+	default:
+		return "Unknown"
+	}
+}
+
+// ChecksumType is the algorithm used to checksum sstable blocks.
+type ChecksumType int
+
+const (
+	DefaultChecksum ChecksumType = iota
+	ChecksumCRC32c
+	ChecksumXXHash64
+	nChecksumType
+)
+
+func (c ChecksumType) String() string {
+	switch c {
+	case DefaultChecksum:
+		return "Default"
+	case ChecksumCRC32c:
+		return "CRC32c"
+	case ChecksumXXHash64:
+		return "XXHash64"
 	default:
 		return "Unknown"
 	}
@@ -54,6 +87,43 @@ func (t FilterType) String() string {
 	return "unknown"
 }
 
+// WALRecoveryMode determines how corrupt records in the WAL are handled when
+// a DB is opened.
+type WALRecoveryMode int
+
+const (
+	// WALRecoveryTolerateCorruptedTail drops an incomplete record at the end
+	// of the last non-empty log file, such as is left by a write which was
+	// torn by a power loss. A corrupt record, or an incomplete record
+	// elsewhere, fails the open.
+	WALRecoveryTolerateCorruptedTail WALRecoveryMode = iota
+	// WALRecoveryAbsoluteConsistency fails the open if any record is corrupt
+	// or incomplete.
+	WALRecoveryAbsoluteConsistency
+	// WALRecoveryPointInTime stops replaying the WAL at the first corrupt
+	// record, dropping the remainder of the log file and any subsequent log
+	// files. The DB is recovered to a consistent point in time.
+	WALRecoveryPointInTime
+	// WALRecoverySkipAnyCorruptedRecords skips corrupt records, dropping the
+	// records up to the next intact block, and continues replaying the WAL.
+	WALRecoverySkipAnyCorruptedRecords
+)
+
+func (m WALRecoveryMode) String() string {
+	switch m {
+	case WALRecoveryTolerateCorruptedTail:
+		return "TolerateCorruptedTail"
+	case WALRecoveryAbsoluteConsistency:
+		return "AbsoluteConsistency"
+	case WALRecoveryPointInTime:
+		return "PointInTime"
+	case WALRecoverySkipAnyCorruptedRecords:
+		return "SkipAnyCorruptedRecords"
+	default:
+		return "Unknown"
+	}
+}
+
 // FilterWriter provides an interface for creating filter blocks. See
 // FilterPolicy for more details about filters.
 type FilterWriter interface {
@@ -91,6 +161,62 @@ type FilterPolicy interface {
 	NewWriter(ftype FilterType) FilterWriter
 }
 
+// Cache is the interface for the cache of uncompressed sstable blocks. Cache
+// entries are identified by the number of the file containing the block and
+// the offset of the block within the file. A single Cache may be shared by
+// multiple DBs, but the DBs must then use disjoint file numbers (for example,
+// by using a Cache wrapper which remaps the file numbers of each DB).
+//
+// The canonical implementation is the sharded CLOCK-Pro cache returned by
+// cache.New. Implementations must be safe for concurrent use.
+type Cache interface {
+	// Get retrieves the cached value for the specified file and offset,
+	// returning nil if no value is present.
+	Get(fileNum, offset uint64) []byte
+
+	// Set sets the cached value for the specified file and offset,
+	// overwriting an existing value if present. The priority indicates the
+	// importance of keeping the value cached: index and filter blocks are
+	// cached with cache.HighPriority and data blocks with cache.LowPriority.
+	// The returned WeakHandle, which may be nil, provides fast retrieval of the
+	// value for as long as it remains in the cache.
+	Set(fileNum, offset uint64, value []byte, pri cache.Priority) cache.WeakHandle
+
+	// EvictFile evicts all of the cached values for the specified file.
+	EvictFile(fileNum uint64)
+
+	// Size returns the current space used by the cache.
+	Size() int64
+
+	// MaxSize returns the capacity of the cache.
+	MaxSize() int64
+}
+
+// SecondaryCache is the interface for a cache of sstable blocks which sits
+// below the block cache, such as a cache stored on a local SSD. It holds the
+// blocks evicted from the block cache, in the same (decompressed) form and
+// identified in the same way as for Cache. The secondary cache is responsible
+// for detecting the corruption of the blocks it stores.
+//
+// The canonical implementation is cache.PersistentCache, which is filled by
+// the block cache as blocks are evicted (see cache.Options.OnEvict).
+// Implementations must be safe for concurrent use.
+type SecondaryCache interface {
+	// Get retrieves the block for the specified file and offset, returning nil
+	// if the block is not present.
+	Get(fileNum, offset uint64) []byte
+
+	// EvictFile evicts all of the blocks for the specified file.
+	EvictFile(fileNum uint64)
+}
+
+func cacheSize(c Cache) int64 {
+	if c == nil {
+		return 0
+	}
+	return c.MaxSize()
+}
+
 func filterPolicyName(p FilterPolicy) string {
 	if p == nil {
 		return "none"
@@ -118,11 +244,32 @@ type LevelOptions struct {
 	// The default value is 90
 	BlockSizeThreshold int
 
-	// Compression defines the per-block compression to use.
+	// Compression defines the per-block compression to use. Different levels
+	// may use different compression algorithms. A common configuration is to
+	// use snappy for the upper levels and zstd for the bottom level, trading
+	// CPU for a better compression ratio on the bulk of the data.
 	//
 	// The default value (DefaultCompression) uses snappy compression.
 	Compression Compression
 
+	// CompressionDictSize is the maximum size in bytes of a compression
+	// dictionary trained from the first data blocks of each sstable. The
+	// dictionary is stored in the sstable and used to compress the remaining
+	// data blocks, which improves the compression ratio of small blocks with
+	// similar contents. Only used with ZstdCompression.
+	//
+	// The default value (0) disables dictionary compression.
+	CompressionDictSize int
+
+	// DataBlockHashIndex appends a hash index to each data block which maps
+	// user keys to the restart interval containing them. Point lookups use the
+	// hash index to avoid the binary search over the block's restart points,
+	// at the cost of roughly one byte per key of additional space. Tables
+	// written with this option cannot be read by older versions of Pebble.
+	//
+	// The default value is false.
+	DataBlockHashIndex bool
+
 	// FilterPolicy defines a filter algorithm (such as a Bloom filter) that can
 	// reduce disk reads for Get calls.
 	//
@@ -141,6 +288,25 @@ type LevelOptions struct {
 	// filters should be preferred except under constrained memory situations.
 	FilterType FilterType
 
+	// PartitionFilters splits table-level filters into partitions aligned with
+	// the index partitions (see IndexBlockSize), along with a top-level filter
+	// index. A point lookup only needs to load the filter partition covering
+	// the key sought, rather than the filter for the entire table. Ignored
+	// unless FilterType is TableFilter.
+	//
+	// The default value is false.
+	PartitionFilters bool
+
+	// IndexBlockSize is the target uncompressed size in bytes of each index
+	// block. When the index of an sstable grows larger than this target, the
+	// index is partitioned into multiple blocks with a top-level index over
+	// the partitions. Partitions are loaded on demand through the block cache,
+	// so only the top-level index needs to be resident to serve lookups. This
+	// is intended for levels with very large tables, such as the bottom level.
+	//
+	// The default value is 0, which writes the index as a single block.
+	IndexBlockSize int
+
 	// The target file size for the level.
 	TargetFileSize int64
 }
@@ -182,8 +348,19 @@ type Options struct {
 	// The default value is 512KB.
 	BytesPerSync int
 
-	// TODO(peter): provide a cache interface.
-	Cache *cache.Cache
+	// Cache is used to cache uncompressed blocks from sstables.
+	//
+	// The default value is nil, which disables block caching. Use cache.New
+	// to create the default CLOCK-Pro cache.
+	Cache Cache
+
+	// Checksum is the algorithm used to checksum the blocks of newly written
+	// sstables. The algorithm is recorded in each sstable's footer, so
+	// sstables written with different algorithms can be read regardless of
+	// this setting, allowing the algorithm to be changed for an existing DB.
+	//
+	// The default value (DefaultChecksum) uses CRC32c.
+	Checksum ChecksumType
 
 	// Comparer defines a total ordering over the space of []byte keys: a 'less
 	// than' relationship. The same comparison algorithm must be used for reads
@@ -192,6 +369,21 @@ type Options struct {
 	// The default value uses the same ordering as bytes.Compare.
 	Comparer *Comparer
 
+	// DiskSlowThreshold enables monitoring of the health of the disk. Writes
+	// and syncs to files which take longer than DiskSlowThreshold are logged
+	// and reported through EventListener.DiskSlow.
+	//
+	// The default value is 0, which disables disk health monitoring.
+	DiskSlowThreshold time.Duration
+
+	// DiskStallTimeout is the duration after which a write or sync which has
+	// not completed is considered to have stalled, in which case the DB fails
+	// with a fatal error rather than blocking indefinitely. It only applies if
+	// DiskSlowThreshold is set.
+	//
+	// The default value is 0, which disables the timeout.
+	DiskStallTimeout time.Duration
+
 	// ErrorIfDBExists is whether it is an error if the database already exists.
 	//
 	// The default value is false.
@@ -226,6 +418,14 @@ type Options struct {
 	// The default logger uses the Go standard library log package.
 	Logger Logger
 
+	// MaxManifestFileSize is the size of the MANIFEST above which a new
+	// MANIFEST is started, containing a snapshot of the current version. The
+	// MANIFEST otherwise grows with every flush and compaction, and is read in
+	// full when the DB is opened.
+	//
+	// The default value is 128 MB.
+	MaxManifestFileSize int64
+
 	// MaxOpenFiles is a soft limit on the number of open files that can be
 	// used by the DB.
 	//
@@ -250,10 +450,74 @@ type Options struct {
 	// The default merger concatenates values.
 	Merger *Merger
 
+	// PinL0IndexAndFilterBlocks holds the index and filter blocks of L0 tables
+	// in memory for as long as the table is in L0, rather than relying on the
+	// block cache to retain them. Every lookup consults every L0 table, so
+	// evicting their metadata from the cache is particularly costly.
+	//
+	// The default value is false.
+	PinL0IndexAndFilterBlocks bool
+
+	// SecondaryCache is consulted for blocks which are not present in Cache
+	// before reading them from an sstable. Blocks are added to the secondary
+	// cache when they are evicted from Cache, which must be created with
+	// cache.Options.OnEvict set accordingly. See cache.NewPersistentCache.
+	//
+	// The default value is nil, which disables the secondary cache.
+	SecondaryCache SecondaryCache
+
 	// Storage maps file names to byte storage.
 	//
 	// The default value uses the underlying operating system's file system.
 	Storage storage.Storage
+
+	// UseDirectIO reads and writes the sstables and log files of the DB with
+	// direct I/O, bypassing the operating system's page cache. Other files,
+	// such as the MANIFEST, are accessed normally. See storage.DirectIO. It is
+	// ignored unless Storage is storage.Default.
+	//
+	// The default value is false.
+	UseDirectIO bool
+
+	// WALCompression is the compression applied to the records of the WAL,
+	// reducing the bandwidth used by writes whose batches are compressible.
+	// Each record is compressed independently, and is left uncompressed if
+	// compression would not reduce its size. Logs written with and without
+	// compression can be replayed alike, but logs containing compressed
+	// records cannot be read by earlier versions.
+	//
+	// Only SnappyCompression is supported. The default value, and any other
+	// value, leaves records uncompressed.
+	WALCompression Compression
+
+	// WALDir is the directory in which the log files of the WAL are stored,
+	// allowing them to be placed on a different device from the tables, such
+	// as a small, fast log device. The WAL directory of a DB is recorded in
+	// its OPTIONS file, so the log files remaining in the previous WAL
+	// directory are replayed when a DB is opened with a different WALDir.
+	//
+	// The default value is "", which stores the log files in the DB's
+	// directory.
+	WALDir string
+
+	// WALRecoveryMode determines how corrupt records in the WAL are handled
+	// when the DB is opened. The records which are dropped are reported
+	// through EventListener.WALCorruption.
+	//
+	// The default value is WALRecoveryTolerateCorruptedTail.
+	WALRecoveryMode WALRecoveryMode
+
+	// WALRecycleLimit is the maximum number of obsolete log files which are
+	// kept for reuse by new logs, avoiding the cost of allocating a new file
+	// and syncing its metadata. The logs of a DB which recycles log files are
+	// written in a format which identifies the stale data of a recycled file,
+	// but in which replaying a log stops at a corrupt record where a record
+	// should begin as it does at the end of the log. Log files are therefore
+	// only recycled if WALRecoveryMode is WALRecoveryTolerateCorruptedTail or
+	// WALRecoveryPointInTime.
+	//
+	// The default value is 0, which disables recycling.
+	WALRecycleLimit int
 }
 
 // EnsureDefaults ensures that the default values for all options are set if a
@@ -265,6 +529,9 @@ func (o *Options) EnsureDefaults() *Options {
 	if o.BytesPerSync <= 0 {
 		o.BytesPerSync = 512 << 10
 	}
+	if o.Checksum <= DefaultChecksum || o.Checksum >= nChecksumType {
+		o.Checksum = ChecksumCRC32c
+	}
 	if o.Comparer == nil {
 		o.Comparer = DefaultComparer
 	}
@@ -299,6 +566,9 @@ func (o *Options) EnsureDefaults() *Options {
 	if o.Logger == nil {
 		o.Logger = defaultLogger{}
 	}
+	if o.MaxManifestFileSize <= 0 {
+		o.MaxManifestFileSize = 128 << 20
+	}
 	if o.MaxOpenFiles == 0 {
 		o.MaxOpenFiles = 1000
 	}
@@ -314,6 +584,9 @@ func (o *Options) EnsureDefaults() *Options {
 	if o.Storage == nil {
 		o.Storage = storage.Default
 	}
+	if o.WALCompression != SnappyCompression && o.WALCompression != NoCompression {
+		o.WALCompression = NoCompression
+	}
 	return o
 }
 
@@ -338,16 +611,26 @@ func (o *Options) String() string {
 	fmt.Fprintf(&buf, "\n")
 	fmt.Fprintf(&buf, "[Options]\n")
 	fmt.Fprintf(&buf, "  bytes_per_sync=%d\n", o.BytesPerSync)
-	fmt.Fprintf(&buf, "  cache_size=%d\n", o.Cache.MaxSize())
+	fmt.Fprintf(&buf, "  cache_size=%d\n", cacheSize(o.Cache))
+	fmt.Fprintf(&buf, "  checksum=%s\n", o.Checksum)
 	fmt.Fprintf(&buf, "  comparer=%s\n", o.Comparer.Name)
+	fmt.Fprintf(&buf, "  disk_slow_threshold=%s\n", o.DiskSlowThreshold)
+	fmt.Fprintf(&buf, "  disk_stall_timeout=%s\n", o.DiskStallTimeout)
 	fmt.Fprintf(&buf, "  l0_compaction_threshold=%d\n", o.L0CompactionThreshold)
 	fmt.Fprintf(&buf, "  l0_slowdown_writes_threshold=%d\n", o.L0SlowdownWritesThreshold)
 	fmt.Fprintf(&buf, "  l0_stop_writes_threshold=%d\n", o.L0StopWritesThreshold)
 	fmt.Fprintf(&buf, "  l1_max_bytes=%d\n", o.L1MaxBytes)
+	fmt.Fprintf(&buf, "  max_manifest_file_size=%d\n", o.MaxManifestFileSize)
 	fmt.Fprintf(&buf, "  max_open_files=%d\n", o.MaxOpenFiles)
 	fmt.Fprintf(&buf, "  mem_table_size=%d\n", o.MemTableSize)
 	fmt.Fprintf(&buf, "  mem_table_stop_writes_threshold=%d\n", o.MemTableStopWritesThreshold)
 	fmt.Fprintf(&buf, "  merger=%s\n", o.Merger.Name)
+	fmt.Fprintf(&buf, "  pin_l0_index_and_filter_blocks=%t\n", o.PinL0IndexAndFilterBlocks)
+	fmt.Fprintf(&buf, "  use_direct_io=%t\n", o.UseDirectIO)
+	fmt.Fprintf(&buf, "  wal_compression=%s\n", o.WALCompression)
+	fmt.Fprintf(&buf, "  wal_dir=%s\n", o.WALDir)
+	fmt.Fprintf(&buf, "  wal_recovery_mode=%s\n", o.WALRecoveryMode)
+	fmt.Fprintf(&buf, "  wal_recycle_limit=%d\n", o.WALRecycleLimit)
 
 	for i := range o.Levels {
 		l := &o.Levels[i]
@@ -356,14 +639,229 @@ func (o *Options) String() string {
 		fmt.Fprintf(&buf, "  block_restart_interval=%d\n", l.BlockRestartInterval)
 		fmt.Fprintf(&buf, "  block_size=%d\n", l.BlockSize)
 		fmt.Fprintf(&buf, "  compression=%s\n", l.Compression)
+		fmt.Fprintf(&buf, "  compression_dict_size=%d\n", l.CompressionDictSize)
+		fmt.Fprintf(&buf, "  data_block_hash_index=%t\n", l.DataBlockHashIndex)
 		fmt.Fprintf(&buf, "  filter_policy=%s\n", filterPolicyName(l.FilterPolicy))
 		fmt.Fprintf(&buf, "  filter_type=%s\n", l.FilterType)
+		fmt.Fprintf(&buf, "  index_block_size=%d\n", l.IndexBlockSize)
+		fmt.Fprintf(&buf, "  partition_filters=%t\n", l.PartitionFilters)
 		fmt.Fprintf(&buf, "  target_file_size=%d\n", l.TargetFileSize)
 	}
 
 	return buf.String()
 }
 
+// ParseHooks contains the callbacks used by ParseOptions to construct the
+// parts of the Options which an OPTIONS file records by name only. A nil
+// callback only recognizes the names of the defaults.
+type ParseHooks struct {
+	// NewComparer returns the Comparer with the given name. Without it, only
+	// the name of DefaultComparer is recognized.
+	NewComparer func(name string) (*Comparer, error)
+	// NewMerger returns the Merger with the given name. Without it, only the
+	// name of DefaultMerger is recognized.
+	NewMerger func(name string) (*Merger, error)
+	// NewFilterPolicy returns the FilterPolicy with the given name. It is not
+	// called for levels without a filter policy. Without it, a level with a
+	// filter policy cannot be parsed.
+	NewFilterPolicy func(name string) (FilterPolicy, error)
+	// SkipOption returns true if the value of the given key in the given
+	// section should not be parsed, leaving it unset. Skipped values are not
+	// validated, so a caller only interested in some of the options is not
+	// affected by the values of the others. Without it, every value is parsed.
+	SkipOption func(section, key string) bool
+}
+
+// ParseOptions parses the contents of an OPTIONS file written by
+// Options.String. The Cache is recreated with the recorded size, while the
+// Comparer, Merger and FilterPolicies are constructed by hooks, which may be
+// nil. The Storage, Logger, EventListener and SecondaryCache are not recorded
+// and are left unset. Unknown sections and keys are ignored, such as those of
+// an OPTIONS file written by RocksDB.
+func ParseOptions(s string, hooks *ParseHooks) (*Options, error) {
+	if hooks == nil {
+		hooks = &ParseHooks{}
+	}
+	o := &Options{}
+	var section string
+	for _, line := range strings.Split(s, "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || line[0] == '#' {
+			continue
+		}
+		if line[0] == '[' {
+			if line[len(line)-1] != ']' {
+				return nil, fmt.Errorf("pebble: invalid OPTIONS line: %q", line)
+			}
+			section = line[1 : len(line)-1]
+			continue
+		}
+		i := strings.IndexByte(line, '=')
+		if i < 0 {
+			return nil, fmt.Errorf("pebble: invalid OPTIONS line: %q", line)
+		}
+		key, value := strings.TrimSpace(line[:i]), strings.TrimSpace(line[i+1:])
+		if hooks.SkipOption != nil && hooks.SkipOption(section, key) {
+			continue
+		}
+
+		var err error
+		switch {
+		case section == "Options":
+			err = o.parseOption(key, value, hooks)
+		case strings.HasPrefix(section, "Level "):
+			var level int
+			level, err = strconv.Atoi(strings.Trim(section[len("Level "):], `"`))
+			if err != nil || level < 0 {
+				return nil, fmt.Errorf("pebble: invalid OPTIONS section: %q", section)
+			}
+			for len(o.Levels) <= level {
+				o.Levels = append(o.Levels, LevelOptions{})
+			}
+			err = o.Levels[level].parseOption(key, value, hooks)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("pebble: invalid OPTIONS value for %s: %q: %v", key, value, err)
+		}
+	}
+	return o, nil
+}
+
+func (o *Options) parseOption(key, value string, hooks *ParseHooks) error {
+	var err error
+	switch key {
+	case "bytes_per_sync":
+		o.BytesPerSync, err = strconv.Atoi(value)
+	case "cache_size":
+		var size int64
+		size, err = strconv.ParseInt(value, 10, 64)
+		if err == nil && size > 0 {
+			o.Cache = cache.New(size)
+		}
+	case "checksum":
+		o.Checksum, err = parseChecksumType(value)
+	case "comparer":
+		switch {
+		case hooks.NewComparer != nil:
+			o.Comparer, err = hooks.NewComparer(value)
+		case value == DefaultComparer.Name:
+			o.Comparer = DefaultComparer
+		default:
+			err = errors.New("unknown comparer")
+		}
+	case "disk_slow_threshold":
+		o.DiskSlowThreshold, err = time.ParseDuration(value)
+	case "disk_stall_timeout":
+		o.DiskStallTimeout, err = time.ParseDuration(value)
+	case "l0_compaction_threshold":
+		o.L0CompactionThreshold, err = strconv.Atoi(value)
+	case "l0_slowdown_writes_threshold":
+		o.L0SlowdownWritesThreshold, err = strconv.Atoi(value)
+	case "l0_stop_writes_threshold":
+		o.L0StopWritesThreshold, err = strconv.Atoi(value)
+	case "l1_max_bytes":
+		o.L1MaxBytes, err = strconv.ParseInt(value, 10, 64)
+	case "max_manifest_file_size":
+		o.MaxManifestFileSize, err = strconv.ParseInt(value, 10, 64)
+	case "max_open_files":
+		o.MaxOpenFiles, err = strconv.Atoi(value)
+	case "mem_table_size":
+		o.MemTableSize, err = strconv.Atoi(value)
+	case "mem_table_stop_writes_threshold":
+		o.MemTableStopWritesThreshold, err = strconv.Atoi(value)
+	case "merger":
+		switch {
+		case hooks.NewMerger != nil:
+			o.Merger, err = hooks.NewMerger(value)
+		case value == DefaultMerger.Name:
+			o.Merger = DefaultMerger
+		default:
+			err = errors.New("unknown merger")
+		}
+	case "pin_l0_index_and_filter_blocks":
+		o.PinL0IndexAndFilterBlocks, err = strconv.ParseBool(value)
+	case "use_direct_io":
+		o.UseDirectIO, err = strconv.ParseBool(value)
+	case "wal_compression":
+		o.WALCompression, err = parseCompression(value)
+	case "wal_dir":
+		o.WALDir = value
+	case "wal_recovery_mode":
+		o.WALRecoveryMode, err = parseWALRecoveryMode(value)
+	case "wal_recycle_limit":
+		o.WALRecycleLimit, err = strconv.Atoi(value)
+	}
+	return err
+}
+
+func (l *LevelOptions) parseOption(key, value string, hooks *ParseHooks) error {
+	var err error
+	switch key {
+	case "block_restart_interval":
+		l.BlockRestartInterval, err = strconv.Atoi(value)
+	case "block_size":
+		l.BlockSize, err = strconv.Atoi(value)
+	case "compression":
+		l.Compression, err = parseCompression(value)
+	case "compression_dict_size":
+		l.CompressionDictSize, err = strconv.Atoi(value)
+	case "data_block_hash_index":
+		l.DataBlockHashIndex, err = strconv.ParseBool(value)
+	case "filter_policy":
+		switch {
+		case value == "none":
+			l.FilterPolicy = nil
+		case hooks.NewFilterPolicy != nil:
+			l.FilterPolicy, err = hooks.NewFilterPolicy(value)
+		default:
+			err = errors.New("unknown filter policy")
+		}
+	case "filter_type":
+		switch value {
+		case BlockFilter.String():
+			l.FilterType = BlockFilter
+		case TableFilter.String():
+			l.FilterType = TableFilter
+		default:
+			err = errors.New("unknown filter type")
+		}
+	case "index_block_size":
+		l.IndexBlockSize, err = strconv.Atoi(value)
+	case "partition_filters":
+		l.PartitionFilters, err = strconv.ParseBool(value)
+	case "target_file_size":
+		l.TargetFileSize, err = strconv.ParseInt(value, 10, 64)
+	}
+	return err
+}
+
+func parseCompression(s string) (Compression, error) {
+	for c := DefaultCompression; c < nCompression; c++ {
+		if c.String() == s {
+			return c, nil
+		}
+	}
+	return 0, errors.New("unknown compression")
+}
+
+func parseChecksumType(s string) (ChecksumType, error) {
+	for c := DefaultChecksum; c < nChecksumType; c++ {
+		if c.String() == s {
+			return c, nil
+		}
+	}
+	return 0, errors.New("unknown checksum")
+}
+
+func parseWALRecoveryMode(s string) (WALRecoveryMode, error) {
+	for m := WALRecoveryTolerateCorruptedTail; m <= WALRecoverySkipAnyCorruptedRecords; m++ {
+		if m.String() == s {
+			return m, nil
+		}
+	}
+	return 0, errors.New("unknown WAL recovery mode")
+}
+
 // IterOptions hold the optional per-query parameters for NewIter.
 //
 // Like Options, a nil *IterOptions is valid and means to use the default
@@ -422,6 +920,19 @@ type WriteOptions struct {
 	//
 	// The default value is true.
 	Sync bool
+
+	// DisableWAL is whether to skip writing to the WAL. The write is applied
+	// to the memtable and is visible to reads, but is lost if the DB is closed
+	// or the process crashes before the memtable is flushed. DB.Flush makes
+	// such writes durable. Sync has no effect on a write which skips the WAL.
+	//
+	// DisableWAL is intended for data which can be rebuilt, such as caches
+	// and bulk loads which are flushed on completion. A write which skips the
+	// WAL may be lost by a crash while a later write which does not skip it is
+	// recovered.
+	//
+	// The default value is false.
+	DisableWAL bool
 }
 
 // Sync specifies the default write options for writes which synchronize to
@@ -436,3 +947,8 @@ var NoSync = &WriteOptions{Sync: false}
 func (o *WriteOptions) GetSync() bool {
 	return o == nil || o.Sync
 }
+
+// GetDisableWAL returns the DisableWAL value or false if the receiver is nil.
+func (o *WriteOptions) GetDisableWAL() bool {
+	return o != nil && o.DisableWAL
+}
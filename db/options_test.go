@@ -6,6 +6,9 @@ package db
 
 import (
 	"testing"
+	"time"
+
+	"github.com/petermattis/pebble/cache"
 )
 
 func TestLevelOptions(t *testing.T) {
@@ -40,22 +43,36 @@ func TestOptionsString(t *testing.T) {
 [Options]
   bytes_per_sync=524288
   cache_size=0
+  checksum=CRC32c
   comparer=leveldb.BytewiseComparator
+  disk_slow_threshold=0s
+  disk_stall_timeout=0s
   l0_compaction_threshold=4
   l0_slowdown_writes_threshold=8
   l0_stop_writes_threshold=12
   l1_max_bytes=67108864
+  max_manifest_file_size=134217728
   max_open_files=1000
   mem_table_size=4194304
   mem_table_stop_writes_threshold=2
   merger=pebble.concatenate
+  pin_l0_index_and_filter_blocks=false
+  use_direct_io=false
+  wal_compression=NoCompression
+  wal_dir=
+  wal_recovery_mode=TolerateCorruptedTail
+  wal_recycle_limit=0
 
 [Level "0"]
   block_restart_interval=16
   block_size=4096
   compression=Snappy
+  compression_dict_size=0
+  data_block_hash_index=false
   filter_policy=none
   filter_type=block
+  index_block_size=0
+  partition_filters=false
   target_file_size=4194304
 `
 
@@ -65,3 +82,97 @@ func TestOptionsString(t *testing.T) {
 		t.Fatalf("expected\n%s\nbut found\n%s", expected, v)
 	}
 }
+
+type testFilterPolicy struct {
+	FilterPolicy
+	name string
+}
+
+func (p testFilterPolicy) Name() string {
+	return p.name
+}
+
+func TestParseOptions(t *testing.T) {
+	opts := &Options{
+		BytesPerSync:      1 << 10,
+		Cache:             cache.New(8 << 20),
+		Checksum:          ChecksumXXHash64,
+		DiskSlowThreshold: 5 * time.Second,
+		Levels: []LevelOptions{
+			{Compression: NoCompression},
+			{
+				Compression:  ZstdCompression,
+				FilterPolicy: testFilterPolicy{name: "test.filter"},
+				FilterType:   TableFilter,
+			},
+		},
+		WALCompression:  SnappyCompression,
+		WALDir:          "wal",
+		WALRecoveryMode: WALRecoveryPointInTime,
+		WALRecycleLimit: 3,
+	}
+	opts = opts.EnsureDefaults()
+
+	hooks := &ParseHooks{
+		NewFilterPolicy: func(name string) (FilterPolicy, error) {
+			return testFilterPolicy{name: name}, nil
+		},
+	}
+	parsed, err := ParseOptions(opts.String(), hooks)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if parsed.Comparer != DefaultComparer || parsed.Merger != DefaultMerger {
+		t.Fatalf("expected the default comparer and merger")
+	}
+	if expected, actual := opts.String(), parsed.String(); expected != actual {
+		t.Fatalf("expected\n%s\nbut found\n%s", expected, actual)
+	}
+
+	// A filter policy, comparer or merger which cannot be constructed is an
+	// error.
+	if _, err := ParseOptions(opts.String(), nil); err == nil {
+		t.Fatal("expected error parsing an unknown filter policy")
+	}
+	custom := *opts
+	custom.Levels = nil
+	custom.Comparer = &Comparer{Name: "test.comparer"}
+	if _, err := ParseOptions(custom.String(), nil); err == nil {
+		t.Fatal("expected error parsing an unknown comparer")
+	}
+
+	testCases := []string{
+		"[Options]\n  bytes_per_sync\n",
+		"[Options]\n  bytes_per_sync=x\n",
+		"[Options]\n  wal_recovery_mode=Unknown\n",
+		"[Level \"x\"]\n  block_size=1\n",
+		"[Options\n",
+	}
+	for _, s := range testCases {
+		if _, err := ParseOptions(s, nil); err == nil {
+			t.Fatalf("expected error parsing %q", s)
+		}
+	}
+
+	// Unknown sections and keys are ignored.
+	parsed, err = ParseOptions("# comment\n[DBOptions]\n  wal_dir=x\n[Options]\n  unknown=1\n  wal_dir=y\n", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if parsed.WALDir != "y" {
+		t.Fatalf("expected WAL dir y, but found %q", parsed.WALDir)
+	}
+
+	// Skipped options are not parsed.
+	skipHooks := &ParseHooks{
+		SkipOption: func(section, key string) bool { return key != "wal_dir" },
+	}
+	parsed, err = ParseOptions("[Options]\n  bytes_per_sync=x\n  cache_size=1024\n  wal_dir=y\n"+
+		"[Level \"x\"]\n  block_size=1\n", skipHooks)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if parsed.WALDir != "y" || parsed.Cache != nil {
+		t.Fatalf("expected only the WAL dir to be parsed, but found\n%s", parsed)
+	}
+}
@@ -9,8 +9,11 @@ import (
 	"errors"
 	"fmt"
 	"io"
+	"io/ioutil"
 	"math/rand"
 	"os"
+	"path/filepath"
+	"reflect"
 	"strconv"
 	"strings"
 	"sync"
@@ -539,6 +542,154 @@ func TestIterLeak(t *testing.T) {
 	}
 }
 
+func TestPinL0IndexAndFilterBlocks(t *testing.T) {
+	cache := cache.New(10 << 20)
+	d, err := Open("", &db.Options{
+		Cache:                     cache,
+		PinL0IndexAndFilterBlocks: true,
+		Storage:                   storage.NewMem(),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 0; i < 1000; i++ {
+		key := []byte(fmt.Sprintf("%04d", i))
+		if err := d.Set(key, key, nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := d.Flush(); err != nil {
+		t.Fatal(err)
+	}
+
+	d.mu.Lock()
+	l0 := d.mu.versions.currentVersion().files[0]
+	d.mu.Unlock()
+	if len(l0) != 1 {
+		t.Fatalf("expected 1 L0 table, but found %d", len(l0))
+	}
+	fileNum := l0[0].fileNum
+	if !d.tableCache.isL0Table(fileNum) {
+		t.Fatalf("expected table %d to be recorded as an L0 table", fileNum)
+	}
+
+	// Evicting the table's blocks from the block cache does not affect the
+	// pinned index block.
+	if _, err := d.Get([]byte("0001")); err != nil {
+		t.Fatal(err)
+	}
+	cache.EvictFile(fileNum)
+	if _, err := d.Get([]byte("0001")); err != nil {
+		t.Fatal(err)
+	}
+	pinnedSize := cache.Size()
+	for i := 0; i < 1000; i += 100 {
+		key := []byte(fmt.Sprintf("%04d", i))
+		if v, err := d.Get(key); err != nil {
+			t.Fatal(err)
+		} else if string(v) != string(key) {
+			t.Fatalf("expected %s, but found %s", key, v)
+		}
+	}
+
+	if err := d.Compact([]byte("0"), []byte("1")); err != nil {
+		t.Fatal(err)
+	}
+	d.mu.Lock()
+	l0 = d.mu.versions.currentVersion().files[0]
+	d.mu.Unlock()
+	if len(l0) != 0 {
+		t.Fatalf("expected no L0 tables, but found %d", len(l0))
+	}
+	if d.tableCache.isL0Table(fileNum) {
+		t.Fatalf("expected table %d to no longer be an L0 table", fileNum)
+	}
+
+	// The table was moved to L1, and its index block is no longer pinned, so
+	// reading the same data block also caches the index block.
+	d.mu.Lock()
+	l1 := d.mu.versions.currentVersion().files[1]
+	d.mu.Unlock()
+	if len(l1) != 1 || l1[0].fileNum != fileNum {
+		t.Fatalf("expected table %d to be moved to L1", fileNum)
+	}
+	cache.EvictFile(fileNum)
+	if _, err := d.Get([]byte("0001")); err != nil {
+		t.Fatal(err)
+	}
+	if size := cache.Size(); size <= pinnedSize {
+		t.Fatalf("expected the index block to be cached, but found size %d <= %d", size, pinnedSize)
+	}
+
+	if err := d.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestDirectIO(t *testing.T) {
+	dir, err := ioutil.TempDir("", "pebble-direct-io")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	opts := &db.Options{
+		Cache:       cache.New(1 << 20),
+		UseDirectIO: true,
+	}
+	d, err := Open(dir, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fs, ok := d.opts.Storage.(directIOStorage)
+	if !ok {
+		t.Fatalf("expected direct I/O storage, but found %T", d.opts.Storage)
+	}
+	for name, expected := range map[string]bool{
+		"000003.log": true, "000004.sst": true, "MANIFEST-000001": false, "OPTIONS-000005": false,
+	} {
+		if direct := fs.direct(filepath.Join(dir, name)); direct != expected {
+			t.Fatalf("%s: expected direct I/O %t, but found %t", name, expected, direct)
+		}
+	}
+	for i := 0; i < 1000; i++ {
+		key := []byte(fmt.Sprintf("%04d", i))
+		if err := d.Set(key, key, db.Sync); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := d.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	for i := 1000; i < 1100; i++ {
+		key := []byte(fmt.Sprintf("%04d", i))
+		if err := d.Set(key, key, db.Sync); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := d.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// Reopen the DB, replaying the WAL and reading the flushed table.
+	d, err = Open(dir, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 1100; i += 50 {
+		key := []byte(fmt.Sprintf("%04d", i))
+		if v, err := d.Get(key); err != nil {
+			t.Fatalf("%s: %v", key, err)
+		} else if !bytes.Equal(key, v) {
+			t.Fatalf("expected %s, but found %s", key, v)
+		}
+	}
+	if err := d.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
+
 func TestCacheEvict(t *testing.T) {
 	cache := cache.New(10 << 20)
 	d, err := Open("", &db.Options{
@@ -588,3 +739,175 @@ func TestCacheEvict(t *testing.T) {
 		t.Fatal(err)
 	}
 }
+
+func TestEncryptedStorage(t *testing.T) {
+	fs, err := storage.NewEncrypted(storage.NewMem(), "KEYS", bytes.Repeat([]byte("k"), 32))
+	if err != nil {
+		t.Fatal(err)
+	}
+	opts := &db.Options{
+		Storage: fs,
+	}
+	d, err := Open("", opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 1000; i++ {
+		key := []byte(fmt.Sprintf("%04d", i))
+		if err := d.Set(key, key, nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := d.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	// Tables written after rotating the key remain readable alongside those
+	// written before.
+	if err := fs.RotateKey(); err != nil {
+		t.Fatal(err)
+	}
+	for i := 1000; i < 1100; i++ {
+		key := []byte(fmt.Sprintf("%04d", i))
+		if err := d.Set(key, key, nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := d.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	for i := 1100; i < 1200; i++ {
+		key := []byte(fmt.Sprintf("%04d", i))
+		if err := d.Set(key, key, nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := d.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// Reopen the DB, replaying the WAL and reading the flushed tables.
+	d, err = Open("", opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 1200; i += 50 {
+		key := []byte(fmt.Sprintf("%04d", i))
+		if v, err := d.Get(key); err != nil {
+			t.Fatalf("%s: %v", key, err)
+		} else if !bytes.Equal(key, v) {
+			t.Fatalf("expected %s, but found %s", key, v)
+		}
+	}
+	if err := d.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestDisableWAL(t *testing.T) {
+	fs := storage.NewMem()
+	d, err := Open("", &db.Options{Storage: fs})
+	if err != nil {
+		t.Fatal(err)
+	}
+	noWAL := &db.WriteOptions{DisableWAL: true}
+	set := func(key, value string, opts *db.WriteOptions) {
+		t.Helper()
+		if err := d.Set([]byte(key), []byte(value), opts); err != nil {
+			t.Fatal(err)
+		}
+	}
+	check := func(expected map[string]string) {
+		t.Helper()
+		if actual := readAll(t, d); !reflect.DeepEqual(expected, actual) {
+			t.Fatalf("expected %v, but found %v", expected, actual)
+		}
+	}
+	reopen := func() {
+		t.Helper()
+		if err := d.Close(); err != nil {
+			t.Fatal(err)
+		}
+		if d, err = Open("", &db.Options{Storage: fs}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// Writes which skip the WAL are visible, but are lost when the DB is
+	// reopened without flushing, while the writes around them are replayed.
+	set("a", "1", nil)
+	set("b", "1", noWAL)
+	set("a", "2", noWAL)
+	set("c", "1", db.Sync)
+	check(map[string]string{"a": "2", "b": "1", "c": "1"})
+	reopen()
+	check(map[string]string{"a": "1", "c": "1"})
+
+	// Flushing makes writes which skip the WAL durable. Writes replayed from
+	// the WAL after the flush are sequenced after the flushed writes.
+	set("b", "2", noWAL)
+	if err := d.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	set("b", "3", nil)
+	set("d", "1", noWAL)
+	reopen()
+	check(map[string]string{"a": "1", "b": "3", "c": "1"})
+	set("b", "4", noWAL)
+	check(map[string]string{"a": "1", "b": "4", "c": "1"})
+	if err := d.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestWALCompression(t *testing.T) {
+	logSizes := make(map[db.Compression]int64)
+	for _, c := range []db.Compression{db.NoCompression, db.SnappyCompression} {
+		fs := storage.NewMem()
+		d, err := Open("", &db.Options{Storage: fs, WALCompression: c})
+		if err != nil {
+			t.Fatal(err)
+		}
+		expected := make(map[string]string)
+		for i := 0; i < 100; i++ {
+			key := fmt.Sprintf("%03d", i)
+			value := strings.Repeat(fmt.Sprintf(`{"id":%d,"name":"pebble"}`, i), 20)
+			if err := d.Set([]byte(key), []byte(value), nil); err != nil {
+				t.Fatal(err)
+			}
+			expected[key] = value
+		}
+		if err := d.Close(); err != nil {
+			t.Fatal(err)
+		}
+		logs := listFiles(t, fs, fileTypeLog)
+		if len(logs) != 1 {
+			t.Fatalf("%s: expected 1 log, but found %v", c, logs)
+		}
+		info, err := fs.Stat(logs[0])
+		if err != nil {
+			t.Fatal(err)
+		}
+		logSizes[c] = info.Size()
+
+		// The log is replayed regardless of the compression of the DB which
+		// reopens it.
+		other := db.SnappyCompression
+		if c == db.SnappyCompression {
+			other = db.NoCompression
+		}
+		d, err = Open("", &db.Options{Storage: fs, WALCompression: other})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if actual := readAll(t, d); !reflect.DeepEqual(expected, actual) {
+			t.Fatalf("%s: recovered data does not match", c)
+		}
+		if err := d.Close(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if logSizes[db.SnappyCompression] >= logSizes[db.NoCompression]/2 {
+		t.Fatalf("expected the compressed log to be smaller, but found %d and %d bytes",
+			logSizes[db.SnappyCompression], logSizes[db.NoCompression])
+	}
+}
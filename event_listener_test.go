@@ -7,7 +7,11 @@ package pebble
 import (
 	"bytes"
 	"fmt"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
+	"time"
 
 	"github.com/cockroachdb/cockroach/pkg/util/syncutil"
 	"github.com/petermattis/pebble/db"
@@ -97,3 +101,88 @@ func TestEventListener(t *testing.T) {
 		t.Fatalf("expected\n%s\nbut found\n%s", expected, v)
 	}
 }
+
+// slowSyncStorage creates files whose syncs are delayed by delay nanoseconds.
+type slowSyncStorage struct {
+	storage.Storage
+	delay int64
+}
+
+func (fs *slowSyncStorage) Create(name string) (storage.File, error) {
+	f, err := fs.Storage.Create(name)
+	if err != nil {
+		return nil, err
+	}
+	return slowSyncFile{File: f, fs: fs}, nil
+}
+
+type slowSyncFile struct {
+	storage.File
+	fs *slowSyncStorage
+}
+
+func (f slowSyncFile) Sync() error {
+	time.Sleep(time.Duration(atomic.LoadInt64(&f.fs.delay)))
+	return f.File.Sync()
+}
+
+type bufferLogger struct {
+	buf *syncedBuffer
+}
+
+func (l bufferLogger) Infof(format string, args ...interface{}) {
+	fmt.Fprintf(l.buf, "info: "+format+"\n", args...)
+}
+
+func (l bufferLogger) Fatalf(format string, args ...interface{}) {
+	fmt.Fprintf(l.buf, "fatal: "+format+"\n", args...)
+}
+
+func TestDiskSlow(t *testing.T) {
+	var buf syncedBuffer
+	var mu sync.Mutex
+	var infos []db.DiskSlowInfo
+
+	fs := &slowSyncStorage{Storage: storage.NewMem()}
+	d, err := Open("", &db.Options{
+		Storage:           fs,
+		DiskSlowThreshold: 10 * time.Millisecond,
+		DiskStallTimeout:  50 * time.Millisecond,
+		Logger:            bufferLogger{&buf},
+		EventListener: &db.EventListener{
+			DiskSlow: func(info db.DiskSlowInfo) {
+				mu.Lock()
+				infos = append(infos, info)
+				mu.Unlock()
+			},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	atomic.StoreInt64(&fs.delay, int64(100*time.Millisecond))
+	if err := d.Set([]byte("a"), []byte("a"), db.Sync); err != nil {
+		t.Fatal(err)
+	}
+	atomic.StoreInt64(&fs.delay, 0)
+	if err := d.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	if len(infos) != 1 {
+		t.Fatalf("expected 1 disk slow event, but found %d", len(infos))
+	}
+	if info := infos[0]; info.Path != "/000003.log" || info.OpType != "sync" {
+		t.Fatalf("unexpected disk slow event: %+v", info)
+	}
+	s := buf.String()
+	if !strings.Contains(s, "info: disk slowness detected: sync of /000003.log") {
+		t.Fatalf("expected disk slowness to be logged, but found\n%s", s)
+	}
+	if !strings.Contains(s, "fatal: disk stall detected: sync of /000003.log") {
+		t.Fatalf("expected disk stall to be fatal, but found\n%s", s)
+	}
+}
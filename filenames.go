@@ -8,6 +8,7 @@ import (
 	"fmt"
 	"os"
 	"path/filepath"
+	"sort"
 	"strconv"
 	"strings"
 
@@ -84,6 +85,50 @@ func parseDBFilename(filename string) (fileType fileType, fileNum uint64, ok boo
 	return 0, 0, false
 }
 
+// walFile is a log file found in one of the directories which may hold the
+// log files of a DB.
+type walFile struct {
+	dir  string
+	name string
+	num  uint64
+}
+
+func (lf walFile) path() string {
+	return filepath.Join(lf.dir, lf.name)
+}
+
+// listLogFiles returns the log files in the given directories, sorted by file
+// number. Directories which do not exist are ignored. A file number may only
+// be used by a single log file.
+func listLogFiles(fs storage.Storage, dirs []string) ([]walFile, error) {
+	var logs []walFile
+	for _, dir := range dirs {
+		ls, err := fs.List(dir)
+		if err != nil {
+			if _, statErr := fs.Stat(dir); os.IsNotExist(statErr) {
+				continue
+			}
+			return nil, err
+		}
+		for _, filename := range ls {
+			ft, fn, ok := parseDBFilename(filename)
+			if ok && ft == fileTypeLog {
+				logs = append(logs, walFile{dir: dir, name: filename, num: fn})
+			}
+		}
+	}
+	sort.Slice(logs, func(i, j int) bool {
+		return logs[i].num < logs[j].num
+	})
+	for i := 1; i < len(logs); i++ {
+		if logs[i].num == logs[i-1].num {
+			return nil, fmt.Errorf("pebble: log files %q and %q have the same file number",
+				logs[i-1].path(), logs[i].path())
+		}
+	}
+	return logs, nil
+}
+
 func setCurrentFile(dirname string, fs storage.Storage, fileNum uint64) error {
 	newFilename := dbFilename(dirname, fileTypeCurrent, fileNum)
 	oldFilename := fmt.Sprintf("%s.%06d.dbtmp", newFilename, fileNum)
@@ -95,8 +140,28 @@ func setCurrentFile(dirname string, fs storage.Storage, fileNum uint64) error {
 	if _, err := fmt.Fprintf(f, "MANIFEST-%06d\n", fileNum); err != nil {
 		return err
 	}
+	if err := f.Sync(); err != nil {
+		return err
+	}
 	if err := f.Close(); err != nil {
 		return err
 	}
-	return fs.Rename(oldFilename, newFilename)
+	if err := fs.Rename(oldFilename, newFilename); err != nil {
+		return err
+	}
+	return syncDir(fs, dirname)
+}
+
+// syncDir syncs the specified directory, making the creation, renaming and
+// removal of the files within it durable.
+func syncDir(fs storage.Storage, dirname string) error {
+	dir, err := fs.OpenDir(dirname)
+	if err != nil {
+		return err
+	}
+	if err := dir.Sync(); err != nil {
+		dir.Close()
+		return err
+	}
+	return dir.Close()
 }
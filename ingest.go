@@ -163,6 +163,9 @@ func ingestTargetLevel(cmp db.Compare, v *version, meta *fileMetadata) int {
 // the same filesystem as the DB. Sstables can be created for ingestion using
 // sstable.Writer.
 func (d *DB) Ingest(paths []string) error {
+	if err := d.readOnlyError(); err != nil {
+		return err
+	}
 	// Allocate file numbers for all of the files being ingested and mark them as
 	// pending in order to prevent them from being deleted.
 	d.mu.Lock()
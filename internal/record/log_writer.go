@@ -11,6 +11,7 @@ import (
 	"sync"
 	"sync/atomic"
 
+	"github.com/golang/snappy"
 	"github.com/petermattis/pebble/internal/crc"
 )
 
@@ -34,6 +35,15 @@ type LogWriter struct {
 	s syncer
 	// blockNumber is the zero based block number for the current block.
 	blockNumber int64
+	// recyclable is whether chunks are written in the recyclable format, in
+	// which case logNum is the low 32 bits of the log number written in each
+	// chunk header.
+	recyclable bool
+	logNum     uint32
+	// compression is whether records are compressed, in which case
+	// compressedBuf holds the compressed payload of the record being written.
+	compression   bool
+	compressedBuf []byte
 	// err is any accumulated error. TODO(peter): This needs to be protected in
 	// some fashion. Perhaps using atomic.Value.
 	err error
@@ -63,6 +73,18 @@ type LogWriter struct {
 
 // NewLogWriter returns a new LogWriter.
 func NewLogWriter(w io.Writer) *LogWriter {
+	return newLogWriter(w, false, 0)
+}
+
+// NewRecyclableLogWriter returns a new LogWriter which writes the recyclable
+// format for the log with the given number. The log may be written to a
+// recycled log file, as the chunks of the previous log are recognized as
+// stale by a reader created by NewLogReader.
+func NewRecyclableLogWriter(w io.Writer, logNum uint64) *LogWriter {
+	return newLogWriter(w, true, uint32(logNum))
+}
+
+func newLogWriter(w io.Writer, recyclable bool, logNum uint32) *LogWriter {
 	c, _ := w.(io.Closer)
 	f, _ := w.(flusher)
 	s, _ := w.(syncer)
@@ -72,6 +94,9 @@ func NewLogWriter(w io.Writer) *LogWriter {
 		f:    f,
 		s:    s,
 		free: make(chan *block, 4),
+
+		recyclable: recyclable,
+		logNum:     logNum,
 	}
 	for i := 0; i < cap(r.free); i++ {
 		r.free <- &block{}
@@ -83,6 +108,14 @@ func NewLogWriter(w io.Writer) *LogWriter {
 	return r
 }
 
+// EnableCompression causes the records subsequently written to be compressed
+// with snappy, unless compression would not reduce their size. Compressed
+// records are decompressed transparently by a Reader. It must not be called
+// concurrently with WriteRecord.
+func (w *LogWriter) EnableCompression() {
+	w.compression = true
+}
+
 func (w *LogWriter) flushLoop() {
 	f := &w.flusher
 	f.Lock()
@@ -273,41 +306,64 @@ func (w *LogWriter) WriteRecord(p []byte) (int64, error) {
 		return -1, w.err
 	}
 
+	var flag byte
+	if w.compression && len(p) > 0 {
+		w.compressedBuf = snappy.Encode(w.compressedBuf[:cap(w.compressedBuf)], p)
+		if len(w.compressedBuf) < len(p) {
+			p, flag = w.compressedBuf, compressedChunkTypeFlag
+		}
+	}
+
 	for i := 0; len(p) > 0; i++ {
-		p = w.emitFragment(i, p)
+		p = w.emitFragment(i, p, flag)
 	}
 
 	offset := w.blockNumber*blockSize + int64(w.block.written)
 	return offset, w.err
 }
 
-func (w *LogWriter) emitFragment(n int, p []byte) []byte {
+// emitFragment writes the next chunk of a record, setting flag in the chunk
+// type of its first chunk.
+func (w *LogWriter) emitFragment(n int, p []byte, flag byte) []byte {
 	b := w.block
 	i := b.written
+	hdrSize := int32(headerSize)
+	if w.recyclable {
+		hdrSize = recyclableHeaderSize
+	}
 	first := n == 0
-	last := blockSize-i-headerSize >= int32(len(p))
+	last := blockSize-i-hdrSize >= int32(len(p))
 
+	var chunkType byte
 	if last {
 		if first {
-			b.buf[i+6] = fullChunkType
+			chunkType = fullChunkType
 		} else {
-			b.buf[i+6] = lastChunkType
+			chunkType = lastChunkType
 		}
 	} else {
 		if first {
-			b.buf[i+6] = firstChunkType
+			chunkType = firstChunkType
 		} else {
-			b.buf[i+6] = middleChunkType
+			chunkType = middleChunkType
 		}
 	}
+	if w.recyclable {
+		chunkType += recyclableFullChunkType - fullChunkType
+		binary.LittleEndian.PutUint32(b.buf[i+7:i+11], w.logNum)
+	}
+	if first {
+		chunkType |= flag
+	}
+	b.buf[i+6] = chunkType
 
-	r := copy(b.buf[i+headerSize:], p)
-	j := i + int32(headerSize+r)
+	r := copy(b.buf[i+hdrSize:], p)
+	j := i + hdrSize + int32(r)
 	binary.LittleEndian.PutUint32(b.buf[i+0:i+4], crc.New(b.buf[i+6:j]).Value())
 	binary.LittleEndian.PutUint16(b.buf[i+4:i+6], uint16(r))
 	atomic.StoreInt32(&b.written, j)
 
-	if blockSize-b.written <= headerSize {
+	if blockSize-b.written <= hdrSize {
 		// There is no room for another fragment in the block, so fill the
 		// remaining bytes with zeros and queue the block for flushing.
 		for i := b.written; i < blockSize; i++ {
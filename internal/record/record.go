@@ -70,6 +70,22 @@
 // first, middle or last chunk of a multi-chunk record. A multi-chunk record
 // has one first chunk, zero or more middle chunks, and one last chunk.
 //
+// A LogWriter may instead write the recyclable format, whose chunk types
+// correspond to the four above and whose 11 byte header follows the chunk
+// type with a 4 byte little-endian log number, which is covered by the
+// checksum. A log file may be recycled by overwriting the file of an obsolete
+// log, and the log number distinguishes the chunks of the new log from the
+// stale chunks of the old one. A reader created by NewLogReader treats a
+// stale chunk as the end of the log, as it does an invalid chunk where a
+// record should begin in a log of the recyclable format, since the tail of a
+// recycled log is indistinguishable from corruption.
+//
+// The chunk type of the first chunk of a record may have the compressed flag
+// (0x80) set, in which case the record's payload is compressed with snappy.
+// A LogWriter compresses each record independently, and only if doing so
+// reduces its size. A Reader decompresses such records transparently, so logs
+// written with and without compression are read alike.
+//
 // The wire format allows for limited recovery in the face of data corruption:
 // on a format error (such as a checksum mismatch), the reader moves to the
 // next block and looks for the next full or first chunk.
@@ -81,10 +97,12 @@ package record // import "github.com/petermattis/pebble/internal/record"
 // instead of "chunk", but "chunk" is shorter and less confusing.
 
 import (
+	"bytes"
 	"encoding/binary"
 	"errors"
 	"io"
 
+	"github.com/golang/snappy"
 	"github.com/petermattis/pebble/internal/crc"
 )
 
@@ -94,12 +112,23 @@ const (
 	firstChunkType  = 2
 	middleChunkType = 3
 	lastChunkType   = 4
+
+	recyclableFullChunkType   = 5
+	recyclableFirstChunkType  = 6
+	recyclableMiddleChunkType = 7
+	recyclableLastChunkType   = 8
+
+	// compressedChunkTypeFlag is set in the chunk type of the first chunk of a
+	// record whose payload is compressed.
+	compressedChunkTypeFlag = 0x80
 )
 
 const (
 	blockSize     = 32 * 1024
 	blockSizeMask = blockSize - 1
 	headerSize    = 7
+
+	recyclableHeaderSize = headerSize + 4
 )
 
 var (
@@ -110,6 +139,14 @@ var (
 	ErrNoLastRecord = errors.New("pebble/record: no last record exists")
 )
 
+// CorruptionError is the error returned by a Reader for a chunk which is
+// corrupt, such as a chunk whose checksum does not match its contents.
+type CorruptionError string
+
+func (e CorruptionError) Error() string {
+	return string(e)
+}
+
 type flusher interface {
 	Flush() error
 }
@@ -130,12 +167,24 @@ type Reader struct {
 	// n is the number of bytes of buf that are valid. Once reading has started,
 	// only the final block can have n < blockSize.
 	n int
+	// blockOffset is the offset in the underlying io.Reader of buf[0].
+	blockOffset int64
 	// started is whether Next has been called at all.
 	started bool
 	// recovering is true when recovering from corruption.
 	recovering bool
 	// last is whether the current chunk is the last chunk of the record.
 	last bool
+	// logNum is the low 32 bits of the number of the log being read, which
+	// chunks of the recyclable format must match.
+	logNum uint32
+	// recyclable is whether a chunk of the recyclable format has been read.
+	recyclable bool
+	// compressed is whether the payload of the current record is compressed.
+	compressed bool
+	// compressedBuf and decompressedBuf hold the payload of the current record
+	// if it is compressed.
+	compressedBuf, decompressedBuf []byte
 	// err is any accumulated error.
 	err error
 	// buf is the buffer.
@@ -149,6 +198,15 @@ func NewReader(r io.Reader) *Reader {
 	}
 }
 
+// NewLogReader returns a new reader for the log with the given number, which
+// may have been written in the recyclable format.
+func NewLogReader(r io.Reader, logNum uint64) *Reader {
+	return &Reader{
+		r:      r,
+		logNum: uint32(logNum),
+	}
+}
+
 // nextChunk sets r.buf[r.i:r.j] to hold the next chunk's payload, reading the
 // next block into the buffer if necessary.
 func (r *Reader) nextChunk(wantFirst bool) error {
@@ -169,48 +227,90 @@ func (r *Reader) nextChunk(wantFirst bool) error {
 					r.Recover()
 					continue
 				}
-				return errors.New("pebble/record: invalid chunk")
+				return CorruptionError("pebble/record: invalid chunk")
 			}
 
-			r.i = r.j + headerSize
-			r.j = r.j + headerSize + int(length)
+			compressed := chunkType&compressedChunkTypeFlag != 0
+			chunkType &^= compressedChunkTypeFlag
+			hdrSize := headerSize
+			recyclable := chunkType >= recyclableFullChunkType && chunkType <= recyclableLastChunkType
+			if recyclable {
+				hdrSize = recyclableHeaderSize
+				chunkType -= recyclableFullChunkType - fullChunkType
+			}
+			start := r.j + 6
+			r.i = r.j + hdrSize
+			r.j = r.j + hdrSize + int(length)
 			if r.j > r.n {
 				if r.recovering {
 					r.Recover()
 					continue
 				}
-				return errors.New("pebble/record: invalid chunk (length overflows block)")
+				if r.recyclable {
+					return endOfLog(wantFirst)
+				}
+				if r.n < blockSize {
+					// The chunk extends past the end of the file.
+					return io.ErrUnexpectedEOF
+				}
+				return CorruptionError("pebble/record: invalid chunk (length overflows block)")
 			}
-			if checksum != crc.New(r.buf[r.i-1:r.j]).Value() {
+			if checksum != crc.New(r.buf[start:r.j]).Value() {
 				if r.recovering {
 					r.Recover()
 					continue
 				}
-				return errors.New("pebble/record: invalid chunk (checksum mismatch)")
+				if r.recyclable {
+					return endOfLog(wantFirst)
+				}
+				return CorruptionError("pebble/record: invalid chunk (checksum mismatch)")
+			}
+			if recyclable {
+				if binary.LittleEndian.Uint32(r.buf[start+1:start+5]) != r.logNum {
+					// The chunk was left by the previous use of a recycled log
+					// file.
+					return endOfLog(wantFirst || r.recovering)
+				}
+				r.recyclable = true
 			}
 			if wantFirst {
 				if chunkType != fullChunkType && chunkType != firstChunkType {
 					continue
 				}
+				r.compressed = compressed
 			}
 			r.last = chunkType == fullChunkType || chunkType == lastChunkType
 			r.recovering = false
 			return nil
 		}
 		if r.n < blockSize && r.started {
-			if r.j != r.n {
+			if r.j != r.n || !wantFirst {
+				// The file ends partway through a chunk header or a record.
 				return io.ErrUnexpectedEOF
 			}
 			return io.EOF
 		}
 		n, err := io.ReadFull(r.r, r.buf[:])
+		if err == io.EOF && !wantFirst && r.started {
+			return io.ErrUnexpectedEOF
+		}
 		if err != nil && err != io.ErrUnexpectedEOF {
 			return err
 		}
+		r.blockOffset += int64(r.n)
 		r.i, r.j, r.n = 0, 0, n
 	}
 }
 
+// endOfLog returns the error for the end of a log encountered where a record
+// begins, or within a record which was torn by a crash.
+func endOfLog(wantFirst bool) error {
+	if wantFirst {
+		return io.EOF
+	}
+	return io.ErrUnexpectedEOF
+}
+
 // Next returns a reader for the next record. It returns io.EOF if there are no
 // more records. The reader returned becomes stale after the next Next call,
 // and should no longer be used.
@@ -225,9 +325,34 @@ func (r *Reader) Next() (io.Reader, error) {
 		return nil, r.err
 	}
 	r.started = true
+	if r.compressed {
+		return r.decompress()
+	}
 	return singleReader{r, r.seq}, nil
 }
 
+// decompress reads the remaining chunks of the current record, whose payload
+// is compressed, and returns a reader for the decompressed payload.
+func (r *Reader) decompress() (io.Reader, error) {
+	buf := bytes.NewBuffer(r.compressedBuf[:0])
+	if _, err := buf.ReadFrom(singleReader{r, r.seq}); err != nil {
+		return nil, err
+	}
+	r.compressedBuf = buf.Bytes()
+	n, err := snappy.DecodedLen(r.compressedBuf)
+	if err == nil {
+		if cap(r.decompressedBuf) < n {
+			r.decompressedBuf = make([]byte, n)
+		}
+		r.decompressedBuf, err = snappy.Decode(r.decompressedBuf[:n], r.compressedBuf)
+	}
+	if err != nil {
+		r.err = CorruptionError("pebble/record: invalid compressed record")
+		return nil, r.err
+	}
+	return bytes.NewReader(r.decompressedBuf), nil
+}
+
 // Recover clears any errors read so far, so that calling Next will start
 // reading from the next good 32KiB block. If there are no such blocks, Next
 // will return io.EOF. Recover also marks the current reader, the one most
@@ -245,6 +370,15 @@ func (r *Reader) Recover() {
 	r.seq++
 }
 
+// Offset returns the offset in the underlying io.Reader of the end of the
+// chunk most recently returned. Once a record has been read in full, this is
+// the offset of the next record, which may be passed to SeekRecord to resume
+// reading after that record, for example from a file which has since been
+// appended to.
+func (r *Reader) Offset() int64 {
+	return r.blockOffset + int64(r.j)
+}
+
 // SeekRecord seeks in the underlying io.Reader such that calling r.Next
 // returns the record whose first chunk header starts at the provided offset.
 // Its behavior is undefined if the argument given is not such an offset, as
@@ -282,6 +416,7 @@ func (r *Reader) SeekRecord(offset int64) error {
 
 	// Clear the state of the internal reader.
 	r.i, r.j, r.n = 0, 0, 0
+	r.blockOffset = offset &^ blockSizeMask
 	r.started, r.recovering, r.last = false, false, false
 	if r.err = r.nextChunk(false); r.err != nil {
 		return r.err
@@ -492,6 +627,13 @@ func (w *Writer) WriteRecord(p []byte) (int64, error) {
 	return offset, w.err
 }
 
+// Size returns the number of bytes written to the underlying io.Writer since
+// the NewWriter call, including those of the current record which are
+// buffered but not yet written.
+func (w *Writer) Size() int64 {
+	return w.blockNumber*blockSize + int64(w.j)
+}
+
 // LastRecordOffset returns the offset in the underlying io.Writer of the last
 // record so far - the one created by the most recent Next call. It is the
 // offset of the first chunk header, suitable to pass to Reader.SeekRecord.
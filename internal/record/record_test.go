@@ -710,6 +710,210 @@ func TestSeekRecord(t *testing.T) {
 	check(2)
 }
 
+func TestReaderOffset(t *testing.T) {
+	rng := rand.New(rand.NewSource(1))
+	buf := new(bytes.Buffer)
+	w := NewWriter(buf)
+	var offset int64
+	for i := 0; i < 50; i++ {
+		// Append a few records, some of which leave less than a header's worth
+		// of space at the end of a block, and flush them.
+		var records [][]byte
+		for j := rng.Intn(3) + 1; j > 0; j-- {
+			n := rng.Intn(2 * blockSize)
+			if rng.Intn(2) == 0 {
+				n = blockSize - 2*headerSize - rng.Intn(headerSize)
+			}
+			rec := bytes.Repeat([]byte{byte(i)}, n)
+			if _, err := w.WriteRecord(rec); err != nil {
+				t.Fatal(err)
+			}
+			records = append(records, rec)
+		}
+		if err := w.Flush(); err != nil {
+			t.Fatal(err)
+		}
+
+		// Resume reading from the offset of the end of the last record read.
+		r := NewReader(bytes.NewReader(buf.Bytes()))
+		if offset > 0 {
+			if err := r.SeekRecord(offset); err != nil {
+				t.Fatalf("SeekRecord(%d): %v", offset, err)
+			}
+		}
+		for _, rec := range records {
+			rr, err := r.Next()
+			if err != nil {
+				t.Fatalf("Next: %v", err)
+			}
+			data, err := ioutil.ReadAll(rr)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(data, rec) {
+				t.Fatalf("record %d: unexpected data", i)
+			}
+		}
+		if _, err := r.Next(); err != io.EOF {
+			t.Fatalf("expected EOF, but found %v", err)
+		}
+		offset = r.Offset()
+		if offset != int64(buf.Len()) {
+			t.Fatalf("expected offset %d, but found %d", buf.Len(), offset)
+		}
+	}
+}
+
+func TestTruncatedRecord(t *testing.T) {
+	buf := new(bytes.Buffer)
+	w := NewWriter(buf)
+	if _, err := w.WriteRecord(bytes.Repeat([]byte("a"), 2*blockSize)); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	// Truncating the record at a block boundary, partway through a block and
+	// partway through a chunk header are all reported as an unexpected EOF.
+	for _, n := range []int{blockSize, blockSize + 100, 2*blockSize + 3} {
+		r := NewReader(bytes.NewReader(buf.Bytes()[:n]))
+		rr, err := r.Next()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := ioutil.ReadAll(rr); err != io.ErrUnexpectedEOF {
+			t.Fatalf("%d: expected unexpected EOF, but found %v", n, err)
+		}
+	}
+}
+
+func TestRecyclableLog(t *testing.T) {
+	rng := rand.New(rand.NewSource(1))
+	writeLog := func(logNum uint64, n int) ([]byte, [][]byte) {
+		buf := new(bytes.Buffer)
+		w := NewRecyclableLogWriter(buf, logNum)
+		var records [][]byte
+		for i := 0; i < n; i++ {
+			rec := make([]byte, rng.Intn(3*blockSize/2)+1)
+			rng.Read(rec)
+			if _, err := w.WriteRecord(rec); err != nil {
+				t.Fatal(err)
+			}
+			records = append(records, rec)
+		}
+		if err := w.Close(); err != nil {
+			t.Fatal(err)
+		}
+		return buf.Bytes(), records
+	}
+
+	readLog := func(data []byte, logNum uint64, records [][]byte) error {
+		r := NewLogReader(bytes.NewReader(data), logNum)
+		for j, rec := range records {
+			rr, err := r.Next()
+			if err != nil {
+				return err
+			}
+			got, err := ioutil.ReadAll(rr)
+			if err != nil {
+				return err
+			}
+			if !bytes.Equal(got, rec) {
+				t.Fatalf("record %d: unexpected data", j)
+			}
+		}
+		rr, err := r.Next()
+		if err == nil {
+			_, err = ioutil.ReadAll(rr)
+		}
+		return err
+	}
+
+	for i := 0; i < 20; i++ {
+		// Recycle the file of log 1 for log 2, overwriting a prefix of it. The
+		// records of log 2 are read, followed by EOF at the stale data of log
+		// 1.
+		oldData, _ := writeLog(1, 20)
+		newData, records := writeLog(2, rng.Intn(10)+2)
+		data := append([]byte(nil), oldData...)
+		copy(data, newData)
+		if err := readLog(data, 2, records); err != io.EOF {
+			t.Fatalf("%d: expected EOF, but found %v", i, err)
+		}
+
+		// The last record of log 2 is torn by a crash, and followed by stale
+		// data of log 1.
+		data = append(data[:0], oldData...)
+		copy(data, newData[:len(newData)-rng.Intn(len(records[len(records)-1]))-1])
+		err := readLog(data, 2, records[:len(records)-1])
+		if err == nil {
+			t.Fatalf("%d: expected the torn record to not be read", i)
+		} else if err != io.EOF && err != io.ErrUnexpectedEOF {
+			t.Fatalf("%d: expected EOF, but found %v", i, err)
+		}
+	}
+}
+
+func TestCompressedLog(t *testing.T) {
+	rng := rand.New(rand.NewSource(1))
+	for _, recyclable := range []bool{false, true} {
+		// Compressible records are interleaved with random records, which are
+		// written uncompressed, and records are written both before and after
+		// compression is enabled.
+		var records [][]byte
+		for i := 0; i < 40; i++ {
+			rec := make([]byte, rng.Intn(3*blockSize)+1)
+			if i%2 == 0 {
+				copy(rec, strings.Repeat(fmt.Sprintf(`{"key":%d,"value":"x"}`, i), len(rec)))
+			} else {
+				rng.Read(rec)
+			}
+			records = append(records, rec)
+		}
+
+		buf := new(bytes.Buffer)
+		w := NewLogWriter(buf)
+		if recyclable {
+			w = NewRecyclableLogWriter(buf, 1)
+		}
+		var size int
+		for i, rec := range records {
+			if i == 10 {
+				w.EnableCompression()
+			}
+			if _, err := w.WriteRecord(rec); err != nil {
+				t.Fatal(err)
+			}
+			size += len(rec)
+		}
+		if err := w.Close(); err != nil {
+			t.Fatal(err)
+		}
+		if buf.Len() >= size*3/4 {
+			t.Fatalf("recyclable=%t: expected the log to be compressed, but found %d bytes of %d",
+				recyclable, buf.Len(), size)
+		}
+
+		r := NewLogReader(bytes.NewReader(buf.Bytes()), 1)
+		for i, rec := range records {
+			rr, err := r.Next()
+			if err != nil {
+				t.Fatalf("recyclable=%t: record %d: %v", recyclable, i, err)
+			}
+			got, err := ioutil.ReadAll(rr)
+			if err != nil {
+				t.Fatalf("recyclable=%t: record %d: %v", recyclable, i, err)
+			}
+			if !bytes.Equal(got, rec) {
+				t.Fatalf("recyclable=%t: record %d: unexpected data", recyclable, i)
+			}
+		}
+		if _, err := r.Next(); err != io.EOF {
+			t.Fatalf("recyclable=%t: expected EOF, but found %v", recyclable, err)
+		}
+	}
+}
+
 func TestLastRecordOffset(t *testing.T) {
 	recs, err := makeTestRecords(
 		// The first record will consume 3 entire blocks but a fraction of the 4th.
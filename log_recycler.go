@@ -0,0 +1,78 @@
+// Copyright 2018 The LevelDB-Go and Pebble Authors. All rights reserved. Use
+// of this source code is governed by a BSD-style license that can be found in
+// the LICENSE file.
+
+package pebble
+
+import (
+	"fmt"
+	"sync"
+)
+
+// logRecycler holds a set of obsolete log files which may be reused for new
+// logs in place of creating new files.
+type logRecycler struct {
+	// limit is the maximum number of log files to hold for recycling.
+	limit int
+	// minRecycleLogNum is the minimum number of a log which may be recycled.
+	// Logs with smaller numbers were written by a previous process, possibly
+	// in the legacy record format, whose stale chunks would not be recognized
+	// when reading the new log.
+	minRecycleLogNum uint64
+
+	mu struct {
+		sync.Mutex
+		logNums []uint64
+	}
+}
+
+// add attempts to add the obsolete log with the given number to the set of
+// logs available for recycling, returning whether the log is held by the
+// recycler and must not be deleted.
+func (r *logRecycler) add(logNum uint64) bool {
+	if logNum < r.minRecycleLogNum {
+		return false
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for _, n := range r.mu.logNums {
+		if n == logNum {
+			return true
+		}
+	}
+	if len(r.mu.logNums) >= r.limit {
+		return false
+	}
+	r.mu.logNums = append(r.mu.logNums, logNum)
+	return true
+}
+
+// peek returns the number of the oldest log available for recycling, or false
+// if there is none. The log remains held by the recycler until it is removed
+// with pop.
+func (r *logRecycler) peek() (uint64, bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if len(r.mu.logNums) == 0 {
+		return 0, false
+	}
+	return r.mu.logNums[0], true
+}
+
+// pop removes the log returned by peek, once it has been recycled.
+func (r *logRecycler) pop(logNum uint64) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if len(r.mu.logNums) == 0 || r.mu.logNums[0] != logNum {
+		return fmt.Errorf("pebble: log %d is not the next log to recycle", logNum)
+	}
+	r.mu.logNums = r.mu.logNums[1:]
+	return nil
+}
+
+// count returns the number of logs available for recycling.
+func (r *logRecycler) count() int {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return len(r.mu.logNums)
+}
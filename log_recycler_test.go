@@ -0,0 +1,162 @@
+// Copyright 2018 The LevelDB-Go and Pebble Authors. All rights reserved. Use
+// of this source code is governed by a BSD-style license that can be found in
+// the LICENSE file.
+
+package pebble
+
+import (
+	"bytes"
+	"fmt"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/petermattis/pebble/db"
+	"github.com/petermattis/pebble/storage"
+)
+
+func TestLogRecycler(t *testing.T) {
+	r := logRecycler{limit: 2, minRecycleLogNum: 4}
+
+	// Logs written by a previous process are not recycled.
+	if r.add(3) {
+		t.Fatal("expected log 3 to not be recycled")
+	}
+	if !r.add(4) || !r.add(5) {
+		t.Fatal("expected logs 4 and 5 to be recycled")
+	}
+	// A log which is already held is still held, but the limit is enforced.
+	if !r.add(4) {
+		t.Fatal("expected log 4 to be held")
+	}
+	if r.add(6) {
+		t.Fatal("expected log 6 to exceed the limit")
+	}
+	if n := r.count(); n != 2 {
+		t.Fatalf("expected 2 logs, but found %d", n)
+	}
+
+	if n, ok := r.peek(); !ok || n != 4 {
+		t.Fatalf("expected log 4, but found %d", n)
+	}
+	if err := r.pop(5); err == nil {
+		t.Fatal("expected error popping log 5")
+	}
+	if err := r.pop(4); err != nil {
+		t.Fatal(err)
+	}
+	if n, ok := r.peek(); !ok || n != 5 {
+		t.Fatalf("expected log 5, but found %d", n)
+	}
+	if err := r.pop(5); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := r.peek(); ok {
+		t.Fatal("expected no logs")
+	}
+}
+
+// logOpCounter counts the log files created and reused through a
+// FaultStorage.
+type logOpCounter struct {
+	mu      sync.Mutex
+	created int
+	reused  int
+}
+
+func (c *logOpCounter) inject(op storage.FaultOp, name string) error {
+	if !strings.HasSuffix(name, ".log") {
+		return nil
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	switch op {
+	case storage.FaultCreate:
+		c.created++
+	case storage.FaultReuseForWrite:
+		c.reused++
+	}
+	return nil
+}
+
+func TestLogRecycling(t *testing.T) {
+	var counter logOpCounter
+	fs := storage.NewFaultMem()
+	fs.SetInjector(counter.inject)
+	opts := &db.Options{
+		Storage:         fs,
+		WALRecycleLimit: 2,
+	}
+	d, err := Open("", opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Fill each log with fewer records than the last, so that each recycled
+	// log file is followed by the stale records of a previous log.
+	expected := make(map[string]string)
+	for i := 0; i < 10; i++ {
+		for j := 0; j < 100-10*i; j++ {
+			key := fmt.Sprintf("%03d", j)
+			value := fmt.Sprintf("%d-%s", i, bytes.Repeat([]byte("x"), 100))
+			if err := d.Set([]byte(key), []byte(value), nil); err != nil {
+				t.Fatal(err)
+			}
+			expected[key] = value
+		}
+		if err := d.Flush(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := d.Set([]byte("a"), []byte("unflushed"), db.Sync); err != nil {
+		t.Fatal(err)
+	}
+	expected["a"] = "unflushed"
+
+	counter.mu.Lock()
+	created, reused := counter.created, counter.reused
+	counter.mu.Unlock()
+	if created != 2 || reused != 9 {
+		t.Fatalf("expected 2 logs to be created and 9 reused, but found %d and %d", created, reused)
+	}
+	// Each flush obsoletes one log, which is reused by the next flush.
+	if logs := listFiles(t, fs, fileTypeLog); len(logs) != 2 {
+		t.Fatalf("expected the live log and 1 recycled log, but found %v", logs)
+	}
+
+	// The recycled log is replayed after a crash, stopping at the stale
+	// records.
+	crashed := fs.Crash()
+	if err := d.Close(); err != nil {
+		t.Fatal(err)
+	}
+	for _, mode := range []db.WALRecoveryMode{
+		db.WALRecoveryTolerateCorruptedTail,
+		db.WALRecoveryPointInTime,
+	} {
+		var events []db.WALCorruptionInfo
+		d, err := Open("", &db.Options{
+			Storage:         crashed,
+			WALRecoveryMode: mode,
+			WALRecycleLimit: 2,
+			EventListener: &db.EventListener{
+				WALCorruption: func(info db.WALCorruptionInfo) {
+					events = append(events, info)
+				},
+			},
+		})
+		if err != nil {
+			t.Fatalf("%s: %v", mode, err)
+		}
+		if len(events) != 0 {
+			t.Fatalf("%s: expected no events, but found %+v", mode, events)
+		}
+		if actual := readAll(t, d); !reflect.DeepEqual(expected, actual) {
+			t.Fatalf("%s: recovered data does not match", mode)
+		}
+		if err := d.Close(); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
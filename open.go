@@ -6,11 +6,13 @@ package pebble
 
 import (
 	"bytes"
+	"errors"
 	"fmt"
 	"io"
+	"io/ioutil"
 	"os"
 	"path/filepath"
-	"sort"
+	"time"
 
 	"github.com/petermattis/pebble/db"
 	"github.com/petermattis/pebble/internal/arenaskl"
@@ -19,12 +21,20 @@ import (
 	"github.com/petermattis/pebble/storage"
 )
 
-func createDB(dirname string, opts *db.Options) (retErr error) {
+func createDB(dirname string, opts *db.Options) error {
 	const manifestFileNum = 1
 	ve := versionEdit{
 		comparatorName: opts.Comparer.Name,
 		nextFileNumber: manifestFileNum + 1,
 	}
+	return writeManifest(dirname, opts, manifestFileNum, &ve)
+}
+
+// writeManifest writes a manifest file containing the single versionEdit ve,
+// and makes it the current manifest.
+func writeManifest(
+	dirname string, opts *db.Options, manifestFileNum uint64, ve *versionEdit,
+) (retErr error) {
 	manifestFilename := dbFilename(dirname, fileTypeManifest, manifestFileNum)
 	f, err := opts.Storage.Create(manifestFilename)
 	if err != nil {
@@ -50,18 +60,226 @@ func createDB(dirname string, opts *db.Options) (retErr error) {
 	if err != nil {
 		return err
 	}
+	if err := f.Sync(); err != nil {
+		return err
+	}
 	return setCurrentFile(dirname, opts.Storage, manifestFileNum)
 }
 
-// Open opens a LevelDB whose files live in the given directory.
+// withDiskHealthChecks returns a copy of opts whose Storage monitors the
+// writes and syncs of the files created by the DB. Slow operations are logged
+// and reported to the EventListener, and stalled operations are fatal.
+func withDiskHealthChecks(opts *db.Options) *db.Options {
+	o := *opts
+	o.Storage = storage.WithDiskHealthChecks(opts.Storage, storage.DiskHealthOptions{
+		SlowThreshold: opts.DiskSlowThreshold,
+		OnSlow: func(name, op string, duration time.Duration) {
+			opts.Logger.Infof("disk slowness detected: %s of %s has taken %0.1fs", op, name, duration.Seconds())
+			if opts.EventListener != nil && opts.EventListener.DiskSlow != nil {
+				opts.EventListener.DiskSlow(db.DiskSlowInfo{
+					Path:     name,
+					OpType:   op,
+					Duration: duration,
+				})
+			}
+		},
+		StallTimeout: opts.DiskStallTimeout,
+		OnStall: func(name, op string, duration time.Duration) {
+			opts.Logger.Fatalf("disk stall detected: %s of %s has not completed after %0.1fs",
+				op, name, duration.Seconds())
+		},
+	})
+	return &o
+}
+
+// directIOStorage is a Storage which reads and writes the sstables and log
+// files of a DB with storage.DirectIO, and all other files normally.
+type directIOStorage struct {
+	storage.Storage
+}
+
+// direct returns true if the named file is read and written with direct I/O.
+func (directIOStorage) direct(name string) bool {
+	fileType, _, ok := parseDBFilename(name)
+	return ok && (fileType == fileTypeTable || fileType == fileTypeLog)
+}
+
+func (fs directIOStorage) Create(name string) (storage.File, error) {
+	if fs.direct(name) {
+		return storage.DirectIO.Create(name)
+	}
+	return fs.Storage.Create(name)
+}
+
+func (fs directIOStorage) ReuseForWrite(oldname, newname string) (storage.File, error) {
+	if fs.direct(newname) {
+		return storage.DirectIO.ReuseForWrite(oldname, newname)
+	}
+	return fs.Storage.ReuseForWrite(oldname, newname)
+}
+
+func (fs directIOStorage) Open(name string) (storage.File, error) {
+	if fs.direct(name) {
+		return storage.DirectIO.Open(name)
+	}
+	return fs.Storage.Open(name)
+}
+
+// logDirs returns the directories which may hold the log files of the DB in
+// dirname: the WAL directory, the DB directory, and the WAL directory the DB
+// was last opened with, if it differs. The log files in the previous WAL
+// directory may hold records which have not been flushed.
+func logDirs(dirname, walDirname, prevWALDirname string) []string {
+	dirs := []string{walDirname}
+	add := func(dir string) {
+		for _, d := range dirs {
+			if filepath.Clean(d) == filepath.Clean(dir) {
+				return
+			}
+		}
+		dirs = append(dirs, dir)
+	}
+	add(dirname)
+	if prevWALDirname != "" {
+		add(prevWALDirname)
+	}
+	return dirs
+}
+
+// nameOnlyParseHooks parse the names of the comparer and merger and the WAL
+// directory of an OPTIONS file, without the implementations the DB was
+// opened with. The other options are skipped, so that Open does not depend
+// on their values.
+var nameOnlyParseHooks = &db.ParseHooks{
+	NewComparer: func(name string) (*db.Comparer, error) {
+		return &db.Comparer{Name: name}, nil
+	},
+	NewMerger: func(name string) (*db.Merger, error) {
+		return &db.Merger{Name: name}, nil
+	},
+	SkipOption: func(section, key string) bool {
+		if section != "Options" {
+			return true
+		}
+		switch key {
+		case "comparer", "merger", "wal_dir":
+			return false
+		}
+		return true
+	},
+}
+
+// readOptionsFile parses the latest OPTIONS file in dirname, returning nil if
+// there is none.
+func readOptionsFile(fs storage.Storage, dirname string, hooks *db.ParseHooks) (*db.Options, error) {
+	ls, err := fs.List(dirname)
+	if err != nil {
+		return nil, err
+	}
+	var optionsFileNum uint64
+	var found bool
+	for _, filename := range ls {
+		ft, fn, ok := parseDBFilename(filename)
+		if ok && ft == fileTypeOptions && (!found || fn > optionsFileNum) {
+			optionsFileNum, found = fn, true
+		}
+	}
+	if !found {
+		return nil, nil
+	}
+	filename := dbFilename(dirname, fileTypeOptions, optionsFileNum)
+	f, err := fs.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	data, err := ioutil.ReadAll(f)
+	if err != nil {
+		return nil, err
+	}
+	opts, err := db.ParseOptions(string(data), hooks)
+	if err != nil {
+		return nil, fmt.Errorf("pebble: OPTIONS file %q: %v", filename, err)
+	}
+	return opts, nil
+}
+
+// LoadOptions returns the options recorded in the latest OPTIONS file of the
+// DB in dirname, which may be passed to Open to open the DB with the options
+// it was last opened with. The comparer, merger and filter policies are
+// constructed by hooks, as described by db.ParseOptions. The Storage of the
+// returned options is fs.
+func LoadOptions(dirname string, fs storage.Storage, hooks *db.ParseHooks) (*db.Options, error) {
+	opts, err := readOptionsFile(fs, dirname, hooks)
+	if err != nil {
+		return nil, err
+	}
+	if opts == nil {
+		return nil, fmt.Errorf("pebble: database %q has no OPTIONS file", dirname)
+	}
+	opts.Storage = fs
+	return opts, nil
+}
+
+// checkOptions returns an error if the comparer or merger of opts differ from
+// those of the stored options the DB in dirname was last opened with. The
+// keys of the DB's tables are ordered and merged by them.
+func checkOptions(dirname string, opts, stored *db.Options) error {
+	if stored.Comparer != nil && stored.Comparer.Name != opts.Comparer.Name {
+		return fmt.Errorf("pebble: database %q was last opened with comparer %q, not %q",
+			dirname, stored.Comparer.Name, opts.Comparer.Name)
+	}
+	if stored.Merger != nil && stored.Merger.Name != opts.Merger.Name {
+		return fmt.Errorf("pebble: database %q was last opened with merger %q, not %q",
+			dirname, stored.Merger.Name, opts.Merger.Name)
+	}
+	return nil
+}
+
+// ErrReadOnly is returned by the Writer methods, Flush, Compact and Ingest of
+// a DB opened with OpenReadOnly.
+var ErrReadOnly = errors.New("pebble: DB opened read-only")
+
+// Open opens a LevelDB whose files live in the given directory. Open fails if
+// the Comparer or Merger differ from those recorded in the OPTIONS file when
+// the DB was last opened. LoadOptions returns the recorded options.
 func Open(dirname string, opts *db.Options) (*DB, error) {
+	return open(dirname, opts, false /* readOnly */)
+}
+
+// OpenReadOnly opens an existing LevelDB in the given directory without
+// modifying it. The LOCK file is not acquired, so the DB may be opened
+// read-only while another process has it open for writing. Such a secondary
+// DB does not see the writes made by the primary after OpenReadOnly returns
+// until TryCatchUpWithPrimary is called. The contents of the log files are
+// replayed into memtables which are never flushed. All Writer methods return
+// ErrReadOnly.
+func OpenReadOnly(dirname string, opts *db.Options) (*DB, error) {
+	return open(dirname, opts, true /* readOnly */)
+}
+
+func open(dirname string, opts *db.Options, readOnly bool) (*DB, error) {
 	const defaultRateLimit = rate.Limit(50 << 20) // 50 MB/sec
 	const defaultBurst = 1 << 20                  // 1 MB
 
 	opts = opts.EnsureDefaults()
+	if opts.UseDirectIO && opts.Storage == storage.Default {
+		o := *opts
+		o.Storage = directIOStorage{Storage: opts.Storage}
+		opts = &o
+	}
+	if opts.DiskSlowThreshold > 0 {
+		opts = withDiskHealthChecks(opts)
+	}
+	walDirname := dirname
+	if opts.WALDir != "" && filepath.Clean(opts.WALDir) != filepath.Clean(dirname) {
+		walDirname = opts.WALDir
+	}
 	d := &DB{
 		dirname:           dirname,
+		walDirname:        walDirname,
 		opts:              opts,
+		openedReadOnly:    readOnly,
 		cmp:               opts.Comparer.Compare,
 		merge:             opts.Merger.Merge,
 		inlineKey:         opts.Comparer.InlineKey,
@@ -75,6 +293,7 @@ func Open(dirname string, opts *db.Options) (*DB, error) {
 	}
 	d.tableCache.init(dirname, opts.Storage, d.opts, tableCacheSize)
 	d.newIter = d.tableCache.newIter
+	d.mu.versions.tableCache = &d.tableCache
 	d.commit = newCommitPipeline(commitEnv{
 		mu:            &d.mu.Mutex,
 		logSeqNum:     &d.mu.versions.logSeqNum,
@@ -91,28 +310,41 @@ func Open(dirname string, opts *db.Options) (*DB, error) {
 	d.mu.compact.cond.L = &d.mu.Mutex
 	d.mu.compact.pendingOutputs = make(map[uint64]struct{})
 	d.mu.snapshots.init()
+	d.mu.bgError.readOnlyC = make(chan struct{})
+	d.readOnly.Store((*ReadOnlyError)(nil))
 	d.largeBatchThreshold = (d.opts.MemTableSize - int(d.mu.mem.mutable.emptySize)) / 2
 
 	d.mu.Lock()
 	defer d.mu.Unlock()
 
-	// Lock the database directory.
 	fs := opts.Storage
-	err := fs.MkdirAll(dirname, 0755)
-	if err != nil {
-		return nil, err
-	}
-	fileLock, err := fs.Lock(dbFilename(dirname, fileTypeLock, 0))
-	if err != nil {
-		return nil, err
+	var fileLock io.Closer
+	if !readOnly {
+		// Lock the database directory.
+		err := fs.MkdirAll(dirname, 0755)
+		if err != nil {
+			return nil, err
+		}
+		fileLock, err = fs.Lock(dbFilename(dirname, fileTypeLock, 0))
+		if err != nil {
+			return nil, err
+		}
+		defer func() {
+			if fileLock != nil {
+				fileLock.Close()
+			}
+		}()
 	}
-	defer func() {
-		if fileLock != nil {
-			fileLock.Close()
+	if !readOnly && d.walDirname != dirname {
+		if err := fs.MkdirAll(d.walDirname, 0755); err != nil {
+			return nil, err
 		}
-	}()
+	}
 
 	if _, err := fs.Stat(dbFilename(dirname, fileTypeCurrent, 0)); os.IsNotExist(err) {
+		if readOnly {
+			return nil, fmt.Errorf("pebble: database %q does not exist", dirname)
+		}
 		// Create the DB if it did not already exist.
 		if err := createDB(dirname, opts); err != nil {
 			return nil, err
@@ -123,39 +355,81 @@ func Open(dirname string, opts *db.Options) (*DB, error) {
 		return nil, fmt.Errorf("pebble: database %q already exists", dirname)
 	}
 
-	// Load the version set.
-	err = d.mu.versions.load(dirname, opts, &d.mu.Mutex)
+	// Check the options against those the DB was last opened with.
+	var prevWALDirname string
+	stored, err := readOptionsFile(fs, dirname, nameOnlyParseHooks)
 	if err != nil {
 		return nil, err
 	}
+	if stored != nil {
+		if err := checkOptions(dirname, opts, stored); err != nil {
+			return nil, err
+		}
+		prevWALDirname = stored.WALDir
+	}
+
+	// Load the version set.
+	if err := d.mu.versions.load(dirname, opts, &d.mu.Mutex); err != nil {
+		return nil, err
+	}
+
+	d.logDirs = logDirs(dirname, d.walDirname, prevWALDirname)
+	if dir := d.logDirs[len(d.logDirs)-1]; dir != dirname && dir != d.walDirname {
+		// The records in the log files of a missing previous WAL directory
+		// would be lost.
+		if _, err := fs.Stat(dir); err != nil {
+			return nil, fmt.Errorf("pebble: WAL directory %q of database %q: %v", dir, dirname, err)
+		}
+	}
+
+	if readOnly {
+		// Replay the log files into memtables without writing anything.
+		if err := d.catchUpLogsLocked(); err != nil {
+			return nil, err
+		}
+		return d, nil
+	}
 
 	// Replay any newer log files than the ones named in the manifest.
 	var ve versionEdit
-	ls, err := fs.List(dirname)
+	allLogFiles, err := listLogFiles(fs, d.logDirs)
 	if err != nil {
 		return nil, err
 	}
-
-	type fileNumAndName struct {
-		num  uint64
-		name string
-	}
-	var logFiles []fileNumAndName
-	for _, filename := range ls {
-		ft, fn, ok := parseDBFilename(filename)
-		if ok && ft == fileTypeLog && (fn >= d.mu.versions.logNumber || fn == d.mu.versions.prevLogNumber) {
-			logFiles = append(logFiles, fileNumAndName{fn, filename})
+	var logFiles []walFile
+	for _, lf := range allLogFiles {
+		if lf.num >= d.mu.versions.logNumber || lf.num == d.mu.versions.prevLogNumber {
+			logFiles = append(logFiles, lf)
 		}
 	}
-	sort.Slice(logFiles, func(i, j int) bool {
-		return logFiles[i].num < logFiles[j].num
-	})
-	for _, lf := range logFiles {
-		maxSeqNum, err := d.replayWAL(&ve, fs, filepath.Join(dirname, lf.name))
+	// A crash after the creation of the new log file below, but before the
+	// manifest is updated, leaves an empty log file following the log file
+	// which was being replayed. The last non-empty log file is the one whose
+	// tail may have been torn by a crash.
+	lastLog := len(logFiles) - 1
+	for ; lastLog > 0; lastLog-- {
+		stat, err := fs.Stat(logFiles[lastLog].path())
 		if err != nil {
 			return nil, err
 		}
+		if stat.Size() > 0 {
+			break
+		}
+	}
+	var stopped bool
+	for i, lf := range logFiles {
 		d.mu.versions.markFileNumUsed(lf.num)
+		if stopped {
+			// Replaying stopped at a corrupt record in an earlier log file. The
+			// log file is obsoleted by the new log file created below.
+			d.reportWALCorruption(lf.path(), 0, fmt.Errorf("pebble: log file follows a corrupt record"))
+			continue
+		}
+		var maxSeqNum uint64
+		maxSeqNum, stopped, err = d.replayWAL(&ve, fs, lf.path(), lf.num, i >= lastLog)
+		if err != nil {
+			return nil, err
+		}
 		if d.mu.versions.logSeqNum < maxSeqNum {
 			d.mu.versions.logSeqNum = maxSeqNum
 		}
@@ -165,17 +439,39 @@ func Open(dirname string, opts *db.Options) (*DB, error) {
 	// Create an empty .log file.
 	ve.logNumber = d.mu.versions.nextFileNum()
 	d.mu.log.number = ve.logNumber
-	logFile, err := fs.Create(dbFilename(dirname, fileTypeLog, ve.logNumber))
+	logFile, err := fs.Create(dbFilename(d.walDirname, fileTypeLog, ve.logNumber))
 	if err != nil {
 		return nil, err
 	}
-	d.mu.log.LogWriter = record.NewLogWriter(logFile)
+	if err := syncDir(fs, d.walDirname); err != nil {
+		return nil, err
+	}
+	// Logs are only recycled if replaying a log stops at the stale data which
+	// follows the records of a recycled log, which the recyclable format
+	// cannot distinguish from corruption.
+	switch opts.WALRecoveryMode {
+	case db.WALRecoveryTolerateCorruptedTail, db.WALRecoveryPointInTime:
+		d.logRecycler.limit = opts.WALRecycleLimit
+	}
+	d.logRecycler.minRecycleLogNum = ve.logNumber
+	d.mu.log.LogWriter = d.newLogWriter(logFile, ve.logNumber)
 
 	// Write a new manifest to disk.
 	if err := d.mu.versions.logAndApply(&ve); err != nil {
 		return nil, err
 	}
 
+	// The log files in a previous WAL directory have been replayed, and are
+	// obsoleted by the new log file. The remaining obsolete log files are
+	// deleted by deleteObsoleteFiles.
+	for _, lf := range allLogFiles {
+		if lf.dir != dirname && lf.dir != d.walDirname {
+			if err := fs.Remove(lf.path()); err != nil {
+				return nil, err
+			}
+		}
+	}
+
 	// Write the current options to disk.
 	d.optionsFileNum = d.mu.versions.nextFileNum()
 	optionsFile, err := fs.Create(dbFilename(dirname, fileTypeOptions, d.optionsFileNum))
@@ -197,7 +493,11 @@ func Open(dirname string, opts *db.Options) (*DB, error) {
 	return d, nil
 }
 
-// replayWAL replays the edits in the specified log file.
+// replayWAL replays the edits in the specified log file. Corrupt records are
+// handled according to Options.WALRecoveryMode, for which last indicates
+// whether this is the last log file being replayed which is not empty. It
+// returns whether replaying the WAL should stop at this log file because of a
+// corrupt record.
 //
 // d.mu must be held when calling this, but the mutex may be dropped and
 // re-acquired during the course of this method.
@@ -205,10 +505,12 @@ func (d *DB) replayWAL(
 	ve *versionEdit,
 	fs storage.Storage,
 	filename string,
-) (maxSeqNum uint64, err error) {
+	logNum uint64,
+	last bool,
+) (maxSeqNum uint64, stopped bool, err error) {
 	file, err := fs.Open(filename)
 	if err != nil {
-		return 0, err
+		return 0, false, err
 	}
 	defer file.Close()
 
@@ -216,23 +518,37 @@ func (d *DB) replayWAL(
 		b   Batch
 		buf bytes.Buffer
 		mem *memTable
-		rr  = record.NewReader(file)
+		rr  = record.NewLogReader(file, logNum)
+		// corruptOffset is the offset of the last corrupt record, which guards
+		// against an error which persists after recovering.
+		corruptOffset int64 = -1
 	)
 	for {
+		offset := rr.Offset()
 		r, err := rr.Next()
 		if err == io.EOF {
 			break
 		}
-		if err != nil {
-			return 0, err
+		if err == nil {
+			_, err = io.Copy(&buf, r)
 		}
-		_, err = io.Copy(&buf, r)
-		if err != nil {
-			return 0, err
+		if err == nil && buf.Len() < batchHeaderLen {
+			err = fmt.Errorf("pebble: corrupt log file %q", filename)
 		}
-
-		if buf.Len() < batchHeaderLen {
-			return 0, fmt.Errorf("pebble: corrupt log file %q", filename)
+		if err != nil {
+			if offset == corruptOffset {
+				return 0, false, err
+			}
+			corruptOffset = offset
+			stopped, err = d.handleWALCorruption(rr, filename, offset, last, err)
+			if err != nil {
+				return 0, false, err
+			}
+			if stopped {
+				break
+			}
+			buf.Reset()
+			continue
 		}
 
 		// TODO(peter): If the batch is too large to fit in the memtable, flush the
@@ -254,13 +570,13 @@ func (d *DB) replayWAL(
 				panic(err)
 			}
 			if err != nil {
-				return 0, err
+				return 0, false, err
 			}
 			break
 		}
 
 		if err := mem.apply(&b, seqNum); err != nil {
-			return 0, err
+			return 0, false, err
 		}
 		mem.unref()
 
@@ -270,7 +586,7 @@ func (d *DB) replayWAL(
 	if mem != nil && !mem.empty() {
 		meta, err := d.writeLevel0Table(fs, mem.newIter(nil))
 		if err != nil {
-			return 0, err
+			return 0, false, err
 		}
 		ve.newFiles = append(ve.newFiles, newFileEntry{level: 0, meta: meta})
 		// Strictly speaking, it's too early to delete meta.fileNum from d.pendingOutputs,
@@ -279,5 +595,48 @@ func (d *DB) replayWAL(
 		delete(d.mu.compact.pendingOutputs, meta.fileNum)
 	}
 
-	return maxSeqNum, nil
+	return maxSeqNum, stopped, nil
+}
+
+// handleWALCorruption handles an error reading the record at the given offset
+// of a log file according to Options.WALRecoveryMode, returning whether
+// replaying the WAL should stop at the record or an error if the DB cannot be
+// opened.
+func (d *DB) handleWALCorruption(
+	rr *record.Reader, filename string, offset int64, last bool, err error,
+) (stop bool, _ error) {
+	corruptErr := fmt.Errorf("pebble: corrupt log file %q at offset %d: %v", filename, offset, err)
+	switch d.opts.WALRecoveryMode {
+	case db.WALRecoveryTolerateCorruptedTail:
+		// Only a record which is truncated by the end of the file is tolerated,
+		// as occurs when a write was torn by a crash. A corrupt record may be
+		// followed by intact records, which must not be dropped.
+		if !last || err != io.ErrUnexpectedEOF {
+			return false, corruptErr
+		}
+		d.reportWALCorruption(filename, offset, err)
+		return true, nil
+	case db.WALRecoveryPointInTime:
+		d.reportWALCorruption(filename, offset, err)
+		return true, nil
+	case db.WALRecoverySkipAnyCorruptedRecords:
+		d.reportWALCorruption(filename, offset, err)
+		rr.Recover()
+		return false, nil
+	default:
+		return false, corruptErr
+	}
+}
+
+// reportWALCorruption logs the records dropped from a log file and notifies
+// the EventListener.
+func (d *DB) reportWALCorruption(filename string, offset int64, err error) {
+	d.opts.Logger.Infof("dropping records of log file %q from offset %d: %v", filename, offset, err)
+	if d.opts.EventListener != nil && d.opts.EventListener.WALCorruption != nil {
+		d.opts.EventListener.WALCorruption(db.WALCorruptionInfo{
+			Path:   filename,
+			Offset: offset,
+			Err:    err,
+		})
+	}
 }
@@ -5,14 +5,19 @@
 package pebble
 
 import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
 	"path/filepath"
 	"reflect"
 	"sort"
 	"strconv"
 	"strings"
+	"sync"
 	"testing"
 
 	"github.com/petermattis/pebble/db"
+	"github.com/petermattis/pebble/sstable"
 	"github.com/petermattis/pebble/storage"
 )
 
@@ -163,3 +168,791 @@ func TestOpenCloseOpenClose(t *testing.T) {
 		}
 	}
 }
+
+func TestOpenReadOnly(t *testing.T) {
+	fs := storage.NewMem()
+	if _, err := OpenReadOnly("", &db.Options{Storage: fs}); err == nil {
+		t.Fatal("expected error opening a non-existent DB read-only")
+	}
+	if ls, err := fs.List(""); err != nil {
+		t.Fatal(err)
+	} else if len(ls) != 0 {
+		t.Fatalf("expected no files, but found %v", ls)
+	}
+
+	d, err := Open("", &db.Options{Storage: fs})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := d.Set([]byte("flushed"), []byte("a"), nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := d.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	// Write enough unflushed data to fill several of the read-only DB's
+	// smaller memtables.
+	value := bytes.Repeat([]byte("v"), 1000)
+	for i := 0; i < 1000; i++ {
+		if err := d.Set([]byte(fmt.Sprintf("key%04d", i)), value, nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	listFiles := func() map[string]int64 {
+		ls, err := fs.List("")
+		if err != nil {
+			t.Fatal(err)
+		}
+		files := make(map[string]int64)
+		for _, name := range ls {
+			info, err := fs.Stat(name)
+			if err != nil {
+				t.Fatal(err)
+			}
+			files[name] = info.Size()
+		}
+		return files
+	}
+	before := listFiles()
+
+	// The DB can be opened read-only while it is open for writing.
+	ro, err := OpenReadOnly("", &db.Options{
+		Storage:      fs,
+		MemTableSize: 256 << 10,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ro.mu.Lock()
+	n := len(ro.mu.mem.queue)
+	ro.mu.Unlock()
+	if n < 4 {
+		t.Fatalf("expected at least 4 memtables, but found %d", n)
+	}
+	if v, err := ro.Get([]byte("flushed")); err != nil {
+		t.Fatal(err)
+	} else if string(v) != "a" {
+		t.Fatalf("expected a, but found %s", v)
+	}
+	iter := ro.NewIter(nil)
+	var count int
+	for iter.SeekGE([]byte("key")); iter.Valid(); iter.Next() {
+		if expected := fmt.Sprintf("key%04d", count); string(iter.Key()) != expected {
+			t.Fatalf("expected %s, but found %s", expected, iter.Key())
+		}
+		count++
+	}
+	if err := iter.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if count != 1000 {
+		t.Fatalf("expected 1000 keys, but found %d", count)
+	}
+
+	for _, err := range []error{
+		ro.Set([]byte("a"), []byte("a"), nil),
+		ro.Delete([]byte("a"), nil),
+		ro.DeleteRange([]byte("a"), []byte("b"), nil),
+		ro.Merge([]byte("a"), []byte("a"), nil),
+		ro.NewBatch().Commit(nil),
+		ro.Flush(),
+		ro.Compact([]byte("a"), []byte("b")),
+		ro.Ingest(nil),
+		ro.Resume(),
+	} {
+		if err != ErrReadOnly {
+			t.Fatalf("expected ErrReadOnly, but found %v", err)
+		}
+	}
+	if err := ro.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	if after := listFiles(); !reflect.DeepEqual(before, after) {
+		t.Fatalf("files modified by read-only DB\nbefore %v\nafter  %v", before, after)
+	}
+	if err := d.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// runCrashTest runs op against a DB created by setup, simulating a crash
+// before each of the storage operations performed by op in turn. After each
+// crash, the DB is reopened from the durable state of the storage at the time
+// of the crash and passed to verify.
+func runCrashTest(
+	t *testing.T,
+	setup func(fs storage.Storage) *DB,
+	op func(d *DB, fs storage.Storage) *DB,
+	verify func(d *DB),
+) {
+	for crashAt := 0; ; crashAt++ {
+		fs := storage.NewFaultMem()
+		d := setup(fs)
+
+		var mu sync.Mutex
+		var n int
+		var crashed *storage.FaultStorage
+		fs.SetInjector(func(storage.FaultOp, string) error {
+			mu.Lock()
+			defer mu.Unlock()
+			if n == crashAt {
+				crashed = fs.Crash()
+			}
+			n++
+			return nil
+		})
+		d = op(d, fs)
+		fs.SetInjector(nil)
+		if err := d.Close(); err != nil {
+			t.Fatal(err)
+		}
+
+		mu.Lock()
+		done := crashed == nil
+		mu.Unlock()
+		if done {
+			// The operation completed before reaching the crash point.
+			if crashAt == 0 {
+				t.Fatal("expected the operation to perform I/O")
+			}
+			return
+		}
+
+		d, err := Open("", &db.Options{Storage: crashed})
+		if err != nil {
+			t.Fatalf("crash at op %d: %v", crashAt, err)
+		}
+		verify(d)
+		if err := d.Close(); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func crashTestSetup(fs storage.Storage) *DB {
+	d, err := Open("", &db.Options{Storage: fs})
+	if err != nil {
+		panic(err)
+	}
+	for i := 0; i < 100; i++ {
+		key := []byte(fmt.Sprintf("%03d", i))
+		if err := d.Set(key, key, db.Sync); err != nil {
+			panic(err)
+		}
+	}
+	return d
+}
+
+func crashTestVerify(t *testing.T, d *DB) {
+	for i := 0; i < 100; i++ {
+		key := []byte(fmt.Sprintf("%03d", i))
+		v, err := d.Get(key)
+		if err != nil {
+			t.Fatalf("%s: %v", key, err)
+		}
+		if !bytes.Equal(key, v) {
+			t.Fatalf("%s: expected %s, but found %s", key, key, v)
+		}
+	}
+}
+
+func TestCrashDuringFlush(t *testing.T) {
+	runCrashTest(t, crashTestSetup,
+		func(d *DB, fs storage.Storage) *DB {
+			if err := d.Flush(); err != nil {
+				t.Fatal(err)
+			}
+			return d
+		},
+		func(d *DB) {
+			crashTestVerify(t, d)
+		})
+}
+
+func TestCrashDuringManifestRotation(t *testing.T) {
+	setup := func(fs storage.Storage) *DB {
+		d := crashTestSetup(fs)
+		if err := d.Flush(); err != nil {
+			t.Fatal(err)
+		}
+		return d
+	}
+	runCrashTest(t, setup,
+		func(d *DB, fs storage.Storage) *DB {
+			// Reopening the DB writes a new manifest and switches CURRENT to it.
+			if err := d.Close(); err != nil {
+				t.Fatal(err)
+			}
+			d, err := Open("", &db.Options{Storage: fs})
+			if err != nil {
+				t.Fatal(err)
+			}
+			return d
+		},
+		func(d *DB) {
+			crashTestVerify(t, d)
+		})
+}
+
+func TestManifestRotation(t *testing.T) {
+	fs := storage.NewMem()
+	opts := secondaryTestOptions(fs)
+	// Every edit starts a new manifest.
+	opts.MaxManifestFileSize = 1
+	d, err := Open("", opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	secondary, err := OpenReadOnly("", secondaryTestOptions(fs))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := make(map[string]string)
+	var lastManifest string
+	for i := 0; i < 5; i++ {
+		key := fmt.Sprintf("%d", i)
+		if err := d.Set([]byte(key), []byte(key), nil); err != nil {
+			t.Fatal(err)
+		}
+		expected[key] = key
+		if err := d.Flush(); err != nil {
+			t.Fatal(err)
+		}
+
+		// The old manifest is deleted once CURRENT names the new one.
+		manifests := listFiles(t, fs, fileTypeManifest)
+		if len(manifests) != 1 {
+			t.Fatalf("%d: expected 1 manifest, but found %v", i, manifests)
+		}
+		current, err := readCurrentFile(fs, "")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if current != manifests[0] || current == lastManifest {
+			t.Fatalf("%d: expected a new manifest, but found %s (CURRENT=%s)", i, manifests[0], current)
+		}
+		lastManifest = current
+
+		if err := secondary.TryCatchUpWithPrimary(); err != nil {
+			t.Fatal(err)
+		}
+		if actual := readAll(t, secondary); !reflect.DeepEqual(expected, actual) {
+			t.Fatalf("%d: expected %v, but found %v", i, expected, actual)
+		}
+	}
+	if err := secondary.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// The edit of a compaction does not record the log number, which is read
+	// from the snapshot at the start of the new manifest.
+	if err := d.Compact([]byte("0"), []byte("9")); err != nil {
+		t.Fatal(err)
+	}
+	secondary, err = OpenReadOnly("", secondaryTestOptions(fs))
+	if err != nil {
+		t.Fatal(err)
+	}
+	d.mu.Lock()
+	logNumber := d.mu.versions.logNumber
+	d.mu.Unlock()
+	if n := secondary.mu.versions.logNumber; n != logNumber {
+		t.Fatalf("expected log number %d, but found %d", logNumber, n)
+	}
+	if err := secondary.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// The unflushed write is replayed from the log named by the snapshot at
+	// the start of the last manifest.
+	if err := d.Set([]byte("a"), []byte("unflushed"), db.Sync); err != nil {
+		t.Fatal(err)
+	}
+	expected["a"] = "unflushed"
+	if err := d.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if d, err = Open("", secondaryTestOptions(fs)); err != nil {
+		t.Fatal(err)
+	}
+	if actual := readAll(t, d); !reflect.DeepEqual(expected, actual) {
+		t.Fatalf("expected %v, but found %v", expected, actual)
+	}
+	if err := d.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestCrashDuringManifestSizeRotation(t *testing.T) {
+	runCrashTest(t, crashTestSetup,
+		func(d *DB, fs storage.Storage) *DB {
+			// The flush starts a new manifest, as the manifest exceeds the size
+			// limit.
+			d.opts.MaxManifestFileSize = 1
+			if err := d.Flush(); err != nil {
+				t.Fatal(err)
+			}
+			return d
+		},
+		func(d *DB) {
+			crashTestVerify(t, d)
+		})
+}
+
+func TestCrashDuringIngest(t *testing.T) {
+	setup := func(fs storage.Storage) *DB {
+		d := crashTestSetup(fs)
+		if err := fs.MkdirAll("ext", 0755); err != nil {
+			t.Fatal(err)
+		}
+		f, err := fs.Create("ext/0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		w := sstable.NewWriter(f, nil, db.LevelOptions{})
+		for i := 0; i < 10; i++ {
+			key := []byte(fmt.Sprintf("ingest%d", i))
+			if err := w.Add(db.MakeInternalKey(key, 0, db.InternalKeyKindSet), key); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if err := w.Close(); err != nil {
+			t.Fatal(err)
+		}
+		return d
+	}
+	runCrashTest(t, setup,
+		func(d *DB, fs storage.Storage) *DB {
+			if err := d.Ingest([]string{"ext/0"}); err != nil {
+				t.Fatal(err)
+			}
+			return d
+		},
+		func(d *DB) {
+			crashTestVerify(t, d)
+			// The ingestion is atomic: either all or none of the ingested keys
+			// are present.
+			var found int
+			for i := 0; i < 10; i++ {
+				key := []byte(fmt.Sprintf("ingest%d", i))
+				if _, err := d.Get(key); err == nil {
+					found++
+				} else if err != db.ErrNotFound {
+					t.Fatalf("%s: %v", key, err)
+				}
+			}
+			if found != 0 && found != 10 {
+				t.Fatalf("expected 0 or 10 ingested keys, but found %d", found)
+			}
+		})
+}
+
+func TestCrashDuringOpenAfterTornWrite(t *testing.T) {
+	setup := func(fs storage.Storage) *DB {
+		d := crashTestSetup(fs)
+		if err := d.Close(); err != nil {
+			t.Fatal(err)
+		}
+		// Tear the write of the last record.
+		logs := listFiles(t, fs, fileTypeLog)
+		if len(logs) != 1 {
+			t.Fatalf("expected 1 log, but found %v", logs)
+		}
+		stat, err := fs.Stat(logs[0])
+		if err != nil {
+			t.Fatal(err)
+		}
+		truncateFile(t, fs, logs[0], int(stat.Size())-2)
+		return nil
+	}
+	runCrashTest(t, setup,
+		func(_ *DB, fs storage.Storage) *DB {
+			// A crash after opening the DB creates a new log file, but before the
+			// manifest is updated, leaves the torn log followed by an empty log.
+			d, err := Open("", &db.Options{Storage: fs})
+			if err != nil {
+				t.Fatal(err)
+			}
+			return d
+		},
+		func(d *DB) {
+			for i := 0; i < 99; i++ {
+				key := []byte(fmt.Sprintf("%03d", i))
+				if _, err := d.Get(key); err != nil {
+					t.Fatalf("%s: %v", key, err)
+				}
+			}
+			if _, err := d.Get([]byte("099")); err != db.ErrNotFound {
+				t.Fatalf("expected the torn record to be dropped, but found %v", err)
+			}
+		})
+}
+
+// truncateFile truncates a file to the given size and syncs it.
+func truncateFile(t *testing.T, fs storage.Storage, filename string, size int) {
+	t.Helper()
+	f, err := fs.Open(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err := ioutil.ReadAll(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.Close()
+	f, err = fs.Create(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := f.Write(data[:size]); err != nil {
+		t.Fatal(err)
+	}
+	if err := f.Sync(); err != nil {
+		t.Fatal(err)
+	}
+	if err := f.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestWALRecoveryMode(t *testing.T) {
+	const numKeys = 100
+	value := bytes.Repeat([]byte("x"), 1000)
+	setup := func() (storage.Storage, string) {
+		fs := storage.NewMem()
+		d, err := Open("", &db.Options{Storage: fs})
+		if err != nil {
+			t.Fatal(err)
+		}
+		for i := 0; i < numKeys; i++ {
+			if err := d.Set([]byte(fmt.Sprintf("%03d", i)), value, nil); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if err := d.Close(); err != nil {
+			t.Fatal(err)
+		}
+		logs := listFiles(t, fs, fileTypeLog)
+		if len(logs) != 1 {
+			t.Fatalf("expected 1 log, but found %v", logs)
+		}
+		return fs, logs[0]
+	}
+
+	testCases := []struct {
+		name    string
+		corrupt func(fs storage.Storage, log string)
+		// expected maps each recovery mode to the keys expected to be dropped:
+		// "none", "last" (only the last key), "suffix" (a suffix of the keys),
+		// "some" (keys other than the last key) or "error" if the DB fails to
+		// open.
+		expected map[db.WALRecoveryMode]string
+	}{
+		{
+			name: "torn tail",
+			corrupt: func(fs storage.Storage, log string) {
+				f, err := fs.Open(log)
+				if err != nil {
+					t.Fatal(err)
+				}
+				data, err := ioutil.ReadAll(f)
+				if err != nil {
+					t.Fatal(err)
+				}
+				f.Close()
+				truncateFile(t, fs, log, len(data)-10)
+			},
+			expected: map[db.WALRecoveryMode]string{
+				db.WALRecoveryTolerateCorruptedTail:   "last",
+				db.WALRecoveryAbsoluteConsistency:     "error",
+				db.WALRecoveryPointInTime:             "last",
+				db.WALRecoverySkipAnyCorruptedRecords: "last",
+			},
+		},
+		{
+			name: "corrupt final block",
+			corrupt: func(fs storage.Storage, log string) {
+				// Corrupt a record which is followed by intact records in the
+				// final block of the log.
+				stat, err := fs.Stat(log)
+				if err != nil {
+					t.Fatal(err)
+				}
+				offset := int(stat.Size()) - 3000
+				if offset < int(stat.Size())/32768*32768 {
+					t.Fatalf("offset %d is not in the final block", offset)
+				}
+				corruptFile(t, fs, log, offset)
+			},
+			expected: map[db.WALRecoveryMode]string{
+				db.WALRecoveryTolerateCorruptedTail:   "error",
+				db.WALRecoveryAbsoluteConsistency:     "error",
+				db.WALRecoveryPointInTime:             "suffix",
+				db.WALRecoverySkipAnyCorruptedRecords: "suffix",
+			},
+		},
+		{
+			name: "corrupt record",
+			corrupt: func(fs storage.Storage, log string) {
+				corruptFile(t, fs, log, 40000)
+			},
+			expected: map[db.WALRecoveryMode]string{
+				db.WALRecoveryTolerateCorruptedTail:   "error",
+				db.WALRecoveryAbsoluteConsistency:     "error",
+				db.WALRecoveryPointInTime:             "suffix",
+				db.WALRecoverySkipAnyCorruptedRecords: "some",
+			},
+		},
+	}
+	for _, c := range testCases {
+		for mode, expected := range c.expected {
+			t.Run(fmt.Sprintf("%s/%s", c.name, mode), func(t *testing.T) {
+				fs, log := setup()
+				c.corrupt(fs, log)
+
+				var events []db.WALCorruptionInfo
+				d, err := Open("", &db.Options{
+					Storage:         fs,
+					WALRecoveryMode: mode,
+					EventListener: &db.EventListener{
+						WALCorruption: func(info db.WALCorruptionInfo) {
+							events = append(events, info)
+						},
+					},
+				})
+				if expected == "error" {
+					if err == nil {
+						t.Fatal("expected error opening DB")
+					}
+					if len(events) != 0 {
+						t.Fatalf("expected no events, but found %v", events)
+					}
+					return
+				}
+				if err != nil {
+					t.Fatal(err)
+				}
+				if len(events) != 1 || events[0].Path != log || events[0].Offset == 0 {
+					t.Fatalf("expected 1 event for %s, but found %+v", log, events)
+				}
+
+				keys := readAll(t, d)
+				var dropped []int
+				for i := 0; i < numKeys; i++ {
+					if _, ok := keys[fmt.Sprintf("%03d", i)]; !ok {
+						dropped = append(dropped, i)
+					}
+				}
+				if len(dropped) == 0 {
+					t.Fatal("expected keys to be dropped")
+				}
+				switch expected {
+				case "last":
+					if len(dropped) != 1 || dropped[0] != numKeys-1 {
+						t.Fatalf("expected the last key to be dropped, but found %v", dropped)
+					}
+				case "suffix":
+					if dropped[len(dropped)-1]-dropped[0] != len(dropped)-1 ||
+						dropped[len(dropped)-1] != numKeys-1 {
+						t.Fatalf("expected a suffix of the keys to be dropped, but found %v", dropped)
+					}
+				case "some":
+					if dropped[len(dropped)-1] == numKeys-1 {
+						t.Fatalf("expected the last key to be kept, but found %v", dropped)
+					}
+				}
+
+				// The DB remains writable, and the dropped records stay dropped
+				// when it is reopened.
+				if err := d.Set([]byte("new"), value, nil); err != nil {
+					t.Fatal(err)
+				}
+				if err := d.Close(); err != nil {
+					t.Fatal(err)
+				}
+				d, err = Open("", &db.Options{Storage: fs})
+				if err != nil {
+					t.Fatal(err)
+				}
+				if actual := readAll(t, d); len(actual) != len(keys)+1 {
+					t.Fatalf("expected %d keys, but found %d", len(keys)+1, len(actual))
+				}
+				if err := d.Close(); err != nil {
+					t.Fatal(err)
+				}
+			})
+		}
+	}
+}
+
+func TestWALDir(t *testing.T) {
+	fs := storage.NewMem()
+	countLogs := func(dir string) int {
+		t.Helper()
+		logs, err := listLogFiles(fs, []string{dir})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return len(logs)
+	}
+
+	// Each layout writes a key which is left in the WAL, and the next layout
+	// replays it from the previous WAL directory.
+	expected := make(map[string]string)
+	walDirs := []string{"wal-a", "wal-a", "", "wal-b", "wal-a", "db", ""}
+	for i, walDir := range walDirs {
+		opts := &db.Options{
+			Storage: fs,
+			WALDir:  walDir,
+		}
+		d, err := Open("db", opts)
+		if err != nil {
+			t.Fatalf("%d: %v", i, err)
+		}
+		if actual := readAll(t, d); !reflect.DeepEqual(expected, actual) {
+			t.Fatalf("%d: expected %v, but found %v", i, expected, actual)
+		}
+		key := fmt.Sprintf("%d", i)
+		if err := d.Set([]byte(key), []byte(walDir), db.Sync); err != nil {
+			t.Fatal(err)
+		}
+		expected[key] = walDir
+		if err := d.Close(); err != nil {
+			t.Fatal(err)
+		}
+
+		walDirname := walDir
+		if walDir == "" {
+			walDirname = "db"
+		}
+		for _, dir := range []string{"db", "wal-a", "wal-b"} {
+			n := countLogs(dir)
+			if dir == walDirname && n != 1 {
+				t.Fatalf("%d: expected 1 log in %q, but found %d", i, dir, n)
+			} else if dir != walDirname && n != 0 {
+				t.Fatalf("%d: expected no logs in %q, but found %d", i, dir, n)
+			}
+		}
+
+		// A DB opened read-only replays the logs in the WAL directory.
+		d, err = OpenReadOnly("db", opts)
+		if err != nil {
+			t.Fatalf("%d: %v", i, err)
+		}
+		if actual := readAll(t, d); !reflect.DeepEqual(expected, actual) {
+			t.Fatalf("%d: expected %v, but found %v", i, expected, actual)
+		}
+		if err := d.Close(); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// The DB cannot be opened if the WAL directory it was last opened with is
+	// missing.
+	d, err := Open("db", &db.Options{Storage: fs, WALDir: "wal-c"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := d.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := fs.Remove(dbFilename("wal-c", fileTypeLog, d.mu.log.number)); err != nil {
+		t.Fatal(err)
+	}
+	if err := fs.Remove("wal-c"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := Open("db", &db.Options{Storage: fs}); err == nil {
+		t.Fatal("expected error opening DB with a missing WAL directory")
+	}
+}
+
+func TestOpenOptionsCheck(t *testing.T) {
+	fs := storage.NewMem()
+	opts := &db.Options{
+		Storage:      fs,
+		MemTableSize: 1 << 20,
+		WALDir:       "wal",
+	}
+	d, err := Open("", opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := d.Set([]byte("a"), []byte("b"), nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := d.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// Opening the DB with a different comparer or merger fails.
+	comparer := *db.DefaultComparer
+	comparer.Name = "test.comparer"
+	merger := *db.DefaultMerger
+	merger.Name = "test.merger"
+	for _, o := range []*db.Options{
+		{Storage: fs, Comparer: &comparer},
+		{Storage: fs, Merger: &merger},
+	} {
+		if _, err := Open("", o); err == nil {
+			t.Fatal("expected error opening DB with incompatible options")
+		} else if !strings.Contains(err.Error(), "was last opened with") {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if _, err := OpenReadOnly("", o); err == nil {
+			t.Fatal("expected error opening DB read-only with incompatible options")
+		}
+	}
+
+	// The DB can be opened with its stored options.
+	loaded, err := LoadOptions("", fs, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if loaded.MemTableSize != opts.MemTableSize || loaded.WALDir != opts.WALDir {
+		t.Fatalf("expected the stored options, but found\n%s", loaded)
+	}
+	d, err = Open("", loaded)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if v, err := d.Get([]byte("a")); err != nil || string(v) != "b" {
+		t.Fatalf("expected b, but found %q (%v)", v, err)
+	}
+	if err := d.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := LoadOptions("", storage.NewMem(), nil); err == nil {
+		t.Fatal("expected error loading the options of a missing DB")
+	}
+
+	// Only the comparer, merger and WAL directory are checked, so options
+	// which cannot be parsed do not prevent the DB from being opened.
+	writeOptions := func(comparerName string) {
+		f, err := fs.Create("OPTIONS-999999")
+		if err != nil {
+			t.Fatal(err)
+		}
+		fmt.Fprintf(f, "[Options]\n  bytes_per_sync=bogus\n  comparer=%s\n  wal_dir=wal\n", comparerName)
+		fmt.Fprintf(f, "[Level \"x\"]\n  filter_policy=unknown.policy\n")
+		if err := f.Close(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	writeOptions(comparer.Name)
+	if _, err := Open("", &db.Options{Storage: fs}); err == nil {
+		t.Fatal("expected error opening DB with incompatible options")
+	}
+	writeOptions(db.DefaultComparer.Name)
+	d, err = Open("", &db.Options{Storage: fs, WALDir: "wal"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := d.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -127,7 +127,7 @@ type Reader struct {
 	fileNum uint64 // TODO(peter): needed for block cache
 	err     error
 	index   []byte
-	cache   *cache.Cache
+	cache   db.Cache
 	cmp     db.Compare
 }
 
@@ -245,8 +245,10 @@ func (r *Reader) NewIter() *Iter {
 
 // readBlock reads and decompresses a block from disk into memory.
 func (r *Reader) readBlock(bh blockHandle) ([]byte, error) {
-	if b := r.cache.Get(r.fileNum, bh.offset); b != nil {
-		return b, nil
+	if r.cache != nil {
+		if b := r.cache.Get(r.fileNum, bh.offset); b != nil {
+			return b, nil
+		}
 	}
 
 	b := make([]byte, bh.length+blockTrailerLen)
@@ -261,14 +263,18 @@ func (r *Reader) readBlock(bh blockHandle) ([]byte, error) {
 	switch b[bh.length] {
 	case noCompressionBlockType:
 		b = b[:bh.length]
-		r.cache.Set(r.fileNum, bh.offset, b)
+		if r.cache != nil {
+			r.cache.Set(r.fileNum, bh.offset, b, cache.LowPriority)
+		}
 		return b, nil
 	case snappyCompressionBlockType:
 		b, err := snappy.Decode(nil, b[:bh.length])
 		if err != nil {
 			return nil, err
 		}
-		r.cache.Set(r.fileNum, bh.offset, b)
+		if r.cache != nil {
+			r.cache.Set(r.fileNum, bh.offset, b, cache.LowPriority)
+		}
 		return b, nil
 	}
 	return nil, fmt.Errorf("pebble/table: unknown block compression: %d", b[bh.length])
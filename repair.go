@@ -0,0 +1,594 @@
+// Copyright 2018 The LevelDB-Go and Pebble Authors. All rights reserved. Use
+// of this source code is governed by a BSD-style license that can be found in
+// the LICENSE file.
+
+package pebble
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"math"
+	"path/filepath"
+	"sort"
+
+	"github.com/petermattis/pebble/db"
+	"github.com/petermattis/pebble/internal/arenaskl"
+	"github.com/petermattis/pebble/internal/record"
+	"github.com/petermattis/pebble/sstable"
+)
+
+// repairLostDir is the subdirectory of the DB directory to which Repair moves
+// the tables it cannot read.
+const repairLostDir = "lost"
+
+// RepairReport describes the outcome of Repair.
+type RepairReport struct {
+	// Tables are the tables of the repaired DB, all of which are in level 0.
+	Tables []db.TableInfo
+	// Lost describes the data which could not be recovered.
+	Lost []string
+}
+
+func (r *RepairReport) String() string {
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, "recovered %d tables\n", len(r.Tables))
+	for _, t := range r.Tables {
+		fmt.Fprintf(&buf, "  %s: %d bytes, seqnums %d-%d\n",
+			filepath.Base(t.Path), t.Size, t.SmallestSeqNum, t.LargestSeqNum)
+	}
+	if len(r.Lost) == 0 {
+		fmt.Fprintf(&buf, "no data was lost\n")
+		return buf.String()
+	}
+	fmt.Fprintf(&buf, "lost:\n")
+	for _, l := range r.Lost {
+		fmt.Fprintf(&buf, "  %s\n", l)
+	}
+	return buf.String()
+}
+
+// Repair rebuilds the MANIFEST of the DB in dirname, which must not be open,
+// from the tables and log files in the directory. It is intended for DBs
+// which cannot be opened because their MANIFEST is missing or corrupt.
+//
+// Every table is read in full to recover its bounds and sequence numbers.
+// Tables which cannot be read are moved to the "lost" subdirectory. The
+// contents of the log files are written to new tables, skipping any corrupt
+// records. All of the tables are placed in level 0, ordered so that newer
+// versions of a key are found before older ones, and subsequent compactions
+// move them down the LSM. Tables whose sequence numbers cannot be ordered
+// this way are merged, and the merged output is split into tables of the
+// level 0 target file size.
+//
+// The sequence number assigned to an ingested table is only recorded in the
+// MANIFEST, so the contents of ingested tables are treated as older than all
+// other data.
+//
+// As with Open, Repair fails if the Comparer or Merger differ from those
+// recorded in the OPTIONS file when the DB was last opened. LoadOptions
+// returns the recorded options.
+func Repair(dirname string, opts *db.Options) (*RepairReport, error) {
+	opts = opts.EnsureDefaults()
+	fs := opts.Storage
+	fileLock, err := fs.Lock(dbFilename(dirname, fileTypeLock, 0))
+	if err != nil {
+		return nil, err
+	}
+	defer fileLock.Close()
+
+	// The tables are rewritten with the comparer and merger, so they must be
+	// those the DB was last opened with.
+	var prevWALDirname string
+	stored, err := readOptionsFile(fs, dirname, nameOnlyParseHooks)
+	if err != nil {
+		return nil, err
+	}
+	if stored != nil {
+		if err := checkOptions(dirname, opts, stored); err != nil {
+			return nil, err
+		}
+		prevWALDirname = stored.WALDir
+	}
+
+	ls, err := fs.List(dirname)
+	if err != nil {
+		return nil, err
+	}
+	r := &repairer{
+		dirname: dirname,
+		opts:    opts,
+		cmp:     opts.Comparer.Compare,
+		report:  &RepairReport{},
+	}
+	var tableNums []uint64
+	for _, filename := range ls {
+		ft, fn, ok := parseDBFilename(filename)
+		if !ok {
+			continue
+		}
+		r.markFileNumUsed(fn)
+		if ft == fileTypeTable {
+			tableNums = append(tableNums, fn)
+		}
+	}
+	// The log files may also be in the WAL directory, or in the WAL directory
+	// the DB was last opened with.
+	walDirname := dirname
+	if opts.WALDir != "" {
+		walDirname = opts.WALDir
+	}
+	dirs := logDirs(dirname, walDirname, prevWALDirname)
+	logFiles, err := listLogFiles(fs, dirs)
+	if err != nil {
+		return nil, err
+	}
+	for _, lf := range logFiles {
+		r.markFileNumUsed(lf.num)
+	}
+	sort.Slice(tableNums, func(i, j int) bool { return tableNums[i] < tableNums[j] })
+
+	for _, fn := range tableNums {
+		if err := r.loadTable(fn); err != nil {
+			return nil, err
+		}
+	}
+	for _, lf := range logFiles {
+		if err := r.convertLog(lf); err != nil {
+			return nil, err
+		}
+	}
+	if err := r.orderTables(); err != nil {
+		return nil, err
+	}
+	if err := r.writeManifest(); err != nil {
+		return nil, err
+	}
+	return r.report, nil
+}
+
+type repairer struct {
+	dirname        string
+	opts           *db.Options
+	cmp            db.Compare
+	nextFileNumber uint64
+	tables         []*fileMetadata
+	report         *RepairReport
+}
+
+func (r *repairer) markFileNumUsed(fileNum uint64) {
+	if r.nextFileNumber <= fileNum {
+		r.nextFileNumber = fileNum + 1
+	}
+}
+
+func (r *repairer) nextFileNum() uint64 {
+	x := r.nextFileNumber
+	r.nextFileNumber++
+	return x
+}
+
+func (r *repairer) lost(format string, args ...interface{}) {
+	msg := fmt.Sprintf(format, args...)
+	r.opts.Logger.Infof("repair: lost %s", msg)
+	r.report.Lost = append(r.report.Lost, msg)
+}
+
+// loadTable reads the table with the given file number in full, recovering
+// its metadata. A table which cannot be read is moved to the lost directory.
+func (r *repairer) loadTable(fileNum uint64) error {
+	filename := dbFilename(r.dirname, fileTypeTable, fileNum)
+	meta, err := r.scanTable(filename, fileNum)
+	if err == nil {
+		r.tables = append(r.tables, meta)
+		return nil
+	}
+
+	fs := r.opts.Storage
+	lostDir := filepath.Join(r.dirname, repairLostDir)
+	if err := fs.MkdirAll(lostDir, 0755); err != nil {
+		return err
+	}
+	if err := fs.Rename(filename, filepath.Join(lostDir, filepath.Base(filename))); err != nil {
+		return err
+	}
+	r.lost("table %s (moved to %s): %v", filepath.Base(filename), repairLostDir, err)
+	return nil
+}
+
+func (r *repairer) scanTable(filename string, fileNum uint64) (*fileMetadata, error) {
+	fs := r.opts.Storage
+	stat, err := fs.Stat(filename)
+	if err != nil {
+		return nil, err
+	}
+	f, err := fs.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	tr := sstable.NewReader(f, fileNum, r.opts)
+	defer tr.Close()
+
+	meta := &fileMetadata{
+		fileNum:        fileNum,
+		size:           uint64(stat.Size()),
+		smallestSeqNum: math.MaxUint64,
+	}
+	iter := tr.NewIter(nil)
+	defer iter.Close()
+	for iter.First(); iter.Valid(); iter.Next() {
+		meta.add(iter.Key())
+	}
+	if err := iter.Error(); err != nil {
+		return nil, err
+	}
+	if meta.smallestSeqNum == math.MaxUint64 {
+		return nil, fmt.Errorf("pebble: table is empty")
+	}
+	return meta, nil
+}
+
+// add extends the bounds and sequence numbers of a table being scanned or
+// written to include key, which must be greater than the keys already added.
+func (m *fileMetadata) add(key db.InternalKey) {
+	if m.smallestSeqNum == math.MaxUint64 {
+		m.smallest = key.Clone()
+	}
+	m.largest.UserKey = append(m.largest.UserKey[:0], key.UserKey...)
+	m.largest.Trailer = key.Trailer
+	if seqNum := key.SeqNum(); seqNum < m.smallestSeqNum {
+		m.smallestSeqNum = seqNum
+	}
+	if seqNum := key.SeqNum(); seqNum > m.largestSeqNum {
+		m.largestSeqNum = seqNum
+	}
+}
+
+// convertLog replays the log file into memtables which are written to new
+// tables. Corrupt records are skipped.
+func (r *repairer) convertLog(lf walFile) error {
+	filename := lf.path()
+	file, err := r.opts.Storage.Open(filename)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	var (
+		buf bytes.Buffer
+		mem *memTable
+		rr  = record.NewLogReader(file, lf.num)
+	)
+	flush := func() error {
+		if mem == nil || mem.empty() {
+			return nil
+		}
+		tables, err := r.writeTables(mem.newIter(nil))
+		if err != nil {
+			return err
+		}
+		r.tables = append(r.tables, tables...)
+		mem = nil
+		return nil
+	}
+
+	lastErrOffset := int64(-1)
+	for {
+		offset := rr.Offset()
+		rec, err := rr.Next()
+		if err == io.EOF {
+			break
+		}
+		buf.Reset()
+		if err == nil {
+			_, err = io.Copy(&buf, rec)
+		}
+		if err == nil && buf.Len() < batchHeaderLen {
+			err = fmt.Errorf("pebble: corrupt log record")
+		}
+		if err != nil {
+			if offset == lastErrOffset {
+				// Recovering did not make progress, so the error is not due
+				// to a corrupt record.
+				return err
+			}
+			lastErrOffset = offset
+			// Skip to the next block which begins a record.
+			r.lost("log %s: records following offset %d: %v", filepath.Base(filename), offset, err)
+			rr.Recover()
+			continue
+		}
+
+		b := Batch{}
+		b.data = buf.Bytes()
+		b.refreshMemTableSize()
+		if mem == nil {
+			mem = newMemTable(r.opts)
+		}
+		err = mem.prepare(&b)
+		if err == arenaskl.ErrArenaFull && !mem.empty() {
+			if err := flush(); err != nil {
+				return err
+			}
+			mem = newMemTable(r.opts)
+			err = mem.prepare(&b)
+		}
+		if err != nil {
+			return err
+		}
+		if err := mem.apply(&b, b.seqNum()); err != nil {
+			return err
+		}
+		mem.unref()
+	}
+	return flush()
+}
+
+// writeTables writes the entries of iter to new tables, starting a new table
+// once the current one reaches the target file size of level 0. Tables are
+// only split between user keys, so the tables have disjoint key ranges.
+// Duplicate entries, which arise when merging tables containing the same
+// data, are written once.
+func (r *repairer) writeTables(iter internalIterator) (_ []*fileMetadata, err error) {
+	fs := r.opts.Storage
+	targetFileSize := uint64(r.opts.Level(0).TargetFileSize)
+	var (
+		tables    []*fileMetadata
+		filenames []string
+		meta      *fileMetadata
+		tw        *sstable.Writer
+	)
+	defer func() {
+		if iter != nil {
+			err = firstError(err, iter.Close())
+		}
+		if tw != nil {
+			err = firstError(err, tw.Close())
+		}
+		if err != nil {
+			for _, filename := range filenames {
+				fs.Remove(filename)
+			}
+		}
+	}()
+
+	finishTable := func() error {
+		err := tw.Close()
+		tw = nil
+		if err != nil {
+			return err
+		}
+		stat, err := fs.Stat(filenames[len(filenames)-1])
+		if err != nil {
+			return err
+		}
+		meta.size = uint64(stat.Size())
+		tables = append(tables, meta)
+		return nil
+	}
+
+	for iter.First(); iter.Valid(); iter.Next() {
+		key := iter.Key()
+		if meta != nil && db.InternalCompare(r.cmp, meta.largest, key) == 0 {
+			continue
+		}
+		if tw != nil && tw.EstimatedSize() >= targetFileSize &&
+			r.cmp(meta.largest.UserKey, key.UserKey) != 0 {
+			if err := finishTable(); err != nil {
+				return nil, err
+			}
+		}
+		if tw == nil {
+			meta = &fileMetadata{
+				fileNum:        r.nextFileNum(),
+				smallestSeqNum: math.MaxUint64,
+			}
+			filename := dbFilename(r.dirname, fileTypeTable, meta.fileNum)
+			file, err := fs.Create(filename)
+			if err != nil {
+				return nil, err
+			}
+			filenames = append(filenames, filename)
+			tw = sstable.NewWriter(file, r.opts, r.opts.Level(0))
+		}
+		if err := tw.Add(key, iter.Value()); err != nil {
+			return nil, err
+		}
+		meta.add(key)
+	}
+	err, iter = iter.Close(), nil
+	if err != nil {
+		return nil, err
+	}
+	if tw != nil {
+		if err := finishTable(); err != nil {
+			return nil, err
+		}
+	}
+	return tables, nil
+}
+
+// repairRun is a set of tables with disjoint key ranges which are ordered as
+// a unit, such as the tables written by merging a group of tables. The bounds
+// of a run are those of the union of its tables.
+type repairRun struct {
+	tables                        []*fileMetadata
+	smallest, largest             []byte
+	smallestSeqNum, largestSeqNum uint64
+}
+
+func (r *repairer) newRepairRun(tables []*fileMetadata) *repairRun {
+	run := &repairRun{tables: tables}
+	for i, t := range tables {
+		if i == 0 || r.cmp(t.smallest.UserKey, run.smallest) < 0 {
+			run.smallest = t.smallest.UserKey
+		}
+		if i == 0 || r.cmp(t.largest.UserKey, run.largest) > 0 {
+			run.largest = t.largest.UserKey
+		}
+		if i == 0 || t.smallestSeqNum < run.smallestSeqNum {
+			run.smallestSeqNum = t.smallestSeqNum
+		}
+		if i == 0 || t.largestSeqNum > run.largestSeqNum {
+			run.largestSeqNum = t.largestSeqNum
+		}
+	}
+	// Order the tables of the run by sequence number.
+	sort.Slice(run.tables, func(i, j int) bool {
+		a, b := run.tables[i], run.tables[j]
+		if a.largestSeqNum != b.largestSeqNum {
+			return a.largestSeqNum < b.largestSeqNum
+		}
+		return a.fileNum < b.fileNum
+	})
+	return run
+}
+
+// orderTables orders the tables by sequence number and assigns them file
+// numbers in that order.
+//
+// The level 0 tables are searched from the highest file number to the lowest
+// and the first entry found for a key is taken to be the newest, so a table
+// must only overlap the key range of a table with a lower file number if all
+// of its sequence numbers are greater. Tables which violate this, such as a
+// table from a lower level whose sequence numbers span those of tables which
+// were above it, are merged. The tables written by a merge have disjoint key
+// ranges, and are ordered as a run using the bounds of their union.
+func (r *repairer) orderTables() error {
+	runs := make([]*repairRun, len(r.tables))
+	for i, t := range r.tables {
+		runs[i] = r.newRepairRun([]*fileMetadata{t})
+	}
+	for {
+		sort.Slice(runs, func(i, j int) bool {
+			a, b := runs[i], runs[j]
+			if a.largestSeqNum != b.largestSeqNum {
+				return a.largestSeqNum < b.largestSeqNum
+			}
+			return a.tables[0].fileNum < b.tables[0].fileNum
+		})
+
+		// Group the runs which must be merged.
+		group := make([]int, len(runs))
+		for i := range group {
+			group[i] = i
+		}
+		var find func(i int) int
+		find = func(i int) int {
+			if group[i] != i {
+				group[i] = find(group[i])
+			}
+			return group[i]
+		}
+		var merges bool
+		for j, b := range runs {
+			for i, a := range runs[:j] {
+				if a.largestSeqNum >= b.smallestSeqNum &&
+					r.cmp(a.smallest, b.largest) <= 0 &&
+					r.cmp(b.smallest, a.largest) <= 0 {
+					group[find(i)] = find(j)
+					merges = true
+				}
+			}
+		}
+		if !merges {
+			break
+		}
+
+		groups := make(map[int][]*repairRun)
+		for i, run := range runs {
+			g := find(i)
+			groups[g] = append(groups[g], run)
+		}
+		merged := make([]*repairRun, 0, len(groups))
+		for i, run := range runs {
+			members := groups[find(i)]
+			if len(members) == 1 {
+				merged = append(merged, run)
+				continue
+			}
+			if members[0] != run {
+				continue
+			}
+			var inputs []*fileMetadata
+			for _, m := range members {
+				inputs = append(inputs, m.tables...)
+			}
+			tables, err := r.mergeTables(inputs)
+			if err != nil {
+				return err
+			}
+			if len(tables) > 0 {
+				merged = append(merged, r.newRepairRun(tables))
+			}
+		}
+		runs = merged
+	}
+
+	r.tables = r.tables[:0]
+	for _, run := range runs {
+		r.tables = append(r.tables, run.tables...)
+	}
+
+	fs := r.opts.Storage
+	var prevFileNum uint64
+	for _, t := range r.tables {
+		if t.fileNum <= prevFileNum {
+			fileNum := r.nextFileNum()
+			err := fs.Rename(dbFilename(r.dirname, fileTypeTable, t.fileNum),
+				dbFilename(r.dirname, fileTypeTable, fileNum))
+			if err != nil {
+				return err
+			}
+			t.fileNum = fileNum
+		}
+		prevFileNum = t.fileNum
+	}
+	return nil
+}
+
+// mergeTables writes the entries of the given tables to new tables. The input
+// tables are left in place, and are deleted as obsolete by Open.
+func (r *repairer) mergeTables(tables []*fileMetadata) ([]*fileMetadata, error) {
+	iters := make([]internalIterator, 0, len(tables))
+	for _, t := range tables {
+		f, err := r.opts.Storage.Open(dbFilename(r.dirname, fileTypeTable, t.fileNum))
+		if err != nil {
+			for _, iter := range iters {
+				iter.Close()
+			}
+			return nil, err
+		}
+		tr := sstable.NewReader(f, t.fileNum, r.opts)
+		iter := tr.NewIter(nil)
+		iter.SetCloseHook(tr.Close)
+		iters = append(iters, iter)
+	}
+	return r.writeTables(newMergingIter(r.cmp, iters...))
+}
+
+// writeManifest writes a new manifest placing all of the tables in level 0.
+// The log files, whose contents have been written to tables, are obsoleted.
+func (r *repairer) writeManifest() error {
+	// The tables must be durably present in the directory before the manifest
+	// referencing them is.
+	if err := syncDir(r.opts.Storage, r.dirname); err != nil {
+		return err
+	}
+
+	manifestFileNum := r.nextFileNum()
+	ve := versionEdit{
+		comparatorName: r.opts.Comparer.Name,
+		logNumber:      r.nextFileNum(),
+	}
+	ve.nextFileNumber = r.nextFileNumber
+	for _, t := range r.tables {
+		// The last sequence is the sequence number following those in use.
+		if ve.lastSequence <= t.largestSeqNum {
+			ve.lastSequence = t.largestSeqNum + 1
+		}
+		ve.newFiles = append(ve.newFiles, newFileEntry{level: 0, meta: *t})
+		r.report.Tables = append(r.report.Tables, t.tableInfo(r.dirname))
+	}
+	return writeManifest(r.dirname, r.opts, manifestFileNum, &ve)
+}
@@ -0,0 +1,334 @@
+// Copyright 2018 The LevelDB-Go and Pebble Authors. All rights reserved. Use
+// of this source code is governed by a BSD-style license that can be found in
+// the LICENSE file.
+
+package pebble
+
+import (
+	"fmt"
+	"io/ioutil"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/petermattis/pebble/db"
+	"github.com/petermattis/pebble/sstable"
+	"github.com/petermattis/pebble/storage"
+)
+
+// corruptFile flips the bits of the byte at the given offset of a file.
+func corruptFile(t *testing.T, fs storage.Storage, filename string, offset int) {
+	t.Helper()
+	f, err := fs.Open(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err := ioutil.ReadAll(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.Close()
+	data[offset] ^= 0xff
+	f, err = fs.Create(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := f.Write(data); err != nil {
+		t.Fatal(err)
+	}
+	if err := f.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// listFiles returns the names of the files of the given type in the root of
+// fs.
+func listFiles(t *testing.T, fs storage.Storage, fileType fileType) []string {
+	t.Helper()
+	ls, err := fs.List("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var names []string
+	for _, name := range ls {
+		if ft, _, ok := parseDBFilename(name); ok && ft == fileType {
+			names = append(names, name)
+		}
+	}
+	return names
+}
+
+func TestRepair(t *testing.T) {
+	fs := storage.NewMem()
+	d, err := Open("", &db.Options{Storage: fs})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Create tables in multiple levels containing overwritten and deleted
+	// keys, and leave some writes in the log.
+	for i := 0; i < 4; i++ {
+		for j := 0; j < 100; j++ {
+			key := []byte(fmt.Sprintf("%03d", j))
+			if j%(i+2) == 0 {
+				err = d.Delete(key, nil)
+			} else {
+				err = d.Set(key, []byte(fmt.Sprintf("%d", i)), nil)
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+		if err := d.Flush(); err != nil {
+			t.Fatal(err)
+		}
+		if i == 1 {
+			if err := d.Compact([]byte("000"), []byte("100")); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	for j := 0; j < 100; j += 7 {
+		if err := d.Set([]byte(fmt.Sprintf("%03d", j)), []byte("log"), nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+	expected := readAll(t, d)
+	if err := d.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// Corrupt the manifest.
+	for _, name := range listFiles(t, fs, fileTypeManifest) {
+		corruptFile(t, fs, name, 0)
+	}
+	if _, err := Open("", &db.Options{Storage: fs}); err == nil {
+		t.Fatal("expected error opening DB with a corrupt manifest")
+	}
+
+	// Repairing the DB with a different comparer fails.
+	comparer := *db.DefaultComparer
+	comparer.Name = "test.comparer"
+	if _, err := Repair("", &db.Options{Storage: fs, Comparer: &comparer}); err == nil {
+		t.Fatal("expected error repairing DB with incompatible options")
+	} else if !strings.Contains(err.Error(), "was last opened with") {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	report, err := Repair("", &db.Options{Storage: fs})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(report.Lost) != 0 {
+		t.Fatalf("expected no data to be lost, but found:\n%s", report)
+	}
+	if len(report.Tables) == 0 {
+		t.Fatalf("expected tables to be recovered")
+	}
+
+	d, err = Open("", &db.Options{Storage: fs})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if actual := readAll(t, d); !reflect.DeepEqual(expected, actual) {
+		t.Fatalf("expected %v, but found %v", expected, actual)
+	}
+	// New writes are sequenced after the recovered data.
+	if err := d.Set([]byte("000"), []byte("new"), nil); err != nil {
+		t.Fatal(err)
+	}
+	if v, err := d.Get([]byte("000")); err != nil {
+		t.Fatal(err)
+	} else if string(v) != "new" {
+		t.Fatalf("expected new, but found %s", v)
+	}
+	if err := d.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestRepairCorruption(t *testing.T) {
+	fs := storage.NewMem()
+	d, err := Open("", &db.Options{Storage: fs})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := d.Set([]byte("a"), []byte("table"), nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := d.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	if err := d.Set([]byte("b"), []byte("log"), nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := d.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	tables := listFiles(t, fs, fileTypeTable)
+	logs := listFiles(t, fs, fileTypeLog)
+	if len(tables) != 1 || len(logs) != 1 {
+		t.Fatalf("expected 1 table and 1 log, but found %v and %v", tables, logs)
+	}
+	corruptFile(t, fs, tables[0], 10)
+	corruptFile(t, fs, logs[0], 10)
+
+	report, err := Repair("", &db.Options{Storage: fs})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(report.Tables) != 0 || len(report.Lost) != 2 ||
+		!strings.HasPrefix(report.Lost[0], "table "+tables[0]) ||
+		!strings.HasPrefix(report.Lost[1], "log "+logs[0]) {
+		t.Fatalf("unexpected report:\n%s", report)
+	}
+	if lost, err := fs.List(repairLostDir); err != nil {
+		t.Fatal(err)
+	} else if !reflect.DeepEqual(lost, tables) {
+		t.Fatalf("expected %v in the lost directory, but found %v", tables, lost)
+	}
+
+	d, err = Open("", &db.Options{Storage: fs})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if actual := readAll(t, d); len(actual) != 0 {
+		t.Fatalf("expected no keys, but found %v", actual)
+	}
+	if err := d.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestRepairOrdering(t *testing.T) {
+	fs := storage.NewMem()
+	opts := (&db.Options{Storage: fs}).EnsureDefaults()
+	writeTable := func(fileNum uint64, entries ...string) {
+		f, err := fs.Create(dbFilename("", fileTypeTable, fileNum))
+		if err != nil {
+			t.Fatal(err)
+		}
+		w := sstable.NewWriter(f, opts, opts.Level(0))
+		for _, e := range entries {
+			var key, value string
+			var seqNum uint64
+			if _, err := fmt.Sscanf(e, "%1s@%d=%s", &key, &seqNum, &value); err != nil {
+				t.Fatal(err)
+			}
+			if err := w.Add(db.MakeInternalKey([]byte(key), seqNum, db.InternalKeyKindSet), []byte(value)); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if err := w.Close(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// Table 5 was below table 6, but contains a key with a higher sequence
+	// number, so the two are merged. Table 3 contains the newest data, so is
+	// renamed to follow the others.
+	writeTable(3, "b@30=newest")
+	writeTable(5, "a@1=old", "z@10=z")
+	writeTable(6, "a@5=new")
+	writeTable(7, "m@20=m")
+
+	report, err := Repair("", &db.Options{Storage: fs})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var seqNums []string
+	for i, table := range report.Tables {
+		seqNums = append(seqNums, fmt.Sprintf("%d-%d", table.SmallestSeqNum, table.LargestSeqNum))
+		if i > 0 && table.FileNum <= report.Tables[i-1].FileNum {
+			t.Fatalf("tables are not in increasing file number order:\n%s", report)
+		}
+	}
+	if expected := []string{"1-10", "20-20", "30-30"}; !reflect.DeepEqual(expected, seqNums) {
+		t.Fatalf("expected tables %v, but found:\n%s", expected, report)
+	}
+
+	d, err := Open("", &db.Options{Storage: fs})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for key, expected := range map[string]string{"a": "new", "b": "newest", "m": "m", "z": "z"} {
+		if v, err := d.Get([]byte(key)); err != nil {
+			t.Fatal(err)
+		} else if string(v) != expected {
+			t.Fatalf("%s: expected %s, but found %s", key, expected, v)
+		}
+	}
+	if err := d.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestRepairMergeSplit(t *testing.T) {
+	fs := storage.NewMem()
+	opts := &db.Options{
+		Storage: fs,
+		Levels:  []db.LevelOptions{{TargetFileSize: 2 << 10}},
+	}
+	opts.EnsureDefaults()
+	writeTable := func(fileNum uint64, seqNum func(i int) uint64, extra ...db.InternalKey) {
+		f, err := fs.Create(dbFilename("", fileTypeTable, fileNum))
+		if err != nil {
+			t.Fatal(err)
+		}
+		w := sstable.NewWriter(f, opts, opts.Level(0))
+		for i := 0; i < 200; i++ {
+			key := db.MakeInternalKey([]byte(fmt.Sprintf("a%03d", i)), seqNum(i), db.InternalKeyKindSet)
+			if err := w.Add(key, []byte(fmt.Sprintf("%020d", key.SeqNum()))); err != nil {
+				t.Fatal(err)
+			}
+		}
+		for _, key := range extra {
+			if err := w.Add(key, []byte("z")); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if err := w.Close(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// Table 5 contains a key with a higher sequence number than all of those
+	// in table 6, so the two are merged. The merged output is larger than the
+	// target file size.
+	writeTable(5, func(i int) uint64 { return uint64(i + 1) },
+		db.MakeInternalKey([]byte("z"), 1000, db.InternalKeyKindSet))
+	writeTable(6, func(i int) uint64 { return uint64(i + 300) })
+
+	report, err := Repair("", opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(report.Tables) < 2 {
+		t.Fatalf("expected the merged output to be split, but found:\n%s", report)
+	}
+	for i, table := range report.Tables {
+		if i > 0 && table.FileNum <= report.Tables[i-1].FileNum {
+			t.Fatalf("tables are not in increasing file number order:\n%s", report)
+		}
+		if table.Size > 2*uint64(opts.Level(0).TargetFileSize) {
+			t.Fatalf("expected tables near the target file size, but found:\n%s", report)
+		}
+	}
+
+	d, err := Open("", opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 200; i++ {
+		key := []byte(fmt.Sprintf("a%03d", i))
+		if v, err := d.Get(key); err != nil {
+			t.Fatal(err)
+		} else if expected := fmt.Sprintf("%020d", i+300); string(v) != expected {
+			t.Fatalf("%s: expected %s, but found %s", key, expected, v)
+		}
+	}
+	if v, err := d.Get([]byte("z")); err != nil || string(v) != "z" {
+		t.Fatalf("expected z, but found %q (%v)", v, err)
+	}
+	if err := d.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
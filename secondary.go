@@ -0,0 +1,194 @@
+// Copyright 2018 The LevelDB-Go and Pebble Authors. All rights reserved. Use
+// of this source code is governed by a BSD-style license that can be found in
+// the LICENSE file.
+
+package pebble
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"sort"
+	"sync/atomic"
+
+	"github.com/petermattis/pebble/internal/arenaskl"
+	"github.com/petermattis/pebble/internal/record"
+)
+
+// replayedLog is a log file whose contents have been replayed into the
+// memtables of a DB opened read-only.
+type replayedLog struct {
+	fileNum uint64
+	// path is the path of the log file.
+	path string
+	// offset is the offset of the end of the last record replayed.
+	offset int64
+	// mems holds the replayed records. Records are only added to the last
+	// memtable.
+	mems []*memTable
+}
+
+// TryCatchUpWithPrimary makes the writes made by the primary DB since the DB
+// was opened, or since the last call, visible to a secondary DB opened with
+// OpenReadOnly. It reads the versionEdits appended to the MANIFEST by the
+// primary and installs the resulting version, drops the memtables of the
+// log files which the primary has since flushed, and replays the records
+// appended to the live log files. A secondary which should follow the
+// primary closely needs to call TryCatchUpWithPrimary periodically.
+//
+// Records which the primary is in the middle of appending are ignored until
+// the next call. The primary is unaware of the secondary, and may delete the
+// tables and log files it has obsoleted while the secondary is reading them.
+func (d *DB) TryCatchUpWithPrimary() error {
+	if !d.openedReadOnly {
+		return errors.New("pebble: TryCatchUpWithPrimary requires a DB opened with OpenReadOnly")
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.mu.closed {
+		return errors.New("pebble: closed")
+	}
+	if _, err := d.mu.versions.catchUp(); err != nil {
+		return err
+	}
+	return d.catchUpLogsLocked()
+}
+
+// catchUpLogsLocked replays the records appended to the live log files since
+// they were last replayed into the memtables of a DB opened read-only, and
+// drops the memtables of the log files which are no longer live.
+//
+// d.mu must be held when calling this.
+func (d *DB) catchUpLogsLocked() error {
+	logFiles, err := listLogFiles(d.opts.Storage, d.logDirs)
+	if err != nil {
+		return err
+	}
+	vs := &d.mu.versions
+	var liveLogFiles []walFile
+	for _, lf := range logFiles {
+		if lf.num >= vs.logNumber || lf.num == vs.prevLogNumber {
+			liveLogFiles = append(liveLogFiles, lf)
+		}
+	}
+
+	// The contents of the log files which are no longer live have been flushed
+	// to the tables of the current version.
+	replayed := d.mu.replayedLogs[:0:0]
+	for _, rl := range d.mu.replayedLogs {
+		if rl.fileNum >= vs.logNumber || rl.fileNum == vs.prevLogNumber {
+			replayed = append(replayed, rl)
+		}
+	}
+	for _, lf := range liveLogFiles {
+		i := sort.Search(len(replayed), func(i int) bool {
+			return replayed[i].fileNum >= lf.num
+		})
+		if i == len(replayed) || replayed[i].fileNum != lf.num {
+			replayed = append(replayed, nil)
+			copy(replayed[i+1:], replayed[i:])
+			replayed[i] = &replayedLog{fileNum: lf.num, path: lf.path()}
+		}
+		maxSeqNum, err := d.replayLogTail(replayed[i])
+		if err != nil {
+			return err
+		}
+		vs.markFileNumUsed(lf.num)
+		if atomic.LoadUint64(&vs.logSeqNum) < maxSeqNum {
+			atomic.StoreUint64(&vs.logSeqNum, maxSeqNum)
+		}
+	}
+	d.mu.replayedLogs = replayed
+
+	// The mutable memtable of a DB opened read-only is always empty, and
+	// remains at the end of the queue.
+	queue := make([]flushable, 0, len(d.mu.mem.queue))
+	for _, rl := range replayed {
+		for _, mem := range rl.mems {
+			queue = append(queue, mem)
+		}
+	}
+	d.mu.mem.queue = append(queue, d.mu.mem.mutable)
+	atomic.StoreUint64(&vs.visibleSeqNum, atomic.LoadUint64(&vs.logSeqNum))
+	return nil
+}
+
+// replayLogTail replays the records appended to a log file since it was last
+// replayed. A truncated record at the end of the log file, which the primary
+// may still be writing, is ignored and replayed by a later call. It returns
+// the sequence number following the last record replayed.
+//
+// d.mu must be held when calling this.
+func (d *DB) replayLogTail(rl *replayedLog) (maxSeqNum uint64, err error) {
+	file, err := d.opts.Storage.Open(rl.path)
+	if os.IsNotExist(err) {
+		// The primary has deleted the log file since it was listed.
+		return 0, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+	defer file.Close()
+
+	// The reader must be an io.Seeker in order to resume reading at the
+	// offset of the last record read.
+	rr := record.NewLogReader(io.NewSectionReader(file, 0, math.MaxInt64), rl.fileNum)
+	if rl.offset > 0 {
+		if err := rr.SeekRecord(rl.offset); err == io.EOF {
+			return 0, nil
+		} else if err != nil {
+			return 0, err
+		}
+	}
+	var buf bytes.Buffer
+	for {
+		r, err := rr.Next()
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			// The primary may be in the middle of appending a record.
+			break
+		} else if err != nil {
+			return 0, err
+		}
+		buf.Reset()
+		if _, err := io.Copy(&buf, r); err == io.ErrUnexpectedEOF {
+			break
+		} else if err != nil {
+			return 0, err
+		}
+		if buf.Len() < batchHeaderLen {
+			return 0, fmt.Errorf("pebble: corrupt log file %q", rl.path)
+		}
+
+		b := Batch{}
+		b.data = buf.Bytes()
+		b.refreshMemTableSize()
+		seqNum := b.seqNum()
+		maxSeqNum = seqNum + uint64(b.count())
+
+		var mem *memTable
+		if n := len(rl.mems); n > 0 {
+			mem = rl.mems[n-1]
+		} else {
+			mem = newMemTable(d.opts)
+			rl.mems = append(rl.mems, mem)
+		}
+		err = mem.prepare(&b)
+		if err == arenaskl.ErrArenaFull && !mem.empty() {
+			mem = newMemTable(d.opts)
+			rl.mems = append(rl.mems, mem)
+			err = mem.prepare(&b)
+		}
+		if err != nil {
+			return 0, err
+		}
+		if err := mem.apply(&b, seqNum); err != nil {
+			return 0, err
+		}
+		mem.unref()
+		rl.offset = rr.Offset()
+	}
+	return maxSeqNum, nil
+}
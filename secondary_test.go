@@ -0,0 +1,230 @@
+// Copyright 2018 The LevelDB-Go and Pebble Authors. All rights reserved. Use
+// of this source code is governed by a BSD-style license that can be found in
+// the LICENSE file.
+
+package pebble
+
+import (
+	"fmt"
+	"math/rand"
+	"reflect"
+	"testing"
+
+	"github.com/petermattis/pebble/db"
+	"github.com/petermattis/pebble/storage"
+)
+
+// secondaryTestOptions returns options for a primary whose flushes and
+// compactions only occur when requested, so that it does not write to the
+// storage concurrently with the secondary reading it.
+func secondaryTestOptions(fs storage.Storage) *db.Options {
+	return &db.Options{
+		Storage:               fs,
+		L0CompactionThreshold: 1000,
+		L0StopWritesThreshold: 1000,
+	}
+}
+
+func readAll(t *testing.T, d *DB) map[string]string {
+	t.Helper()
+	m := make(map[string]string)
+	iter := d.NewIter(nil)
+	for iter.First(); iter.Valid(); iter.Next() {
+		m[string(iter.Key())] = string(iter.Value())
+	}
+	if err := iter.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return m
+}
+
+func TestTryCatchUpWithPrimary(t *testing.T) {
+	fs := storage.NewMem()
+	primary, err := Open("", secondaryTestOptions(fs))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := primary.TryCatchUpWithPrimary(); err == nil {
+		t.Fatal("expected error catching up a primary")
+	}
+	if err := primary.Set([]byte("a"), []byte("1"), nil); err != nil {
+		t.Fatal(err)
+	}
+
+	secondary, err := OpenReadOnly("", secondaryTestOptions(fs))
+	if err != nil {
+		t.Fatal(err)
+	}
+	get := func(key string) string {
+		t.Helper()
+		v, err := secondary.Get([]byte(key))
+		if err == db.ErrNotFound {
+			return ""
+		} else if err != nil {
+			t.Fatal(err)
+		}
+		return string(v)
+	}
+	catchUp := func() {
+		t.Helper()
+		if err := secondary.TryCatchUpWithPrimary(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if v := get("a"); v != "1" {
+		t.Fatalf("expected 1, but found %q", v)
+	}
+
+	// Writes to the log are not visible until the secondary catches up.
+	if err := primary.Set([]byte("b"), []byte("2"), nil); err != nil {
+		t.Fatal(err)
+	}
+	if v := get("b"); v != "" {
+		t.Fatalf("expected b to be absent, but found %q", v)
+	}
+	catchUp()
+	if v := get("b"); v != "2" {
+		t.Fatalf("expected 2, but found %q", v)
+	}
+
+	// After a flush, the secondary reads the keys from the new table and drops
+	// the memtable of the old log.
+	if err := primary.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	catchUp()
+	secondary.mu.Lock()
+	numTables := len(secondary.mu.versions.currentVersion().files[0])
+	numMems := len(secondary.mu.mem.queue)
+	secondary.mu.Unlock()
+	if numTables != 1 || numMems != 1 {
+		t.Fatalf("expected 1 table and 1 memtable, but found %d and %d", numTables, numMems)
+	}
+	if v := get("a"); v != "1" {
+		t.Fatalf("expected 1, but found %q", v)
+	}
+	if v := get("b"); v != "2" {
+		t.Fatalf("expected 2, but found %q", v)
+	}
+
+	// Deletions and compactions are followed as well.
+	if err := primary.Delete([]byte("a"), nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := primary.Compact([]byte("a"), []byte("c")); err != nil {
+		t.Fatal(err)
+	}
+	catchUp()
+	if v := get("a"); v != "" {
+		t.Fatalf("expected a to be absent, but found %q", v)
+	}
+	if v := get("b"); v != "2" {
+		t.Fatalf("expected 2, but found %q", v)
+	}
+
+	// Catching up without any new writes is a no-op.
+	catchUp()
+	if err := secondary.Set([]byte("c"), []byte("3"), nil); err != ErrReadOnly {
+		t.Fatalf("expected ErrReadOnly, but found %v", err)
+	}
+	if err := secondary.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := primary.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestTryCatchUpWithPrimaryRandom(t *testing.T) {
+	fs := storage.NewMem()
+	primary, err := Open("", secondaryTestOptions(fs))
+	if err != nil {
+		t.Fatal(err)
+	}
+	secondary, err := OpenReadOnly("", secondaryTestOptions(fs))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rng := rand.New(rand.NewSource(1))
+	value := make([]byte, 100)
+	// Flushing an empty memtable fails, so only flush after a write.
+	var dirty bool
+	for i := 0; i < 2000; i++ {
+		key := []byte(fmt.Sprintf("%04d", rng.Intn(500)))
+		switch n := rng.Intn(100); {
+		case n < 60:
+			rng.Read(value)
+			err = primary.Set(key, value, nil)
+			dirty = true
+		case n < 90:
+			err = primary.Delete(key, nil)
+			dirty = true
+		default:
+			if dirty {
+				err = primary.Flush()
+				dirty = false
+			}
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if rng.Intn(20) == 0 {
+			if err := secondary.TryCatchUpWithPrimary(); err != nil {
+				t.Fatal(err)
+			}
+			if expected, actual := readAll(t, primary), readAll(t, secondary); !reflect.DeepEqual(expected, actual) {
+				t.Fatalf("%d: secondary does not match primary", i)
+			}
+		}
+	}
+	if err := secondary.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := primary.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestTryCatchUpWithPrimaryCorruption(t *testing.T) {
+	fs := storage.NewMem()
+	primary, err := Open("", secondaryTestOptions(fs))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := primary.Set([]byte("a"), []byte("1"), nil); err != nil {
+		t.Fatal(err)
+	}
+	secondary, err := OpenReadOnly("", secondaryTestOptions(fs))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// A corrupt record appended to the manifest is an error, rather than being
+	// mistaken for a record which the primary is still writing.
+	if err := primary.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	manifests := listFiles(t, fs, fileTypeManifest)
+	f, err := fs.Open(manifests[len(manifests)-1])
+	if err != nil {
+		t.Fatal(err)
+	}
+	stat, err := f.Stat()
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.Close()
+	corruptFile(t, fs, manifests[len(manifests)-1], int(stat.Size())-1)
+	if err := secondary.TryCatchUpWithPrimary(); err == nil {
+		t.Fatal("expected error catching up with a corrupt manifest")
+	}
+
+	if err := secondary.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := primary.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -6,7 +6,6 @@ package sstable
 
 import (
 	"encoding/binary"
-	"errors"
 	"unsafe"
 
 	"github.com/petermattis/pebble/db"
@@ -29,6 +28,9 @@ type blockWriter struct {
 	curKey          []byte
 	prevKey         []byte
 	tmp             [50]byte
+	// hashIndex is non-nil if a data block hash index should be appended to
+	// the block.
+	hashIndex *dataBlockHashBuilder
 }
 
 func (w *blockWriter) store(keySize int, value []byte) {
@@ -60,6 +62,9 @@ func (w *blockWriter) add(key db.InternalKey, value []byte) {
 	key.Encode(w.curKey)
 
 	w.store(size, value)
+	if w.hashIndex != nil {
+		w.hashIndex.add(key.UserKey, len(w.restarts)-1)
+	}
 }
 
 func (w *blockWriter) finish() []byte {
@@ -78,7 +83,14 @@ func (w *blockWriter) finish() []byte {
 		binary.LittleEndian.PutUint32(tmp4, x)
 		w.buf = append(w.buf, tmp4...)
 	}
-	binary.LittleEndian.PutUint32(tmp4, uint32(len(w.restarts)))
+	numRestarts := uint32(len(w.restarts))
+	if w.hashIndex != nil {
+		var ok bool
+		if w.buf, ok = w.hashIndex.finish(w.buf); ok {
+			numRestarts |= dataBlockHashIndexFlag
+		}
+	}
+	binary.LittleEndian.PutUint32(tmp4, numRestarts)
 	w.buf = append(w.buf, tmp4...)
 	return w.buf
 }
@@ -87,10 +99,17 @@ func (w *blockWriter) reset() {
 	w.nEntries = 0
 	w.buf = w.buf[:0]
 	w.restarts = w.restarts[:0]
+	if w.hashIndex != nil {
+		w.hashIndex.reset()
+	}
 }
 
 func (w *blockWriter) estimatedSize() int {
-	return len(w.buf) + 4*(len(w.restarts)+1)
+	n := len(w.buf) + 4*(len(w.restarts)+1)
+	if w.hashIndex != nil {
+		n += w.hashIndex.estimatedSize()
+	}
+	return n
 }
 
 type blockEntry struct {
@@ -109,11 +128,14 @@ type blockIter struct {
 	globalSeqNum uint64
 	ptr          unsafe.Pointer
 	data         []byte
-	key, val     []byte
-	ikey         db.InternalKey
-	cached       []blockEntry
-	cachedBuf    []byte
-	err          error
+	// hashBuckets holds the buckets of the data block hash index, or nil if
+	// the block does not have a hash index.
+	hashBuckets []byte
+	key, val    []byte
+	ikey        db.InternalKey
+	cached      []blockEntry
+	cachedBuf   []byte
+	err         error
 }
 
 func newBlockIter(cmp db.Compare, block block) (*blockIter, error) {
@@ -122,12 +144,27 @@ func newBlockIter(cmp db.Compare, block block) (*blockIter, error) {
 }
 
 func (i *blockIter) init(cmp db.Compare, block block, globalSeqNum uint64) error {
-	numRestarts := int(binary.LittleEndian.Uint32(block[len(block)-4:]))
+	packed := binary.LittleEndian.Uint32(block[len(block)-4:])
+	numRestarts := int(packed &^ dataBlockHashIndexFlag)
 	if numRestarts == 0 {
-		return errors.New("pebble/table: invalid table (block has no restart points)")
+		return CorruptionError("pebble/table: invalid table (block has no restart points)")
+	}
+	end := len(block) - 4
+	i.hashBuckets = nil
+	if packed&dataBlockHashIndexFlag != 0 {
+		if end < 2 {
+			return CorruptionError("pebble/table: invalid table (bad data block hash index)")
+		}
+		numBuckets := int(binary.LittleEndian.Uint16(block[end-2:]))
+		end -= 2
+		if numBuckets == 0 || numBuckets+4*numRestarts > end {
+			return CorruptionError("pebble/table: invalid table (bad data block hash index)")
+		}
+		i.hashBuckets = block[end-numBuckets : end]
+		end -= numBuckets
 	}
 	i.cmp = cmp
-	i.restarts = len(block) - 4*(1+numRestarts)
+	i.restarts = end - 4*numRestarts
 	i.numRestarts = numRestarts
 	i.globalSeqNum = globalSeqNum
 	i.ptr = unsafe.Pointer(&block[0])
@@ -234,6 +271,38 @@ func (i *blockIter) SeekGE(key []byte) {
 	}
 }
 
+// seekGEForGet is like SeekGE, but uses the data block hash index, if
+// present, to locate the restart interval containing key. It is only suitable
+// for point lookups: if the block does not contain key the iterator may be
+// left invalid rather than positioned at the next larger key.
+func (i *blockIter) seekGEForGet(key []byte) {
+	if i.hashBuckets == nil {
+		i.SeekGE(key)
+		return
+	}
+	bucket := i.hashBuckets[dataBlockHash(key)%uint32(len(i.hashBuckets))]
+	switch {
+	case bucket == dataBlockHashNoEntry:
+		// The key is not present in the block.
+		i.offset = i.restarts
+		i.nextOffset = i.restarts
+		return
+	case bucket == dataBlockHashCollision || int(bucket) >= i.numRestarts:
+		i.SeekGE(key)
+		return
+	}
+
+	// Iterate from the restart point to somewhere >= the key sought.
+	ikey := db.MakeSearchKey(key)
+	i.offset = int(binary.LittleEndian.Uint32(i.data[i.restarts+4*int(bucket):]))
+	i.loadEntry()
+	for ; i.Valid(); i.Next() {
+		if db.InternalCompare(i.cmp, i.ikey, ikey) >= 0 {
+			break
+		}
+	}
+}
+
 // SeekLT implements InternalIterator.SeekLT, as documented in the pebble/db
 // package.
 func (i *blockIter) SeekLT(key []byte) {
@@ -0,0 +1,133 @@
+// Copyright 2018 The LevelDB-Go and Pebble Authors. All rights reserved. Use
+// of this source code is governed by a BSD-style license that can be found in
+// the LICENSE file.
+
+package sstable
+
+import "encoding/binary"
+
+// A data block may optionally be followed by a hash index which maps the hash
+// of a user key to the index of the restart interval containing the key. A
+// point lookup can then jump directly to the restart interval rather than
+// binary searching the restart points. The format matches RocksDB's
+// kDataBlockBinaryAndHash data block index type:
+//
+//	[entries][restart points][buckets][num buckets][num restarts]
+//
+// Each bucket is a single byte containing the index of a restart point, or
+// one of the special values dataBlockHashNoEntry or dataBlockHashCollision.
+// The number of buckets is a little-endian uint16. The presence of the hash
+// index is indicated by setting the high bit of the num restarts field. Older
+// readers would misinterpret the field, so tables containing data blocks with
+// a hash index are written with formatVersionDataBlockHashIndex in the
+// footer, which older readers reject.
+const (
+	dataBlockHashNoEntry     = 255
+	dataBlockHashCollision   = 254
+	dataBlockHashMaxRestarts = 253
+	dataBlockHashIndexFlag   = 1 << 31
+
+	// dataBlockHashUtilRatio is the target ratio of keys to buckets.
+	dataBlockHashUtilRatio = 0.75
+)
+
+// dataBlockHash is the hash function used by the data block hash index. It is
+// the LevelDB hash function with the seed used by RocksDB for this purpose.
+func dataBlockHash(b []byte) uint32 {
+	const (
+		seed = 397
+		m    = 0xc6a4a793
+	)
+	h := uint32(seed) ^ uint32(len(b)*m)
+	for ; len(b) >= 4; b = b[4:] {
+		h += uint32(b[0]) | uint32(b[1])<<8 | uint32(b[2])<<16 | uint32(b[3])<<24
+		h *= m
+		h ^= h >> 16
+	}
+	switch len(b) {
+	case 3:
+		h += uint32(b[2]) << 16
+		fallthrough
+	case 2:
+		h += uint32(b[1]) << 8
+		fallthrough
+	case 1:
+		h += uint32(b[0])
+		h *= m
+		h ^= h >> 24
+	}
+	return h
+}
+
+type dataBlockHashEntry struct {
+	hash         uint32
+	restartIndex uint8
+}
+
+// dataBlockHashBuilder accumulates the hashes of the user keys added to a data
+// block and builds the block's hash index.
+type dataBlockHashBuilder struct {
+	entries []dataBlockHashEntry
+	// valid is false if the block has too many restart points to be indexed.
+	valid bool
+}
+
+func (b *dataBlockHashBuilder) add(userKey []byte, restartIndex int) {
+	if restartIndex > dataBlockHashMaxRestarts {
+		b.valid = false
+		return
+	}
+	b.entries = append(b.entries, dataBlockHashEntry{
+		hash:         dataBlockHash(userKey),
+		restartIndex: uint8(restartIndex),
+	})
+}
+
+func (b *dataBlockHashBuilder) numBuckets() int {
+	n := int(float64(len(b.entries))/dataBlockHashUtilRatio) | 1
+	if n > 1<<16-1 {
+		n = 1<<16 - 1
+	}
+	return n
+}
+
+// estimatedSize returns the size of the hash index that would be appended to
+// the block by finish.
+func (b *dataBlockHashBuilder) estimatedSize() int {
+	if !b.valid || len(b.entries) == 0 {
+		return 0
+	}
+	return b.numBuckets() + 2
+}
+
+// finish appends the buckets and the number of buckets to buf. It returns false
+// if the block cannot be indexed, in which case buf is unchanged.
+func (b *dataBlockHashBuilder) finish(buf []byte) ([]byte, bool) {
+	if !b.valid || len(b.entries) == 0 {
+		return buf, false
+	}
+	n := b.numBuckets()
+	start := len(buf)
+	for i := 0; i < n; i++ {
+		buf = append(buf, dataBlockHashNoEntry)
+	}
+	buckets := buf[start:]
+	for _, e := range b.entries {
+		bucket := &buckets[e.hash%uint32(n)]
+		switch *bucket {
+		case dataBlockHashNoEntry:
+			*bucket = e.restartIndex
+		case dataBlockHashCollision, e.restartIndex:
+		default:
+			*bucket = dataBlockHashCollision
+		}
+	}
+	var tmp [2]byte
+	binary.LittleEndian.PutUint16(tmp[:], uint16(n))
+	return append(buf, tmp[:]...), true
+}
+
+func (b *dataBlockHashBuilder) reset() {
+	b.entries = b.entries[:0]
+	b.valid = true
+}
@@ -204,6 +204,58 @@ func TestBlockIter2(t *testing.T) {
 	}
 }
 
+func TestBlockHashIndex(t *testing.T) {
+	for _, n := range []int{1, 10, 500, 2000} {
+		t.Run(fmt.Sprint(n), func(t *testing.T) {
+			w := &blockWriter{
+				restartInterval: 4,
+				hashIndex:       &dataBlockHashBuilder{valid: true},
+			}
+			var keys []string
+			for i := 0; i < n; i++ {
+				key := fmt.Sprintf("%05d", 2*i)
+				keys = append(keys, key)
+				w.add(db.MakeInternalKey([]byte(key), 0, db.InternalKeyKindSet), []byte(key))
+			}
+			data := w.finish()
+
+			it, err := newBlockIter(bytes.Compare, data)
+			if err != nil {
+				t.Fatal(err)
+			}
+			// Blocks with more restart points than can be stored in a bucket are
+			// written without a hash index.
+			hasIndex := (n+3)/4 <= dataBlockHashMaxRestarts
+			if hasIndex != (it.hashBuckets != nil) {
+				t.Fatalf("expected hash index %t, but found %t", hasIndex, it.hashBuckets != nil)
+			}
+
+			var count int
+			for it.First(); it.Valid(); it.Next() {
+				if string(it.Key().UserKey) != keys[count] {
+					t.Fatalf("expected %s, but found %s", keys[count], it.Key().UserKey)
+				}
+				count++
+			}
+			if count != n {
+				t.Fatalf("expected %d keys, but found %d", n, count)
+			}
+
+			for i := 0; i < n; i++ {
+				it.seekGEForGet([]byte(keys[i]))
+				if !it.Valid() || string(it.Key().UserKey) != keys[i] {
+					t.Fatalf("expected to find %s", keys[i])
+				}
+				absent := fmt.Sprintf("%05d", 2*i+1)
+				it.seekGEForGet([]byte(absent))
+				if it.Valid() && string(it.Key().UserKey) == absent {
+					t.Fatalf("unexpectedly found %s", absent)
+				}
+			}
+		})
+	}
+}
+
 func BenchmarkBlockIterSeekGE(b *testing.B) {
 	const blockSize = 32 << 10
 
@@ -0,0 +1,52 @@
+// Copyright 2018 The LevelDB-Go and Pebble Authors. All rights reserved. Use
+// of this source code is governed by a BSD-style license that can be found in
+// the LICENSE file.
+
+package sstable
+
+import (
+	"fmt"
+
+	"github.com/cespare/xxhash/v2"
+	"github.com/petermattis/pebble/db"
+	"github.com/petermattis/pebble/internal/crc"
+)
+
+// checksumTypeFor returns the footer checksum type for the specified
+// db.ChecksumType.
+func checksumTypeFor(c db.ChecksumType) byte {
+	switch c {
+	case db.ChecksumCRC32c:
+		return checksumCRC32c
+	case db.ChecksumXXHash64:
+		return checksumXXHash64
+	default:
+		panic(fmt.Sprintf("pebble/table: unknown checksum type: %d", c))
+	}
+}
+
+// validChecksumType returns true if the reader supports the footer checksum
+// type.
+func validChecksumType(checksumType byte) bool {
+	switch checksumType {
+	case checksumCRC32c, checksumXXHash64:
+		return true
+	}
+	return false
+}
+
+// blockChecksum computes the checksum of a block's data followed by its
+// 1-byte block type, using the specified footer checksum type.
+func blockChecksum(checksumType byte, data, blockType []byte) uint32 {
+	switch checksumType {
+	case checksumCRC32c:
+		return crc.New(data).Update(blockType).Value()
+	case checksumXXHash64:
+		d := xxhash.New()
+		d.Write(data)
+		d.Write(blockType)
+		return uint32(d.Sum64())
+	default:
+		panic(fmt.Sprintf("pebble/table: unknown checksum type: %d", checksumType))
+	}
+}
@@ -0,0 +1,111 @@
+// Copyright 2018 The LevelDB-Go and Pebble Authors. All rights reserved. Use
+// of this source code is governed by a BSD-style license that can be found in
+// the LICENSE file.
+
+package sstable
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/petermattis/pebble/db"
+	"github.com/petermattis/pebble/storage"
+)
+
+func TestChecksum(t *testing.T) {
+	testCases := []struct {
+		checksum     db.ChecksumType
+		checksumType byte
+	}{
+		{db.DefaultChecksum, checksumCRC32c},
+		{db.ChecksumCRC32c, checksumCRC32c},
+		{db.ChecksumXXHash64, checksumXXHash64},
+	}
+	for _, c := range testCases {
+		t.Run(c.checksum.String(), func(t *testing.T) {
+			fs := storage.NewMem()
+			f, err := fs.Create("sstable")
+			if err != nil {
+				t.Fatal(err)
+			}
+			w := NewWriter(f, &db.Options{Checksum: c.checksum}, db.LevelOptions{
+				BlockSize:   256,
+				Compression: db.NoCompression,
+			})
+			for i := 0; i < 100; i++ {
+				key := db.MakeInternalKey([]byte(fmt.Sprintf("%04d", i)), 0, db.InternalKeyKindSet)
+				if err := w.Add(key, []byte(fmt.Sprint(i))); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if err := w.Close(); err != nil {
+				t.Fatal(err)
+			}
+
+			// The checksum type is recorded in the footer and the table can be
+			// read regardless of the options used to open it.
+			f, err = fs.Open("sstable")
+			if err != nil {
+				t.Fatal(err)
+			}
+			r := NewReader(f, 0, nil)
+			if r.err != nil {
+				t.Fatal(r.err)
+			}
+			if r.checksumType != c.checksumType {
+				t.Fatalf("expected checksum type %d, but found %d", c.checksumType, r.checksumType)
+			}
+			var count int
+			i := r.NewIter(nil)
+			for i.First(); i.Valid(); i.Next() {
+				count++
+			}
+			if err := i.Close(); err != nil {
+				t.Fatal(err)
+			}
+			if count != 100 {
+				t.Fatalf("expected 100 keys, but found %d", count)
+			}
+			if err := r.Close(); err != nil {
+				t.Fatal(err)
+			}
+
+			// Corrupt the first data block and verify the checksum mismatch is
+			// detected.
+			f, err = fs.Open("sstable")
+			if err != nil {
+				t.Fatal(err)
+			}
+			stat, err := f.Stat()
+			if err != nil {
+				t.Fatal(err)
+			}
+			data := make([]byte, stat.Size())
+			if _, err := f.ReadAt(data, 0); err != nil {
+				t.Fatal(err)
+			}
+			f.Close()
+			data[0] ^= 0xff
+			f, err = fs.Create("corrupt")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if _, err := f.Write(data); err != nil {
+				t.Fatal(err)
+			}
+			f.Close()
+
+			f, err = fs.Open("corrupt")
+			if err != nil {
+				t.Fatal(err)
+			}
+			r = NewReader(f, 0, nil)
+			defer r.Close()
+			i = r.NewIter(nil)
+			i.First()
+			if err := i.Close(); err == nil {
+				t.Fatalf("expected checksum mismatch, but found no error")
+			}
+		})
+	}
+}
@@ -0,0 +1,219 @@
+// Copyright 2018 The LevelDB-Go and Pebble Authors. All rights reserved. Use
+// of this source code is governed by a BSD-style license that can be found in
+// the LICENSE file.
+
+package sstable
+
+import (
+	"encoding/binary"
+	"fmt"
+	"sync"
+
+	lz4 "github.com/bkaradzic/go-lz4"
+	"github.com/golang/snappy"
+	"github.com/klauspost/compress/zstd"
+	"github.com/petermattis/pebble/db"
+)
+
+// compressor compresses and decompresses the contents of blocks stored with a
+// particular block type. Compressors are registered in a table keyed by the
+// block type byte stored in the block trailer, which allows a Reader to
+// decode any block regardless of the compression the table was written with.
+type compressor struct {
+	// blockType is the block trailer type byte identifying blocks compressed
+	// by this compressor.
+	blockType byte
+	// compression is the db.Compression value that selects this compressor
+	// when writing.
+	compression db.Compression
+	// compress appends the compressed form of src to dst[:0], returning the
+	// result. The returned slice may alias dst if dst has enough capacity.
+	compress func(dst, src []byte) []byte
+	// decompress returns the decompressed form of src.
+	decompress func(src []byte) ([]byte, error)
+}
+
+var (
+	compressorsByType        [256]*compressor
+	compressorsByCompression = make(map[db.Compression]*compressor)
+)
+
+// registerCompressor adds c to the compressor registry. It panics if another
+// compressor has already been registered for the same block type or
+// compression.
+func registerCompressor(c *compressor) {
+	if c.blockType == noCompressionBlockType {
+		panic("pebble/table: cannot register a compressor for the uncompressed block type")
+	}
+	if compressorsByType[c.blockType] != nil {
+		panic(fmt.Sprintf("pebble/table: duplicate compressor for block type %d", c.blockType))
+	}
+	if _, ok := compressorsByCompression[c.compression]; ok {
+		panic(fmt.Sprintf("pebble/table: duplicate compressor for %s", c.compression))
+	}
+	compressorsByType[c.blockType] = c
+	compressorsByCompression[c.compression] = c
+}
+
+// compressorForCompression returns the compressor to use when writing blocks
+// with the specified compression, or nil if blocks should be left
+// uncompressed.
+func compressorForCompression(c db.Compression) *compressor {
+	return compressorsByCompression[c]
+}
+
+// decompressBlock decompresses the contents of a block with the specified
+// block type.
+func decompressBlock(blockType byte, b []byte) ([]byte, error) {
+	if blockType == noCompressionBlockType {
+		return b, nil
+	}
+	c := compressorsByType[blockType]
+	if c == nil {
+		return nil, CorruptionError(fmt.Sprintf("pebble/table: unknown block compression: %d", blockType))
+	}
+	return c.decompress(b)
+}
+
+func init() {
+	registerCompressor(&compressor{
+		blockType:   snappyCompressionBlockType,
+		compression: db.SnappyCompression,
+		compress: func(dst, src []byte) []byte {
+			return snappy.Encode(dst[:cap(dst)], src)
+		},
+		decompress: func(src []byte) ([]byte, error) {
+			return snappy.Decode(nil, src)
+		},
+	})
+	registerCompressor(&compressor{
+		blockType:   lz4CompressionBlockType,
+		compression: db.LZ4Compression,
+		compress:    lz4Compress,
+		decompress:  lz4Decompress,
+	})
+	registerCompressor(&compressor{
+		blockType:   zstdCompressionBlockType,
+		compression: db.ZstdCompression,
+		compress:    zstdCompress,
+		decompress:  zstdDecompress,
+	})
+}
+
+// The lz4 and zstd compressed block formats match those used by RocksDB
+// (format_version >= 2): the compressed data is preceded by the varint32
+// encoded length of the decompressed data.
+
+var errCorruptCompressedBlock = CorruptionError("pebble/table: corrupt compressed block")
+
+// decodeDecompressedLen decodes the decompressed length prefix of a lz4 or
+// zstd compressed block, returning the length and the remaining compressed
+// data.
+func decodeDecompressedLen(src []byte) (int, []byte, error) {
+	v, n := binary.Uvarint(src)
+	if n <= 0 || v > 1<<32-1 {
+		return 0, nil, errCorruptCompressedBlock
+	}
+	return int(v), src[n:], nil
+}
+
+// lz4HeaderLen is the length of the little-endian decompressed length header
+// used by the go-lz4 package. It is replaced with a varint32 prefix on disk.
+const lz4HeaderLen = 4
+
+func lz4Compress(dst, src []byte) []byte {
+	if n := binary.MaxVarintLen32 + lz4.CompressBound(len(src)); cap(dst) < n {
+		dst = make([]byte, n)
+	}
+	dst = dst[:cap(dst)]
+	// Encode at an offset which leaves room for the largest possible varint
+	// prefix, then slide the prefix up against the compressed data.
+	const offset = binary.MaxVarintLen32 - lz4HeaderLen
+	enc, err := lz4.Encode(dst[offset:], src)
+	if err != nil {
+		// The only error returned by lz4.Encode is for inputs larger than the
+		// maximum block size, which is far larger than any sstable block.
+		panic(err)
+	}
+	var buf [binary.MaxVarintLen32]byte
+	n := binary.PutUvarint(buf[:], uint64(len(src)))
+	start := binary.MaxVarintLen32 - n
+	copy(dst[start:], buf[:n])
+	return dst[start : offset+len(enc)]
+}
+
+func lz4Decompress(src []byte) ([]byte, error) {
+	n, src, err := decodeDecompressedLen(src)
+	if err != nil {
+		return nil, err
+	}
+	if n == 0 {
+		return []byte{}, nil
+	}
+	tmp := make([]byte, lz4HeaderLen+len(src))
+	binary.LittleEndian.PutUint32(tmp, uint32(n))
+	copy(tmp[lz4HeaderLen:], src)
+	b, err := lz4.Decode(make([]byte, n), tmp)
+	if err != nil {
+		return nil, err
+	}
+	if len(b) != n {
+		return nil, errCorruptCompressedBlock
+	}
+	return b, nil
+}
+
+var zstdState struct {
+	once    sync.Once
+	encoder *zstd.Encoder
+	decoder *zstd.Decoder
+}
+
+// zstdInit lazily creates the shared zstd encoder and decoder. Both are safe
+// for concurrent use via EncodeAll and DecodeAll.
+func zstdInit() {
+	zstdState.once.Do(func() {
+		var err error
+		zstdState.encoder, err = zstd.NewWriter(nil, zstd.WithEncoderConcurrency(1))
+		if err != nil {
+			panic(err)
+		}
+		zstdState.decoder, err = zstd.NewReader(nil, zstd.WithDecoderConcurrency(0))
+		if err != nil {
+			panic(err)
+		}
+	})
+}
+
+func zstdCompress(dst, src []byte) []byte {
+	zstdInit()
+	return zstdCompressWith(zstdState.encoder, dst, src)
+}
+
+func zstdCompressWith(encoder *zstd.Encoder, dst, src []byte) []byte {
+	if cap(dst) < binary.MaxVarintLen32 {
+		dst = make([]byte, binary.MaxVarintLen32)
+	}
+	n := binary.PutUvarint(dst[:binary.MaxVarintLen32], uint64(len(src)))
+	return encoder.EncodeAll(src, dst[:n])
+}
+
+func zstdDecompress(src []byte) ([]byte, error) {
+	zstdInit()
+	return zstdDecompressWith(zstdState.decoder, src)
+}
+
+func zstdDecompressWith(decoder *zstd.Decoder, src []byte) ([]byte, error) {
+	n, src, err := decodeDecompressedLen(src)
+	if err != nil {
+		return nil, err
+	}
+	b, err := decoder.DecodeAll(src, make([]byte, 0, n))
+	if err != nil {
+		return nil, err
+	}
+	if len(b) != n {
+		return nil, errCorruptCompressedBlock
+	}
+	return b, nil
+}
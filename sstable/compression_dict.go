@@ -0,0 +1,137 @@
+// Copyright 2018 The LevelDB-Go and Pebble Authors. All rights reserved. Use
+// of this source code is governed by a BSD-style license that can be found in
+// the LICENSE file.
+
+package sstable
+
+import (
+	"github.com/klauspost/compress/zstd"
+)
+
+const (
+	// compressionDictMetaName is the metaindex key of the meta block holding
+	// the zstd compression dictionary.
+	compressionDictMetaName = "rocksdb.compression_dict"
+
+	// compressionDictID is the dictionary ID recorded in zstd frames compressed
+	// with a table's dictionary. Every table has its own dictionary, so the ID
+	// only needs to distinguish dictionary frames from plain frames. The value
+	// is in the range zstd recommends for private use.
+	compressionDictID = 0x70656262
+
+	// compressionDictSampleRatio is the ratio between the number of bytes of
+	// data blocks sampled for training and the dictionary size.
+	compressionDictSampleRatio = 8
+)
+
+// compressionDictWriter trains a zstd compression dictionary from the first
+// data blocks written to a table. Data blocks written before the dictionary
+// has been trained are compressed without the dictionary. Once trained, the
+// dictionary is used to compress all subsequent data blocks and is stored in
+// a meta block so that the reader can decompress them.
+type compressionDictWriter struct {
+	maxSize    int
+	sampleSize int
+	samples    [][]byte
+	// dict is the trained dictionary. It is nil until training has completed.
+	dict    []byte
+	encoder *zstd.Encoder
+	// done is set once training has been attempted, whether or not it
+	// succeeded.
+	done bool
+}
+
+func newCompressionDictWriter(maxSize int) *compressionDictWriter {
+	return &compressionDictWriter{maxSize: maxSize}
+}
+
+// addSample adds an uncompressed data block to the training samples, training
+// the dictionary once enough data has been sampled.
+func (d *compressionDictWriter) addSample(b []byte) {
+	if d.done {
+		return
+	}
+	d.samples = append(d.samples, append([]byte(nil), b...))
+	d.sampleSize += len(b)
+	if d.sampleSize >= compressionDictSampleRatio*d.maxSize {
+		d.train()
+	}
+}
+
+// train builds the dictionary from the samples collected so far. The raw
+// content of the dictionary is taken from the most recent samples, and the
+// entropy tables are built from all of them. Failure to build a dictionary
+// is not an error: the remaining blocks are compressed without one.
+func (d *compressionDictWriter) train() {
+	d.done = true
+	samples := d.samples
+	d.samples = nil
+
+	var history []byte
+	for _, s := range samples {
+		history = append(history, s...)
+	}
+	if len(history) > d.maxSize {
+		history = history[len(history)-d.maxSize:]
+	}
+
+	dict, err := zstd.BuildDict(zstd.BuildDictOptions{
+		ID:       compressionDictID,
+		Contents: samples,
+		History:  history,
+		Offsets:  [3]int{1, 4, 8},
+		Level:    zstd.SpeedDefault,
+	})
+	if err != nil {
+		return
+	}
+	encoder, err := zstd.NewWriter(nil,
+		zstd.WithEncoderConcurrency(1), zstd.WithEncoderDict(dict))
+	if err != nil {
+		return
+	}
+	d.dict = dict
+	d.encoder = encoder
+}
+
+// compress compresses a data block, returning false if the dictionary has not
+// been trained.
+func (d *compressionDictWriter) compress(dst, src []byte) ([]byte, bool) {
+	if d.encoder == nil {
+		return nil, false
+	}
+	return zstdCompressWith(d.encoder, dst, src), true
+}
+
+func (d *compressionDictWriter) close() {
+	if d.encoder != nil {
+		d.encoder.Close()
+		d.encoder = nil
+	}
+	d.samples = nil
+}
+
+// compressionDictReader decompresses zstd blocks using a table's compression
+// dictionary. The dictionary is loaded once when the table is opened. Each
+// open table with a dictionary has its own decoder, so the decoder is limited
+// to a single goroutine and its buffers rather than one per CPU.
+type compressionDictReader struct {
+	decoder *zstd.Decoder
+}
+
+func newCompressionDictReader(dict []byte) (*compressionDictReader, error) {
+	decoder, err := zstd.NewReader(nil,
+		zstd.WithDecoderConcurrency(1), zstd.WithDecoderDicts(dict))
+	if err != nil {
+		return nil, err
+	}
+	return &compressionDictReader{decoder: decoder}, nil
+}
+
+func (d *compressionDictReader) decompress(src []byte) ([]byte, error) {
+	return zstdDecompressWith(d.decoder, src)
+}
+
+func (d *compressionDictReader) close() {
+	d.decoder.Close()
+}
@@ -0,0 +1,99 @@
+// Copyright 2018 The LevelDB-Go and Pebble Authors. All rights reserved. Use
+// of this source code is governed by a BSD-style license that can be found in
+// the LICENSE file.
+
+package sstable
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/petermattis/pebble/db"
+	"github.com/petermattis/pebble/storage"
+)
+
+func TestCompressionDict(t *testing.T) {
+	const n = 5000
+	key := func(i int) []byte {
+		return []byte(fmt.Sprintf("key%06d", i))
+	}
+	value := func(i int) []byte {
+		return []byte(fmt.Sprintf(
+			`{"id":%d,"name":"user-%d","email":"user-%d@example.com","active":%t,"score":%d}`,
+			i, i, i, i%3 == 0, i*7%101))
+	}
+
+	fs := storage.NewMem()
+	build := func(name string, dictSize int) *Reader {
+		f, err := fs.Create(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		w := NewWriter(f, nil, db.LevelOptions{
+			BlockSize:           512,
+			Compression:         db.ZstdCompression,
+			CompressionDictSize: dictSize,
+		})
+		for i := 0; i < n; i++ {
+			if err := w.Add(db.MakeInternalKey(key(i), 0, db.InternalKeyKindSet), value(i)); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if err := w.Close(); err != nil {
+			t.Fatal(err)
+		}
+		f, err = fs.Open(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		r := NewReader(f, 0, nil)
+		if r.err != nil {
+			t.Fatal(r.err)
+		}
+		return r
+	}
+
+	plain := build("plain", 0)
+	defer plain.Close()
+	if plain.compressionDict != nil {
+		t.Fatalf("expected no compression dictionary")
+	}
+
+	dict := build("dict", 4096)
+	defer dict.Close()
+	if dict.compressionDict == nil {
+		t.Fatalf("expected a compression dictionary")
+	}
+	if dict.Properties.DataSize >= plain.Properties.DataSize {
+		t.Fatalf("expected dictionary compression to reduce the data size: %d >= %d",
+			dict.Properties.DataSize, plain.Properties.DataSize)
+	}
+
+	i := dict.NewIter(nil)
+	var count int
+	for i.First(); i.Valid(); i.Next() {
+		if string(i.Key().UserKey) != string(key(count)) {
+			t.Fatalf("expected %s, but found %s", key(count), i.Key().UserKey)
+		}
+		if string(i.Value()) != string(value(count)) {
+			t.Fatalf("expected %s, but found %s", value(count), i.Value())
+		}
+		count++
+	}
+	if err := i.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if count != n {
+		t.Fatalf("expected %d keys, but found %d", n, count)
+	}
+
+	for _, j := range []int{0, 1, n / 2, n - 1} {
+		v, err := dict.get(key(j), nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(v) != string(value(j)) {
+			t.Fatalf("expected %s, but found %s", value(j), v)
+		}
+	}
+}
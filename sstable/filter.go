@@ -8,6 +8,7 @@ import (
 	"encoding/binary"
 	"errors"
 
+	"github.com/petermattis/pebble/cache"
 	"github.com/petermattis/pebble/db"
 )
 
@@ -204,3 +205,128 @@ func (f *tableFilterWriter) metaName() string {
 func (f *tableFilterWriter) policyName() string {
 	return f.policy.Name()
 }
+
+// partitionedFilterReader reads a table-level filter which has been split
+// into partitions aligned with the index partitions. The top-level filter
+// index is held in memory, while the filter partitions are read on demand
+// through the block cache.
+type partitionedFilterReader struct {
+	policy db.FilterPolicy
+	reader *Reader
+	// index is the top-level filter index. The i'th key is the last key of the
+	// i'th filter partition and the i'th value is the encoded block handle of
+	// that partition.
+	index block
+}
+
+func newPartitionedFilterReader(
+	index []byte, policy db.FilterPolicy, r *Reader,
+) *partitionedFilterReader {
+	if len(index) < 4 {
+		return nil
+	}
+	return &partitionedFilterReader{
+		policy: policy,
+		reader: r,
+		index:  index,
+	}
+}
+
+func (f *partitionedFilterReader) mayContain(key []byte) (bool, error) {
+	var i blockIter
+	if err := i.init(f.reader.compare, f.index, 0); err != nil {
+		return false, err
+	}
+	i.SeekGE(key)
+	if !i.Valid() {
+		// The key is larger than the last key in the table.
+		return false, nil
+	}
+	v := i.Value()
+	bh, n := decodeBlockHandle(v)
+	if n == 0 || n != len(v) {
+		return false, CorruptionError("pebble/table: corrupt filter index entry")
+	}
+	data, _, err := f.reader.readBlock(bh, cache.HighPriority, nil)
+	if err != nil {
+		return false, err
+	}
+	return f.policy.MayContain(db.TableFilter, data, key), nil
+}
+
+type filterPartition struct {
+	// sep is the last key of the index partition the filter partition is
+	// aligned with.
+	sep    db.InternalKey
+	filter []byte
+	bh     blockHandle
+}
+
+// partitionedFilterWriter writes a table-level filter which is split into
+// partitions aligned with the index partitions. Each partition is a
+// table-level filter over the keys in the data blocks covered by the
+// corresponding index partition. The partitions are written by the Writer,
+// after which finish returns the top-level filter index.
+type partitionedFilterWriter struct {
+	policy db.FilterPolicy
+	writer db.FilterWriter
+	// count is the count of the number of keys added to the current partition.
+	count      int
+	partitions []filterPartition
+}
+
+func newPartitionedFilterWriter(policy db.FilterPolicy) *partitionedFilterWriter {
+	return &partitionedFilterWriter{
+		policy: policy,
+		writer: policy.NewWriter(db.TableFilter),
+	}
+}
+
+func (f *partitionedFilterWriter) addKey(key []byte) {
+	f.count++
+	f.writer.AddKey(key)
+}
+
+func (f *partitionedFilterWriter) finishBlock(blockOffset uint64) error {
+	// NB: partitioned filters are finished along with the index partitions.
+	return nil
+}
+
+// finishPartition finishes the filter for the keys added since the previous
+// partition. The filter partition is keyed by sep, the last key of the
+// corresponding index partition.
+func (f *partitionedFilterWriter) finishPartition(sep db.InternalKey) {
+	if f.count == 0 {
+		// Lookups for keys within an empty partition fall through to the next
+		// partition, which cannot contain them.
+		return
+	}
+	f.partitions = append(f.partitions, filterPartition{
+		sep:    sep.Clone(),
+		filter: f.writer.Finish(nil),
+	})
+	f.count = 0
+}
+
+func (f *partitionedFilterWriter) finish() ([]byte, error) {
+	index := blockWriter{restartInterval: 1}
+	var tmp [blockHandleMaxLen]byte
+	for i := range f.partitions {
+		p := &f.partitions[i]
+		if p.bh.length == 0 {
+			return nil, errors.New("pebble/table: filter partition has not been written")
+		}
+		n := encodeBlockHandle(tmp[:], p.bh)
+		index.add(p.sep, tmp[:n])
+	}
+	f.partitions = nil
+	return index.finish(), nil
+}
+
+func (f *partitionedFilterWriter) metaName() string {
+	return "partitionedfilter." + f.policy.Name()
+}
+
+func (f *partitionedFilterWriter) policyName() string {
+	return f.policy.Name()
+}
@@ -6,7 +6,6 @@ package sstable
 
 import (
 	"encoding/binary"
-	"errors"
 	"sort"
 	"unsafe"
 
@@ -58,7 +57,7 @@ func newRawBlockIter(cmp db.Compare, block block) (*rawBlockIter, error) {
 func (i *rawBlockIter) init(cmp db.Compare, block block) error {
 	numRestarts := int(binary.LittleEndian.Uint32(block[len(block)-4:]))
 	if numRestarts == 0 {
-		return errors.New("pebble/table: invalid table (block has no restart points)")
+		return CorruptionError("pebble/table: invalid table (block has no restart points)")
 	}
 	i.cmp = cmp
 	i.restarts = len(block) - 4*(1+numRestarts)
@@ -0,0 +1,89 @@
+// Copyright 2018 The LevelDB-Go and Pebble Authors. All rights reserved. Use
+// of this source code is governed by a BSD-style license that can be found in
+// the LICENSE file.
+
+package sstable
+
+import (
+	"io"
+
+	"github.com/petermattis/pebble/storage"
+)
+
+const (
+	// readaheadThreshold is the number of consecutive sequential block reads
+	// after which readahead is enabled.
+	readaheadThreshold = 3
+	// initialReadaheadSize is the size of the first readahead read.
+	initialReadaheadSize = 64 << 10
+	// maxReadaheadSize is the size at which the readahead size stops growing.
+	maxReadaheadSize = 256 << 10
+)
+
+// readahead detects sequential access to the data blocks of a table by an
+// iterator and, once detected, reads ahead of the iterator into a buffer so
+// that subsequent blocks can be loaded without issuing a read per block. The
+// readahead size starts at initialReadaheadSize and doubles each time the
+// buffer is refilled, up to maxReadaheadSize. A non-sequential access resets
+// the readahead state.
+type readahead struct {
+	// numReads is the number of consecutive sequential block accesses.
+	numReads int
+	// nextOffset is the offset following the last block accessed.
+	nextOffset uint64
+	// size is the size of the next readahead read, or 0 if readahead has not
+	// yet been enabled.
+	size int
+	// buf holds the data read ahead, starting at bufOffset.
+	buf       []byte
+	bufOffset uint64
+}
+
+// observe records an access to the block with the specified handle, whether
+// or not the block needs to be read from the file.
+func (ra *readahead) observe(bh blockHandle) {
+	if bh.offset == ra.nextOffset && ra.numReads > 0 {
+		ra.numReads++
+	} else {
+		ra.numReads = 1
+		ra.size = 0
+	}
+	ra.nextOffset = bh.offset + bh.length + blockTrailerLen
+}
+
+// read returns the contents of the block with the specified handle, including
+// its trailer, if it can be served by readahead. It returns nil if the access
+// pattern is not sequential, in which case the caller should read the block
+// directly. The returned slice does not alias the readahead buffer.
+func (ra *readahead) read(f storage.File, bh blockHandle) ([]byte, error) {
+	if ra.numReads < readaheadThreshold {
+		return nil, nil
+	}
+	n := bh.length + blockTrailerLen
+	if bh.offset < ra.bufOffset || bh.offset+n > ra.bufOffset+uint64(len(ra.buf)) {
+		if ra.size == 0 {
+			ra.size = initialReadaheadSize
+		} else if ra.size < maxReadaheadSize {
+			ra.size *= 2
+		}
+		size := ra.size
+		if uint64(size) < n {
+			size = int(n)
+		}
+		if cap(ra.buf) < size {
+			ra.buf = make([]byte, size)
+		}
+		ra.buf = ra.buf[:size]
+		k, err := f.ReadAt(ra.buf, int64(bh.offset))
+		ra.buf = ra.buf[:k]
+		ra.bufOffset = bh.offset
+		if uint64(k) < n {
+			if err == nil || err == io.EOF {
+				err = io.ErrUnexpectedEOF
+			}
+			return nil, err
+		}
+	}
+	start := bh.offset - ra.bufOffset
+	return append([]byte(nil), ra.buf[start:start+n]...), nil
+}
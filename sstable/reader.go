@@ -12,10 +12,8 @@ import (
 	"io"
 	"sync"
 
-	"github.com/golang/snappy"
 	"github.com/petermattis/pebble/cache"
 	"github.com/petermattis/pebble/db"
-	"github.com/petermattis/pebble/internal/crc"
 	"github.com/petermattis/pebble/storage"
 )
 
@@ -48,42 +46,179 @@ type block []byte
 
 // Iter is an iterator over an entire table of data. It is a two-level
 // iterator: to seek for a given key, it first looks in the index for the
-// block that contains that key, and then looks inside that block.
+// block that contains that key, and then looks inside that block. If the
+// table's index is partitioned, the index is itself a two-level iterator over
+// the top-level index and the index partitions.
 type Iter struct {
-	reader    *Reader
-	index     blockIter
-	data      blockIter
+	reader *Reader
+	// topLevelIndex is only used if the table has a partitioned index. The
+	// index partitions are loaded into index as the top-level index is
+	// traversed.
+	topLevelIndex blockIter
+	index         blockIter
+	data          blockIter
+	twoLevel      bool
+	// readahead detects sequential scans of the data blocks and reads ahead
+	// of the iterator.
+	readahead readahead
 	err       error
 	closeHook func() error
 }
 
 func (i *Iter) init(r *Reader) error {
 	i.reader = r
+	i.readahead = readahead{}
 	var index block
 	index, i.err = r.readIndex()
 	if i.err != nil {
 		return i.err
 	}
+	if r.Properties.IndexType == twoLevelIndex {
+		i.twoLevel = true
+		i.err = i.topLevelIndex.init(r.compare, index, r.Properties.GlobalSeqNum)
+		return i.err
+	}
 	i.err = i.index.init(r.compare, index, r.Properties.GlobalSeqNum)
 	return i.err
 }
 
+// loadIndex loads the index partition at the current top-level index position
+// and leaves i.index unpositioned. If unsuccessful, it invalidates i.index and
+// sets i.err to any error encountered, which may be nil if we have simply
+// exhausted the top-level index.
+func (i *Iter) loadIndex() bool {
+	if !i.topLevelIndex.Valid() {
+		i.err = i.topLevelIndex.err
+		i.invalidateIndex()
+		return false
+	}
+	v := i.topLevelIndex.Value()
+	h, n := decodeBlockHandle(v)
+	if n == 0 || n != len(v) {
+		i.err = CorruptionError("pebble/table: corrupt top-level index entry")
+		i.invalidateIndex()
+		return false
+	}
+	index, _, err := i.reader.readBlock(h, cache.HighPriority, nil)
+	if err != nil {
+		i.err = err
+		i.invalidateIndex()
+		return false
+	}
+	i.err = i.index.init(i.reader.compare, index, i.reader.Properties.GlobalSeqNum)
+	if i.err != nil {
+		i.invalidateIndex()
+		return false
+	}
+	return true
+}
+
+func (i *Iter) invalidateIndex() {
+	i.index.offset = -1
+	i.index.nextOffset = -1
+}
+
+// seekIndexGE positions the index at the first entry whose key is >= key.
+func (i *Iter) seekIndexGE(key []byte) {
+	if !i.twoLevel {
+		i.index.SeekGE(key)
+		return
+	}
+	i.topLevelIndex.SeekGE(key)
+	if i.loadIndex() {
+		i.index.SeekGE(key)
+		i.skipIndexForward()
+	}
+}
+
+// firstIndex positions the index at the first entry.
+func (i *Iter) firstIndex() {
+	if !i.twoLevel {
+		i.index.First()
+		return
+	}
+	i.topLevelIndex.First()
+	if i.loadIndex() {
+		i.index.First()
+		i.skipIndexForward()
+	}
+}
+
+// lastIndex positions the index at the last entry.
+func (i *Iter) lastIndex() {
+	if !i.twoLevel {
+		i.index.Last()
+		return
+	}
+	i.topLevelIndex.Last()
+	if i.loadIndex() {
+		i.index.Last()
+		i.skipIndexBackward()
+	}
+}
+
+// nextIndex moves the index to the next entry, returning false if the index
+// is exhausted.
+func (i *Iter) nextIndex() bool {
+	if i.index.Next() || !i.twoLevel {
+		return i.index.Valid()
+	}
+	return i.skipIndexForward()
+}
+
+// prevIndex moves the index to the previous entry, returning false if the
+// index is exhausted.
+func (i *Iter) prevIndex() bool {
+	if i.index.Prev() || !i.twoLevel {
+		return i.index.Valid()
+	}
+	return i.skipIndexBackward()
+}
+
+// skipIndexForward advances through the index partitions until i.index is
+// positioned at a valid entry or the top-level index is exhausted.
+func (i *Iter) skipIndexForward() bool {
+	for !i.index.Valid() {
+		if !i.topLevelIndex.Next() || !i.loadIndex() {
+			i.invalidateIndex()
+			return false
+		}
+		i.index.First()
+	}
+	return true
+}
+
+// skipIndexBackward moves backward through the index partitions until i.index
+// is positioned at a valid entry or the top-level index is exhausted.
+func (i *Iter) skipIndexBackward() bool {
+	for !i.index.Valid() {
+		if !i.topLevelIndex.Prev() || !i.loadIndex() {
+			i.invalidateIndex()
+			return false
+		}
+		i.index.Last()
+	}
+	return true
+}
+
 // loadBlock loads the block at the current index position and leaves i.data
 // unpositioned. If unsuccessful, it sets i.err to any error encountered, which
 // may be nil if we have simply exhausted the entire table.
 func (i *Iter) loadBlock() bool {
 	if !i.index.Valid() {
-		i.err = i.index.err
+		if i.err == nil {
+			i.err = i.index.err
+		}
 		return false
 	}
 	// Load the next block.
 	v := i.index.Value()
 	h, n := decodeBlockHandle(v)
 	if n == 0 || n != len(v) {
-		i.err = errors.New("pebble/table: corrupt index entry")
+		i.err = CorruptionError("pebble/table: corrupt index entry")
 		return false
 	}
-	block, _, err := i.reader.readBlock(h)
+	block, _, err := i.reader.readBlock(h, cache.LowPriority, &i.readahead)
 	if err != nil {
 		i.err = err
 		return false
@@ -103,21 +238,23 @@ func (i *Iter) loadBlock() bool {
 // db.ErrNotFound if f does not contain the key.
 func (i *Iter) seekBlock(key []byte, f *blockFilterReader) bool {
 	if !i.index.Valid() {
-		i.err = i.index.err
+		if i.err == nil {
+			i.err = i.index.err
+		}
 		return false
 	}
 	// Load the next block.
 	v := i.index.Value()
 	h, n := decodeBlockHandle(v)
 	if n == 0 || n != len(v) {
-		i.err = errors.New("pebble/table: corrupt index entry")
+		i.err = CorruptionError("pebble/table: corrupt index entry")
 		return false
 	}
 	if f != nil && !f.mayContain(h.offset, key) {
 		i.err = db.ErrNotFound
 		return false
 	}
-	block, _, err := i.reader.readBlock(h)
+	block, _, err := i.reader.readBlock(h, cache.LowPriority, nil)
 	if err != nil {
 		i.err = err
 		return false
@@ -126,8 +263,9 @@ func (i *Iter) seekBlock(key []byte, f *blockFilterReader) bool {
 	if i.err != nil {
 		return false
 	}
-	// Look for the key inside that block.
-	i.data.SeekGE(key)
+	// Look for the key inside that block, using the block's hash index if
+	// present.
+	i.data.seekGEForGet(key)
 	return true
 }
 
@@ -141,7 +279,7 @@ func (i *Iter) SeekGE(key []byte) {
 	// NB: the top-level dbIter has already adjusted key based on
 	// IterOptions.LowerBound.
 
-	i.index.SeekGE(key)
+	i.seekIndexGE(key)
 	if i.loadBlock() {
 		i.data.SeekGE(key)
 	}
@@ -157,9 +295,9 @@ func (i *Iter) SeekLT(key []byte) {
 	// NB: the top-level dbIter has already adjusted key based on
 	// IterOptions.UpperBound.
 
-	i.index.SeekGE(key)
-	if !i.index.Valid() {
-		i.index.Last()
+	i.seekIndexGE(key)
+	if !i.index.Valid() && i.err == nil {
+		i.lastIndex()
 	}
 	if i.loadBlock() {
 		i.data.SeekLT(key)
@@ -175,7 +313,7 @@ func (i *Iter) SeekLT(key []byte) {
 			// be chosen as "compleu". The SeekGE in the index block will then point
 			// us to the block containing "complexion". If this happens, we want the
 			// last key from the previous data block.
-			i.index.Prev()
+			i.prevIndex()
 			if i.loadBlock() {
 				i.data.Last()
 			}
@@ -193,7 +331,7 @@ func (i *Iter) First() {
 	// NB: the top-level dbIter will call SeekGE if IterOptions.LowerBound is
 	// set.
 
-	i.index.First()
+	i.firstIndex()
 	if i.loadBlock() {
 		i.data.First()
 	}
@@ -209,7 +347,7 @@ func (i *Iter) Last() {
 	// NB: the top-level dbIter will call SeekLT if IterOptions.UpperBound is
 	// set.
 
-	i.index.Last()
+	i.lastIndex()
 	if i.loadBlock() {
 		i.data.Last()
 	}
@@ -229,7 +367,7 @@ func (i *Iter) Next() bool {
 			i.err = i.data.err
 			break
 		}
-		if !i.index.Next() {
+		if !i.nextIndex() {
 			break
 		}
 		if i.loadBlock() {
@@ -254,7 +392,7 @@ func (i *Iter) Prev() bool {
 			i.err = i.data.err
 			break
 		}
-		if !i.index.Prev() {
+		if !i.prevIndex() {
 			break
 		}
 		if i.loadBlock() {
@@ -317,21 +455,37 @@ type Reader struct {
 	file    storage.File
 	fileNum uint64
 	err     error
-	indexBH blockHandle
-	index   struct {
+	// checksumType is the block checksum algorithm recorded in the footer.
+	checksumType byte
+	indexBH      blockHandle
+	index        struct {
 		mu     sync.RWMutex
 		handle cache.WeakHandle
-	}
-	opts        *db.Options
-	cache       *cache.Cache
-	compare     db.Compare
-	blockFilter *blockFilterReader
-	tableFilter *tableFilterReader
-	Properties  Properties
+		// pinned holds the index block if it has been pinned by PinMetadata.
+		pinned block
+	}
+	opts  *db.Options
+	cache db.Cache
+	// secondaryCache holds the blocks evicted from the block cache.
+	secondaryCache db.SecondaryCache
+	compare        db.Compare
+	blockFilter    *blockFilterReader
+	tableFilter    *tableFilterReader
+	// partitionedFilter is non-nil if the table has a table-level filter that
+	// has been partitioned.
+	partitionedFilter *partitionedFilterReader
+	// compressionDict is non-nil if the table was written with a compression
+	// dictionary.
+	compressionDict *compressionDictReader
+	Properties      Properties
 }
 
 // Close implements DB.Close, as documented in the pebble/db package.
 func (r *Reader) Close() error {
+	if r.compressionDict != nil {
+		r.compressionDict.close()
+		r.compressionDict = nil
+	}
 	if r.err != nil {
 		if r.file != nil {
 			r.file.Close()
@@ -360,11 +514,19 @@ func (r *Reader) get(key []byte, o *db.IterOptions) (value []byte, err error) {
 		if !r.tableFilter.mayContain(key) {
 			return nil, db.ErrNotFound
 		}
+	} else if r.partitionedFilter != nil {
+		mayContain, err := r.partitionedFilter.mayContain(key)
+		if err != nil {
+			return nil, err
+		}
+		if !mayContain {
+			return nil, db.ErrNotFound
+		}
 	}
 
 	i := &Iter{}
 	if err := i.init(r); err == nil {
-		i.index.SeekGE(key)
+		i.seekIndexGE(key)
 		i.seekBlock(key, r.blockFilter)
 	}
 
@@ -391,11 +553,40 @@ func (r *Reader) NewIter(o *db.IterOptions) *Iter {
 	return i
 }
 
+// PinMetadata loads the index block and holds it in memory for the lifetime of
+// the reader, rather than relying on the block cache to retain it. If the
+// index is partitioned, the top-level index is pinned and the index partitions
+// remain in the cache. Filter blocks, other than filter partitions, are always
+// held in memory by the reader.
+func (r *Reader) PinMetadata() error {
+	if r.err != nil {
+		return r.err
+	}
+	b, err := r.readIndex()
+	if err != nil {
+		return err
+	}
+	r.index.mu.Lock()
+	r.index.pinned = b
+	r.index.mu.Unlock()
+	return nil
+}
+
+// UnpinMetadata releases the index block pinned by PinMetadata, after which
+// the index block is read through the block cache like any other block.
+func (r *Reader) UnpinMetadata() {
+	r.index.mu.Lock()
+	r.index.pinned = nil
+	r.index.handle = nil
+	r.index.mu.Unlock()
+}
+
 func (r *Reader) readIndex() (block, error) {
-	// Fast-path for retrieving the index block from a weak cache handle.
+	// Fast-path for retrieving a pinned index block, or the index block from a
+	// weak cache handle.
 	r.index.mu.RLock()
-	var b []byte
-	if r.index.handle != nil {
+	b := r.index.pinned
+	if b == nil && r.index.handle != nil {
 		b = r.index.handle.Get()
 	}
 	r.index.mu.RUnlock()
@@ -405,7 +596,7 @@ func (r *Reader) readIndex() (block, error) {
 
 	// Slow-path: read the index block from disk. This checks the cache again,
 	// but that is ok because somebody else might have inserted it for us.
-	b, h, err := r.readBlock(r.indexBH)
+	b, h, err := r.readBlock(r.indexBH, cache.HighPriority, nil)
 	if err == nil && h != nil {
 		r.index.mu.Lock()
 		r.index.handle = h
@@ -414,39 +605,93 @@ func (r *Reader) readIndex() (block, error) {
 	return b, err
 }
 
-// readBlock reads and decompresses a block from disk into memory.
-func (r *Reader) readBlock(bh blockHandle) (block, cache.WeakHandle, error) {
-	if b := r.cache.Get(r.fileNum, bh.offset); b != nil {
+// readBlock reads and decompresses a block from disk into memory, unless it is
+// present in the cache or the secondary cache. The block is added to the cache
+// with the specified priority. If ra is non-nil, the access
+// is recorded and the block may be read using readahead.
+func (r *Reader) readBlock(
+	bh blockHandle, pri cache.Priority, ra *readahead,
+) (block, cache.WeakHandle, error) {
+	if ra != nil {
+		ra.observe(bh)
+	}
+	if r.cache != nil {
+		if b := r.cache.Get(r.fileNum, bh.offset); b != nil {
+			return b, nil, nil
+		}
+	}
+
+	var b []byte
+	if r.secondaryCache != nil {
+		b = r.secondaryCache.Get(r.fileNum, bh.offset)
+	}
+	if b == nil {
+		var err error
+		if b, err = r.readRawBlock(bh, ra); err != nil {
+			return nil, nil, err
+		}
+		if b, err = r.decompressBlock(b[bh.length], b[:bh.length]); err != nil {
+			return nil, nil, err
+		}
+	}
+	if r.cache == nil {
 		return b, nil, nil
 	}
+	h := r.cache.Set(r.fileNum, bh.offset, b, pri)
+	return b, h, nil
+}
 
-	b := make([]byte, bh.length+blockTrailerLen)
-	if _, err := r.file.ReadAt(b, int64(bh.offset)); err != nil {
-		return nil, nil, err
+// readRawBlock reads a block and its trailer from the file, using readahead
+// if ra is non-nil, and verifies the block's checksum.
+func (r *Reader) readRawBlock(bh blockHandle, ra *readahead) ([]byte, error) {
+	var b []byte
+	if ra != nil {
+		var err error
+		if b, err = ra.read(r.file, bh); err != nil {
+			return nil, err
+		}
+	}
+	if b == nil {
+		b = make([]byte, bh.length+blockTrailerLen)
+		if _, err := r.file.ReadAt(b, int64(bh.offset)); err != nil {
+			return nil, err
+		}
+	}
+	if !r.validChecksum(b, bh) {
+		return nil, CorruptionError("pebble/table: invalid table (checksum mismatch)")
 	}
+	return b, nil
+}
+
+// validChecksum returns true if the checksum in the trailer of a raw block
+// matches the block's contents.
+func (r *Reader) validChecksum(b []byte, bh blockHandle) bool {
 	checksum0 := binary.LittleEndian.Uint32(b[bh.length+1:])
-	checksum1 := crc.New(b[:bh.length+1]).Value()
-	if checksum0 != checksum1 {
-		return nil, nil, errors.New("pebble/table: invalid table (checksum mismatch)")
-	}
-	switch b[bh.length] {
-	case noCompressionBlockType:
-		b = b[:bh.length]
-		h := r.cache.Set(r.fileNum, bh.offset, b)
-		return b, h, nil
-	case snappyCompressionBlockType:
-		b, err := snappy.Decode(nil, b[:bh.length])
-		if err != nil {
-			return nil, nil, err
+	checksum1 := blockChecksum(r.checksumType, b[:bh.length], b[bh.length:bh.length+1])
+	return checksum0 == checksum1
+}
+
+// decompressBlock decompresses the contents of a block, using the table's
+// compression dictionary if it has one. A block which cannot be decompressed
+// is corrupt.
+func (r *Reader) decompressBlock(blockType byte, b []byte) ([]byte, error) {
+	var err error
+	if blockType == zstdCompressionBlockType && r.compressionDict != nil {
+		b, err = r.compressionDict.decompress(b)
+	} else {
+		b, err = decompressBlock(blockType, b)
+	}
+	if err != nil {
+		if _, ok := err.(CorruptionError); !ok {
+			err = CorruptionError(fmt.Sprintf("pebble/table: corrupt compressed block: %v", err))
 		}
-		h := r.cache.Set(r.fileNum, bh.offset, b)
-		return b, h, nil
+		return nil, err
 	}
-	return nil, nil, fmt.Errorf("pebble/table: unknown block compression: %d", b[bh.length])
+	return b, nil
 }
 
 func (r *Reader) readMetaindex(metaindexBH blockHandle, o *db.Options) error {
-	b, _, err := r.readBlock(metaindexBH)
+	b, _, err := r.readBlock(metaindexBH, cache.LowPriority, nil)
 	if err != nil {
 		return err
 	}
@@ -459,7 +704,7 @@ func (r *Reader) readMetaindex(metaindexBH blockHandle, o *db.Options) error {
 	for i.First(); i.Valid(); i.Next() {
 		bh, n := decodeBlockHandle(i.Value())
 		if n == 0 {
-			return errors.New("pebble/table: invalid table (bad filter block handle)")
+			return CorruptionError("pebble/table: invalid table (bad filter block handle)")
 		}
 		meta[string(i.Key().UserKey)] = bh
 	}
@@ -468,7 +713,7 @@ func (r *Reader) readMetaindex(metaindexBH blockHandle, o *db.Options) error {
 	}
 
 	if bh, ok := meta["rocksdb.properties"]; ok {
-		b, _, err = r.readBlock(bh)
+		b, _, err = r.readBlock(bh, cache.LowPriority, nil)
 		if err != nil {
 			return err
 		}
@@ -477,22 +722,35 @@ func (r *Reader) readMetaindex(metaindexBH blockHandle, o *db.Options) error {
 		}
 	}
 
+	if bh, ok := meta[compressionDictMetaName]; ok {
+		b, _, err = r.readBlock(bh, cache.LowPriority, nil)
+		if err != nil {
+			return err
+		}
+		r.compressionDict, err = newCompressionDictReader(b)
+		if err != nil {
+			return CorruptionError(fmt.Sprintf("pebble/table: invalid table (bad compression dictionary): %v", err))
+		}
+	}
+
 	for level := range r.opts.Levels {
 		fp := r.opts.Levels[level].FilterPolicy
 		if fp == nil {
 			continue
 		}
 		types := []struct {
-			ftype  db.FilterType
-			prefix string
+			ftype       db.FilterType
+			prefix      string
+			partitioned bool
 		}{
-			{db.BlockFilter, "filter."},
-			{db.TableFilter, "fullfilter."},
+			{db.BlockFilter, "filter.", false},
+			{db.TableFilter, "fullfilter.", false},
+			{db.TableFilter, "partitionedfilter.", true},
 		}
 		var done bool
 		for _, t := range types {
 			if bh, ok := meta[t.prefix+fp.Name()]; ok {
-				b, _, err = r.readBlock(bh)
+				b, _, err = r.readBlock(bh, cache.HighPriority, nil)
 				if err != nil {
 					return err
 				}
@@ -501,12 +759,19 @@ func (r *Reader) readMetaindex(metaindexBH blockHandle, o *db.Options) error {
 				case db.BlockFilter:
 					r.blockFilter = newBlockFilterReader(b, fp)
 					if r.blockFilter == nil {
-						return errors.New("pebble/table: invalid table (bad filter block)")
+						return CorruptionError("pebble/table: invalid table (bad filter block)")
 					}
 				case db.TableFilter:
+					if t.partitioned {
+						r.partitionedFilter = newPartitionedFilterReader(b, fp, r)
+						if r.partitionedFilter == nil {
+							return CorruptionError("pebble/table: invalid table (bad filter block)")
+						}
+						break
+					}
 					r.tableFilter = newTableFilterReader(b, fp)
 					if r.tableFilter == nil {
-						return errors.New("pebble/table: invalid table (bad filter block)")
+						return CorruptionError("pebble/table: invalid table (bad filter block)")
 					}
 				default:
 					panic(fmt.Sprintf("unknown filter type: %v", t.ftype))
@@ -528,11 +793,12 @@ func (r *Reader) readMetaindex(metaindexBH blockHandle, o *db.Options) error {
 func NewReader(f storage.File, fileNum uint64, o *db.Options) *Reader {
 	o = o.EnsureDefaults()
 	r := &Reader{
-		file:    f,
-		fileNum: fileNum,
-		opts:    o,
-		cache:   o.Cache,
-		compare: o.Comparer.Compare,
+		file:           f,
+		fileNum:        fileNum,
+		opts:           o,
+		cache:          o.Cache,
+		compare:        o.Comparer.Compare,
+		secondaryCache: o.SecondaryCache,
 	}
 	if f == nil {
 		r.err = errors.New("pebble/table: nil file")
@@ -558,7 +824,7 @@ func NewReader(f storage.File, fileNum uint64, o *db.Options) *Reader {
 	//    table_magic_number (8 bytes)
 	footer := make([]byte, footerLen)
 	if stat.Size() < int64(len(footer)) {
-		r.err = errors.New("pebble/table: invalid table (file size is too small)")
+		r.err = CorruptionError("pebble/table: invalid table (file size is too small)")
 		return r
 	}
 	_, err = f.ReadAt(footer, stat.Size()-int64(len(footer)))
@@ -567,26 +833,27 @@ func NewReader(f storage.File, fileNum uint64, o *db.Options) *Reader {
 		return r
 	}
 	if string(footer[magicOffset:footerLen]) != magic {
-		r.err = errors.New("pebble/table: invalid table (bad magic number)")
+		r.err = CorruptionError("pebble/table: invalid table (bad magic number)")
 		return r
 	}
 
 	version := binary.LittleEndian.Uint32(footer[versionOffset:magicOffset])
-	if version != formatVersion {
+	if version != formatVersion && version != formatVersionDataBlockHashIndex {
 		r.err = fmt.Errorf("pebble/table: unsupported format version %d", version)
 		return r
 	}
 
-	if footer[0] != checksumCRC32c {
+	if !validChecksumType(footer[0]) {
 		r.err = fmt.Errorf("pebble/table: unsupported checksum type %d", footer[0])
 		return r
 	}
+	r.checksumType = footer[0]
 	footer = footer[1:]
 
 	// Read the metaindex.
 	metaindexBH, n := decodeBlockHandle(footer)
 	if n == 0 {
-		r.err = errors.New("pebble/table: invalid table (bad metaindex block handle)")
+		r.err = CorruptionError("pebble/table: invalid table (bad metaindex block handle)")
 		return r
 	}
 	footer = footer[n:]
@@ -598,7 +865,7 @@ func NewReader(f storage.File, fileNum uint64, o *db.Options) *Reader {
 	// Read the index into memory.
 	r.indexBH, n = decodeBlockHandle(footer)
 	if n == 0 {
-		r.err = errors.New("pebble/table: invalid table (bad index block handle)")
+		r.err = CorruptionError("pebble/table: invalid table (bad index block handle)")
 		return r
 	}
 
@@ -81,8 +81,10 @@ The table file format looks like:
 
 Each block consists of some data and a 5 byte trailer: a 1 byte block type and
 a 4 byte checksum of the compressed data. The block type gives the per-block
-compression used; each block is compressed independently. The checksum
-algorithm is described in the pebble/crc package.
+compression used; each block is compressed independently. The checksum covers
+the compressed data and the block type. The checksum algorithm is recorded in
+the footer and is either the masked CRC-32c described in the pebble/crc
+package, or the low 32 bits of the 64-bit xxHash.
 
 The decompressed block data consists of a sequence of key/value entries
 followed by a trailer. Each key is encoded as a shared prefix length and a
@@ -103,6 +105,10 @@ uint32 values are the block offsets of each restart point. The final uint32
 value is P itself. Thus, when seeking for a particular key, one can use binary
 search to find the largest restart point whose key is <= the key sought.
 
+A data block may also contain a hash index between the restart points and the
+final uint32, in which case the high bit of the final uint32 is set. See
+block_hash.go for the details.
+
 An index block is a block with N key/value entries. The i'th value is the
 encoded block handle of the i'th data block. The i'th key is a separator for
 i < N-1, and a successor for i == N-1. The separator between blocks i and i+1
@@ -110,10 +116,18 @@ is a key that is >= every key in block i and is < every key i block i+1. The
 successor for the final block is a key that is >= every key in block N-1. The
 index block restart interval is 1: every entry is a restart point.
 
-The table footer is exactly 48 bytes long:
+If the index is partitioned, the index block described above is split into
+several index partitions, and the footer refers to a top-level index block
+instead. The i'th key of the top-level index is the last key of the i'th index
+partition and the i'th value is the encoded block handle of that partition. The
+properties record the use of a partitioned index.
+
+The table footer is exactly 53 bytes long:
+  - a 1-byte checksum type,
   - the block handle for the metaindex block,
   - the block handle for the index block,
-  - padding to take the two items above up to 40 bytes,
+  - padding to take the three items above up to 41 bytes,
+  - a 4-byte format version,
   - an 8-byte magic string.
 
 A block handle is an offset and a length; the length does not include the 5
@@ -130,21 +144,47 @@ const (
 
 	magic = "\xf7\xcf\xf4\x85\xb7\x41\xe2\x88"
 
-	noChecksum     = 0
-	checksumCRC32c = 1
-	checksumXXHash = 2
+	// The checksum type gives the algorithm used to checksum each block. It is
+	// stored in the first byte of the footer. The values match those used by
+	// RocksDB.
+	noChecksum       = 0
+	checksumCRC32c   = 1
+	checksumXXHash   = 2
+	checksumXXHash64 = 3
 
 	formatVersion = 2
-
-	// The block type gives the per-block compression format.
+	// formatVersionDataBlockHashIndex is written in place of formatVersion by
+	// tables whose data blocks may contain a hash index. Readers which do not
+	// understand the hash index reject such tables.
+	formatVersionDataBlockHashIndex = 3
+
+	// The index type is stored in the properties block. The values match those
+	// used by RocksDB.
+	binarySearchIndex = 0
+	twoLevelIndex     = 2
+
+	// The block type gives the per-block compression format. The values match
+	// those used by RocksDB. See compression.go for the registry mapping block
+	// types to compressors.
 	// These constants are part of the file format and should not be changed.
 	// They are different from the db.Compression constants because the latter
 	// are designed so that the zero value of the db.Compression type means to
 	// use the default compression (which is snappy).
 	noCompressionBlockType     = 0
 	snappyCompressionBlockType = 1
+	lz4CompressionBlockType    = 4
+	zstdCompressionBlockType   = 7
 )
 
+// CorruptionError is the error returned when the contents of a table are
+// found to be corrupt, such as a block whose checksum does not match its
+// contents or an index entry which cannot be decoded.
+type CorruptionError string
+
+func (e CorruptionError) Error() string {
+	return string(e)
+}
+
 // TODO(peter): silence unused warnings.
 var _ = noChecksum
 var _ = checksumXXHash
@@ -18,6 +18,7 @@ import (
 	"testing"
 
 	"github.com/petermattis/pebble/bloom"
+	"github.com/petermattis/pebble/cache"
 	"github.com/petermattis/pebble/db"
 	"github.com/petermattis/pebble/storage"
 )
@@ -237,6 +238,14 @@ func build(
 	fp db.FilterPolicy,
 	ftype db.FilterType,
 ) (storage.File, error) {
+	return buildWithOptions(db.LevelOptions{
+		Compression:  compression,
+		FilterPolicy: fp,
+		FilterType:   ftype,
+	})
+}
+
+func buildWithOptions(lo db.LevelOptions) (storage.File, error) {
 	// Create a sorted list of wordCount's keys.
 	keys := make([]string, len(wordCount))
 	i := 0
@@ -258,11 +267,7 @@ func build(
 		Merger: &db.Merger{
 			Name: "nullptr",
 		},
-	}, db.LevelOptions{
-		Compression:  compression,
-		FilterPolicy: fp,
-		FilterType:   ftype,
-	})
+	}, lo)
 	for _, k := range keys {
 		v := wordCount[k]
 		ikey := db.MakeInternalKey([]byte(k), 0, db.InternalKeyKindSet)
@@ -446,6 +451,345 @@ func TestWriter(t *testing.T) {
 	}
 }
 
+func TestWriterCompression(t *testing.T) {
+	var uncompressedSize uint64
+	for _, c := range []db.Compression{
+		db.NoCompression,
+		db.SnappyCompression,
+		db.ZstdCompression,
+		db.LZ4Compression,
+	} {
+		t.Run(c.String(), func(t *testing.T) {
+			f, err := build(c, nil, 0)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := check(f, nil); err != nil {
+				t.Fatal(err)
+			}
+
+			f, err = memFileSystem.Open(fmt.Sprintf("/tmp%d", tmpFileCount-1))
+			if err != nil {
+				t.Fatal(err)
+			}
+			r := NewReader(f, 0, nil)
+			defer r.Close()
+			if r.err != nil {
+				t.Fatal(r.err)
+			}
+			if r.Properties.CompressionName != c.String() {
+				t.Fatalf("expected %s, but found %s", c, r.Properties.CompressionName)
+			}
+			if c == db.NoCompression {
+				uncompressedSize = r.Properties.DataSize
+			} else if r.Properties.DataSize >= uncompressedSize {
+				t.Fatalf("expected data size < %d, but found %d", uncompressedSize, r.Properties.DataSize)
+			}
+		})
+	}
+}
+
+func TestTwoLevelIndex(t *testing.T) {
+	for _, indexBlockSize := range []int{0, 1, 64, 256, 1024} {
+		t.Run(fmt.Sprint(indexBlockSize), func(t *testing.T) {
+			f, err := buildWithOptions(db.LevelOptions{
+				BlockSize:      256,
+				IndexBlockSize: indexBlockSize,
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			r := NewReader(f, 0, nil)
+			if r.err != nil {
+				t.Fatal(r.err)
+			}
+			if indexBlockSize == 0 {
+				// Partitioning is disabled by default.
+				if r.Properties.IndexType != binarySearchIndex {
+					t.Fatalf("expected single-level index, but found index type %d", r.Properties.IndexType)
+				}
+			} else if r.Properties.IndexType != twoLevelIndex {
+				t.Fatalf("expected two-level index, but found index type %d", r.Properties.IndexType)
+			} else if r.Properties.IndexPartitions <= 1 {
+				t.Fatalf("expected multiple index partitions, but found %d", r.Properties.IndexPartitions)
+			}
+			if indexBlockSize != 0 && r.Properties.TopLevelIndexSize >= r.Properties.IndexSize {
+				t.Fatalf("expected top-level index size %d < index size %d",
+					r.Properties.TopLevelIndexSize, r.Properties.IndexSize)
+			}
+			if err := r.Close(); err != nil {
+				t.Fatal(err)
+			}
+
+			f, err = memFileSystem.Open(fmt.Sprintf("/tmp%d", tmpFileCount-1))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := check(f, nil); err != nil {
+				t.Fatal(err)
+			}
+		})
+	}
+}
+
+func TestDataBlockHashIndex(t *testing.T) {
+	f, err := buildWithOptions(db.LevelOptions{
+		BlockSize:          256,
+		DataBlockHashIndex: true,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	stat, err := f.Stat()
+	if err != nil {
+		t.Fatal(err)
+	}
+	footer := make([]byte, footerLen)
+	if _, err := f.ReadAt(footer, stat.Size()-footerLen); err != nil {
+		t.Fatal(err)
+	}
+	version := binary.LittleEndian.Uint32(footer[versionOffset:magicOffset])
+	if version != formatVersionDataBlockHashIndex {
+		t.Fatalf("expected format version %d, but found %d", formatVersionDataBlockHashIndex, version)
+	}
+	if err := check(f, nil); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestPinMetadata(t *testing.T) {
+	f, err := build(db.DefaultCompression, nil, db.TableFilter)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := cache.New(1 << 20)
+	r := NewReader(f, 0, &db.Options{Cache: c})
+	if err := r.PinMetadata(); err != nil {
+		t.Fatal(err)
+	}
+	c.EvictFile(0)
+	if _, err := r.readIndex(); err != nil {
+		t.Fatal(err)
+	}
+	// The pinned index block is returned without consulting the cache, so the
+	// cache remains empty.
+	if size := c.Size(); size != 0 {
+		t.Fatalf("expected empty cache, but found %d", size)
+	}
+	// Once unpinned, the index block is read through the cache.
+	r.UnpinMetadata()
+	if _, err := r.readIndex(); err != nil {
+		t.Fatal(err)
+	}
+	if size := c.Size(); size == 0 {
+		t.Fatalf("expected the index block to be cached")
+	}
+	if err := r.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+type countingFile struct {
+	storage.File
+	reads int
+}
+
+func (f *countingFile) ReadAt(p []byte, off int64) (int, error) {
+	f.reads++
+	return f.File.ReadAt(p, off)
+}
+
+func TestSecondaryCache(t *testing.T) {
+	f, err := build(db.DefaultCompression, nil, db.TableFilter)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sc, err := cache.NewPersistentCache(storage.NewMem(), "/pcache", 1<<20)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sc.Close()
+
+	scan := func(r *Reader) int {
+		var count int
+		i := r.NewIter(nil)
+		for i.First(); i.Valid(); i.Next() {
+			count++
+		}
+		if err := i.Close(); err != nil {
+			t.Fatal(err)
+		}
+		return count
+	}
+
+	// Blocks which remain in the block cache are not added to the secondary
+	// cache.
+	r := NewReader(f, 0, &db.Options{
+		Cache:          cache.NewWithOptions(1<<20, cache.Options{OnEvict: sc.Set}),
+		SecondaryCache: sc,
+	})
+	expected := scan(r)
+	if b := sc.Get(0, 0); b != nil {
+		t.Fatalf("expected the first block to not be in the secondary cache")
+	}
+	if err := r.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// Blocks evicted from a small block cache are added to the secondary
+	// cache, from which they are read rather than from the file.
+	cf := &countingFile{File: f}
+	r = NewReader(cf, 0, &db.Options{
+		Cache:          cache.NewWithOptions(4<<10, cache.Options{Shards: 1, OnEvict: sc.Set}),
+		SecondaryCache: sc,
+	})
+	if count := scan(r); count != expected {
+		t.Fatalf("expected %d keys, but found %d", expected, count)
+	}
+	if b := sc.Get(0, 0); b == nil {
+		t.Fatalf("expected the first block to be in the secondary cache")
+	}
+	cf.reads = 0
+	if count := scan(r); count != expected {
+		t.Fatalf("expected %d keys, but found %d", expected, count)
+	}
+	if cf.reads != 0 {
+		t.Fatalf("expected blocks to be read from the secondary cache, but found %d reads", cf.reads)
+	}
+
+	// Evicting the file from the secondary cache causes the blocks to be read
+	// from the file again.
+	sc.EvictFile(0)
+	if count := scan(r); count != expected {
+		t.Fatalf("expected %d keys, but found %d", expected, count)
+	}
+	if cf.reads == 0 {
+		t.Fatalf("expected blocks to be read from the file")
+	}
+	if err := r.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestReadahead(t *testing.T) {
+	f, err := buildWithOptions(db.LevelOptions{BlockSize: 256})
+	if err != nil {
+		t.Fatal(err)
+	}
+	cf := &countingFile{File: f}
+	r := NewReader(cf, 0, nil)
+	if r.err != nil {
+		t.Fatal(r.err)
+	}
+	numDataBlocks := int(r.Properties.NumDataBlocks)
+	if numDataBlocks < 100 {
+		t.Fatalf("expected at least 100 data blocks, but found %d", numDataBlocks)
+	}
+
+	var forward []string
+	cf.reads = 0
+	i := r.NewIter(nil)
+	for i.First(); i.Valid(); i.Next() {
+		forward = append(forward, string(i.Key().UserKey))
+	}
+	if err := i.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if cf.reads >= numDataBlocks/4 {
+		t.Fatalf("expected readahead to reduce the reads of %d blocks, but found %d reads",
+			numDataBlocks, cf.reads)
+	}
+
+	// A reverse scan does not use readahead, and returns the same keys.
+	cf.reads = 0
+	i = r.NewIter(nil)
+	n := len(forward)
+	for i.Last(); i.Valid(); i.Prev() {
+		n--
+		if n < 0 || string(i.Key().UserKey) != forward[n] {
+			t.Fatalf("unexpected key %s", i.Key().UserKey)
+		}
+	}
+	if err := i.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if n != 0 {
+		t.Fatalf("expected %d keys, but found %d", len(forward), len(forward)-n)
+	}
+	if cf.reads < numDataBlocks {
+		t.Fatalf("expected %d reads, but found %d", numDataBlocks, cf.reads)
+	}
+	if err := r.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestPartitionedFilter(t *testing.T) {
+	for _, indexBlockSize := range []int{0, 1, 128, 1 << 20} {
+		t.Run(fmt.Sprint(indexBlockSize), func(t *testing.T) {
+			f, err := buildWithOptions(db.LevelOptions{
+				BlockSize:        256,
+				IndexBlockSize:   indexBlockSize,
+				FilterPolicy:     bloom.FilterPolicy(10),
+				FilterType:       db.TableFilter,
+				PartitionFilters: true,
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			c := &countingFilterPolicy{
+				FilterPolicy: bloom.FilterPolicy(10),
+			}
+			r := NewReader(f, 0, &db.Options{
+				Levels: []db.LevelOptions{{
+					FilterPolicy: c,
+				}},
+			})
+			if r.err != nil {
+				t.Fatal(r.err)
+			}
+			if r.partitionedFilter == nil {
+				t.Fatalf("expected partitioned filter")
+			}
+			var partitions int
+			i, err := newBlockIter(r.compare, r.partitionedFilter.index)
+			if err != nil {
+				t.Fatal(err)
+			}
+			for i.First(); i.Valid(); i.Next() {
+				partitions++
+			}
+			if expected := int(r.Properties.IndexPartitions); expected == 0 {
+				if partitions != 1 {
+					t.Fatalf("expected 1 filter partition, but found %d", partitions)
+				}
+			} else if partitions != expected {
+				t.Fatalf("expected %d filter partitions, but found %d", expected, partitions)
+			}
+			if err := r.Close(); err != nil {
+				t.Fatal(err)
+			}
+
+			f, err = memFileSystem.Open(fmt.Sprintf("/tmp%d", tmpFileCount-1))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := check(f, c); err != nil {
+				t.Fatal(err)
+			}
+			if c.truePositives != len(wordCount) {
+				t.Errorf("true positives: got %d, want %d", c.truePositives, len(wordCount))
+			}
+			if c.falseNegatives != 0 {
+				t.Errorf("false negatives: got %d, want %d", c.falseNegatives, 0)
+			}
+			if c.trueNegatives == 0 {
+				t.Errorf("true negatives: got %d, want > 0", c.trueNegatives)
+			}
+		})
+	}
+}
+
 func testNoCompressionOutput(t *testing.T, fp db.FilterPolicy, ftype db.FilterType) {
 	filename := "testdata/h.no-compression.sst"
 	if fp != nil {
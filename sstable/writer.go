@@ -13,9 +13,7 @@ import (
 	"math"
 	"os"
 
-	"github.com/golang/snappy"
 	"github.com/petermattis/pebble/db"
-	"github.com/petermattis/pebble/internal/crc"
 	"github.com/petermattis/pebble/storage"
 )
 
@@ -30,11 +28,15 @@ type Writer struct {
 	// The next give fields are copied from a db.Options.
 	blockSize          int
 	blockSizeThreshold int
+	indexBlockSize     int
 	bytesPerSync       int
+	checksumType       byte
 	compare            db.Compare
 	compression        db.Compression
 	separator          db.Separator
 	successor          db.Successor
+	// formatVersion is the format version written in the footer.
+	formatVersion uint32
 	// A table is a series of blocks and a block's index entry contains a
 	// separator key between one block and the next. Thus, a finished block
 	// cannot be written until the first key in the next block is seen.
@@ -48,11 +50,19 @@ type Writer struct {
 	syncOffset uint64
 	block      blockWriter
 	indexBlock blockWriter
-	props      Properties
-	// compressedBuf is the destination buffer for snappy compression. It is
+	// indexPartitions holds the finished index partitions when the index is
+	// split into multiple blocks. The partitions are written along with a
+	// top-level index when the table is closed.
+	indexPartitions     []indexPartition
+	indexPartitionsSize int
+	props               Properties
+	// compressedBuf is the destination buffer for block compression. It is
 	// re-used over the lifetime of the writer, avoiding the allocation of a
 	// temporary buffer for each block.
 	compressedBuf []byte
+	// compressionDict trains and holds the compression dictionary, if
+	// dictionary compression is enabled.
+	compressionDict *compressionDictWriter
 	// filter accumulates the filter block.
 	filter filterWriter
 	// tmp is a scratch buffer, large enough to hold either footerLen bytes,
@@ -134,24 +144,75 @@ func (w *Writer) flushPendingBH(key db.InternalKey) {
 	n := encodeBlockHandle(w.tmp[:], w.pendingBH)
 	w.indexBlock.add(sep, w.tmp[:n])
 	w.pendingBH = blockHandle{}
+	// NB: the index partition is finished after adding the entry for the
+	// pending block so that the keys added to a partitioned filter, which
+	// include the keys in the pending block, line up with the partition.
+	if w.indexBlockSize > 0 && w.indexBlock.estimatedSize() >= w.indexBlockSize {
+		w.finishIndexPartition()
+	}
+}
+
+// indexPartition is a finished index block of a partitioned index.
+type indexPartition struct {
+	// sep is the last key in the partition, which is used as the partition's
+	// key in the top-level index.
+	sep      db.InternalKey
+	block    []byte
+	nEntries int
+}
+
+// finishIndexPartition finishes the current index block and adds it to the
+// list of index partitions. The partitions are held in memory until the table
+// is closed because the index blocks follow the data blocks in the table.
+func (w *Writer) finishIndexPartition() {
+	sep := db.DecodeInternalKey(w.indexBlock.curKey).Clone()
+	b := w.indexBlock.finish()
+	w.indexPartitions = append(w.indexPartitions, indexPartition{
+		sep:      sep,
+		block:    append([]byte(nil), b...),
+		nEntries: w.indexBlock.nEntries,
+	})
+	w.indexPartitionsSize += len(b)
+	w.indexBlock.reset()
+	if f, ok := w.filter.(*partitionedFilterWriter); ok {
+		f.finishPartition(sep)
+	}
+}
+
+// writeTwoLevelIndex writes the index partitions followed by the top-level
+// index, which maps the last key in each partition to the partition's block
+// handle. It returns the block handle of the top-level index.
+func (w *Writer) writeTwoLevelIndex() (blockHandle, error) {
+	if w.indexBlock.nEntries > 0 {
+		w.finishIndexPartition()
+	}
+	topLevelIndex := blockWriter{restartInterval: 1}
+	for i := range w.indexPartitions {
+		p := &w.indexPartitions[i]
+		bh, err := w.writeCompressedBlock(p.block, false)
+		if err != nil {
+			return blockHandle{}, err
+		}
+		n := encodeBlockHandle(w.tmp[:], bh)
+		topLevelIndex.add(p.sep, w.tmp[:n])
+		w.props.IndexSize += bh.length + blockTrailerLen
+	}
+	bh, err := w.writeCompressedBlock(topLevelIndex.finish(), false)
+	if err != nil {
+		return blockHandle{}, err
+	}
+	w.props.IndexPartitions = uint64(len(w.indexPartitions))
+	w.props.IndexSize += bh.length + blockTrailerLen
+	w.props.IndexType = twoLevelIndex
+	w.props.TopLevelIndexSize = bh.length + blockTrailerLen
+	w.indexPartitions = nil
+	return bh, nil
 }
 
 // finishBlock finishes the current block and returns its block handle, which is
 // its offset and length in the table.
 func (w *Writer) finishBlock(block *blockWriter) (blockHandle, error) {
-	// Compress the buffer, discarding the result if the improvement
-	// isn't at least 12.5%.
-	b := block.finish()
-	blockType := byte(noCompressionBlockType)
-	if w.compression == db.SnappyCompression {
-		compressed := snappy.Encode(w.compressedBuf, b)
-		w.compressedBuf = compressed[:cap(compressed)]
-		if len(compressed) < len(b)-len(b)/8 {
-			blockType = snappyCompressionBlockType
-			b = compressed
-		}
-	}
-	bh, err := w.writeRawBlock(b, blockType)
+	bh, err := w.writeCompressedBlock(block.finish(), block == &w.block)
 
 	// Calculate filters.
 	if w.filter != nil {
@@ -163,11 +224,60 @@ func (w *Writer) finishBlock(block *blockWriter) (blockHandle, error) {
 	return bh, err
 }
 
+// writeFilterPartitions writes the partitions of a partitioned filter. The
+// top-level filter index is written by the caller. Must be called after the
+// index partitions have been finished.
+func (w *Writer) writeFilterPartitions(f *partitionedFilterWriter) error {
+	if w.indexBlock.nEntries > 0 {
+		// The index is not partitioned, or the keys in the final data blocks
+		// have not been added to a filter partition yet.
+		f.finishPartition(db.DecodeInternalKey(w.indexBlock.curKey))
+	}
+	for i := range f.partitions {
+		p := &f.partitions[i]
+		bh, err := w.writeRawBlock(p.filter, noCompressionBlockType)
+		if err != nil {
+			return err
+		}
+		p.bh = bh
+		w.props.FilterSize += bh.length
+	}
+	return nil
+}
+
+// writeCompressedBlock compresses and writes a block, returning its block
+// handle.
+func (w *Writer) writeCompressedBlock(b []byte, dataBlock bool) (blockHandle, error) {
+	// Compress the buffer, discarding the result if the improvement
+	// isn't at least 12.5%.
+	blockType := byte(noCompressionBlockType)
+	if c := compressorForCompression(w.compression); c != nil {
+		var compressed []byte
+		var ok bool
+		// The compression dictionary is only used for data blocks. In
+		// particular, the metaindex block must be readable before the
+		// dictionary has been loaded.
+		if w.compressionDict != nil && dataBlock {
+			w.compressionDict.addSample(b)
+			compressed, ok = w.compressionDict.compress(w.compressedBuf, b)
+		}
+		if !ok {
+			compressed = c.compress(w.compressedBuf, b)
+		}
+		w.compressedBuf = compressed[:cap(compressed)]
+		if len(compressed) < len(b)-len(b)/8 {
+			blockType = c.blockType
+			b = compressed
+		}
+	}
+	return w.writeRawBlock(b, blockType)
+}
+
 func (w *Writer) writeRawBlock(b []byte, blockType byte) (blockHandle, error) {
 	w.tmp[0] = blockType
 
 	// Calculate the checksum.
-	checksum := crc.New(b).Update(w.tmp[:1]).Value()
+	checksum := blockChecksum(w.checksumType, b, w.tmp[:1])
 	binary.LittleEndian.PutUint32(w.tmp[1:5], checksum)
 
 	// Write the bytes to the file.
@@ -199,6 +309,9 @@ func (w *Writer) writeRawBlock(b []byte, blockType byte) (blockHandle, error) {
 // table was written to.
 func (w *Writer) Close() (err error) {
 	defer func() {
+		if w.compressionDict != nil {
+			w.compressionDict.close()
+		}
 		if w.file == nil {
 			return
 		}
@@ -215,7 +328,7 @@ func (w *Writer) Close() (err error) {
 	// Finish the last data block, or force an empty data block if there
 	// aren't any data blocks at all.
 	w.flushPendingBH(db.InternalKey{})
-	if w.block.nEntries > 0 || w.indexBlock.nEntries == 0 {
+	if w.block.nEntries > 0 || w.numDataBlocks() == 0 {
 		bh, err := w.finishBlock(&w.block)
 		if err != nil {
 			w.err = err
@@ -225,12 +338,31 @@ func (w *Writer) Close() (err error) {
 		w.flushPendingBH(db.InternalKey{})
 	}
 	w.props.DataSize = w.offset
-	w.props.NumDataBlocks = uint64(w.indexBlock.nEntries)
+	w.props.NumDataBlocks = uint64(w.numDataBlocks())
+
+	// Write the index partitions and top-level index if the index has been
+	// partitioned. Otherwise, the index is written after the metaindex.
+	var indexBH blockHandle
+	twoLevel := len(w.indexPartitions) > 0
+	if twoLevel {
+		var err error
+		indexBH, err = w.writeTwoLevelIndex()
+		if err != nil {
+			w.err = err
+			return w.err
+		}
+	}
 
 	// Write the filter block.
 	var metaindex rawBlockWriter
 	metaindex.restartInterval = 1
 	if w.filter != nil {
+		if f, ok := w.filter.(*partitionedFilterWriter); ok {
+			if err := w.writeFilterPartitions(f); err != nil {
+				w.err = err
+				return w.err
+			}
+		}
 		b, err := w.filter.finish()
 		if err != nil {
 			w.err = err
@@ -244,7 +376,18 @@ func (w *Writer) Close() (err error) {
 		n := encodeBlockHandle(w.tmp[:], bh)
 		metaindex.add(db.InternalKey{UserKey: []byte(w.filter.metaName())}, w.tmp[:n])
 		w.props.FilterPolicyName = w.filter.policyName()
-		w.props.FilterSize = bh.length
+		w.props.FilterSize += bh.length
+	}
+
+	// Write the compression dictionary block.
+	if w.compressionDict != nil && w.compressionDict.dict != nil {
+		bh, err := w.writeRawBlock(w.compressionDict.dict, noCompressionBlockType)
+		if err != nil {
+			w.err = err
+			return w.err
+		}
+		n := encodeBlockHandle(w.tmp[:], bh)
+		metaindex.add(db.InternalKey{UserKey: []byte(compressionDictMetaName)}, w.tmp[:n])
 	}
 
 	// TODO(peter): write the range-del block.
@@ -256,7 +399,9 @@ func (w *Writer) Close() (err error) {
 		// NB: RocksDB includes the block trailer length in the index size
 		// property, though it doesn't include the trailer in the filter size
 		// property.
-		w.props.IndexSize = uint64(w.indexBlock.estimatedSize()) + blockTrailerLen
+		if !twoLevel {
+			w.props.IndexSize = uint64(w.indexBlock.estimatedSize()) + blockTrailerLen
+		}
 		w.props.save(&raw)
 		bh, err := w.writeRawBlock(raw.finish(), noCompressionBlockType)
 		if err != nil {
@@ -276,10 +421,12 @@ func (w *Writer) Close() (err error) {
 	}
 
 	// Write the index block.
-	indexBH, err := w.finishBlock(&w.indexBlock)
-	if err != nil {
-		w.err = err
-		return w.err
+	if !twoLevel {
+		indexBH, err = w.finishBlock(&w.indexBlock)
+		if err != nil {
+			w.err = err
+			return w.err
+		}
 	}
 
 	// Write the table footer.
@@ -287,11 +434,11 @@ func (w *Writer) Close() (err error) {
 	for i := range footer {
 		footer[i] = 0
 	}
-	footer[0] = checksumCRC32c
+	footer[0] = w.checksumType
 	n := 1
 	n += encodeBlockHandle(footer[n:], metaindexBH)
 	n += encodeBlockHandle(footer[n:], indexBH)
-	binary.LittleEndian.PutUint32(footer[versionOffset:], formatVersion)
+	binary.LittleEndian.PutUint32(footer[versionOffset:], w.formatVersion)
 	copy(footer[magicOffset:], magic)
 	if _, err := w.writer.Write(footer); err != nil {
 		w.err = err
@@ -325,7 +472,18 @@ func (w *Writer) Close() (err error) {
 // EstimatedSize returns the estimated size of the sstable being written if a
 // called to Finish() was made without adding additional keys.
 func (w *Writer) EstimatedSize() uint64 {
-	return w.offset + uint64(w.block.estimatedSize()+w.indexBlock.estimatedSize())
+	return w.offset + uint64(w.block.estimatedSize()+w.indexBlock.estimatedSize()+
+		w.indexPartitionsSize)
+}
+
+// numDataBlocks returns the number of data blocks that have been added to the
+// index.
+func (w *Writer) numDataBlocks() int {
+	n := w.indexBlock.nEntries
+	for i := range w.indexPartitions {
+		n += w.indexPartitions[i].nEntries
+	}
+	return n
 }
 
 // Stat returns the file info for the finished sstable. Only valid to call
@@ -346,7 +504,10 @@ func NewWriter(f storage.File, o *db.Options, lo db.LevelOptions) *Writer {
 		file:               f,
 		blockSize:          lo.BlockSize,
 		blockSizeThreshold: (lo.BlockSize*lo.BlockSizeThreshold + 99) / 100,
+		indexBlockSize:     lo.IndexBlockSize,
+		formatVersion:      formatVersion,
 		bytesPerSync:       o.BytesPerSync,
+		checksumType:       checksumTypeFor(o.Checksum),
 		compare:            o.Comparer.Compare,
 		compression:        lo.Compression,
 		separator:          o.Comparer.Separator,
@@ -368,12 +529,25 @@ func NewWriter(f storage.File, o *db.Options, lo db.LevelOptions) *Writer {
 		case db.BlockFilter:
 			w.filter = newBlockFilterWriter(lo.FilterPolicy)
 		case db.TableFilter:
-			w.filter = newTableFilterWriter(lo.FilterPolicy)
+			if lo.PartitionFilters {
+				w.filter = newPartitionedFilterWriter(lo.FilterPolicy)
+			} else {
+				w.filter = newTableFilterWriter(lo.FilterPolicy)
+			}
 		default:
 			panic(fmt.Sprintf("unknown filter type: %v", lo.FilterType))
 		}
 	}
 
+	if lo.DataBlockHashIndex {
+		w.block.hashIndex = &dataBlockHashBuilder{valid: true}
+		w.formatVersion = formatVersionDataBlockHashIndex
+	}
+
+	if lo.Compression == db.ZstdCompression && lo.CompressionDictSize > 0 {
+		w.compressionDict = newCompressionDictWriter(lo.CompressionDictSize)
+	}
+
 	w.props.ColumnFamilyID = math.MaxInt32
 	w.props.ComparatorName = o.Comparer.Name
 	w.props.CompressionName = lo.Compression.String()
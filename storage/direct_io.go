@@ -0,0 +1,259 @@
+// Copyright 2018 The LevelDB-Go and Pebble Authors. All rights reserved. Use
+// of this source code is governed by a BSD-style license that can be found in
+// the LICENSE file.
+
+package storage
+
+import (
+	"io"
+	"os"
+	"unsafe"
+)
+
+const (
+	// directIOAlignment is the alignment of the file offsets, lengths and
+	// memory buffers used for direct I/O. It is a multiple of the logical
+	// block size of all common devices.
+	directIOAlignment = 4096
+
+	// directIOBufferSize is the size of the write buffer of a file opened for
+	// writing with direct I/O.
+	directIOBufferSize = 256 << 10
+)
+
+// DirectIO is a Storage implementation backed by the underlying operating
+// system's file system which bypasses the operating system's page cache when
+// reading and writing files. Reads and writes are performed with O_DIRECT on
+// Linux. Files are opened normally on other operating systems, and on file
+// systems which do not support direct I/O.
+//
+// Direct I/O avoids double caching of sstable blocks in both the page cache
+// and the block cache, and prevents large sequential reads and writes, such
+// as those performed by compactions, from evicting other data from the page
+// cache. Reads which are not covered by the block cache become more
+// expensive, so direct I/O should be combined with a suitably sized block
+// cache. A DB uses DirectIO for its sstables and log files when
+// db.Options.UseDirectIO is set.
+var DirectIO Storage = directFS{}
+
+type directFS struct {
+	defaultFS
+}
+
+func (directFS) Create(name string) (File, error) {
+	f, direct, err := openDirect(name, os.O_RDWR|os.O_CREATE|os.O_TRUNC)
+	if err != nil {
+		return nil, err
+	}
+	if !direct {
+		return f, nil
+	}
+	return &directFile{
+		f:        f,
+		buf:      alignedBuffer(directIOBufferSize),
+		writable: true,
+	}, nil
+}
+
+func (directFS) ReuseForWrite(oldname, newname string) (File, error) {
+	if err := os.Rename(oldname, newname); err != nil {
+		return nil, err
+	}
+	f, direct, err := openDirect(newname, os.O_RDWR|os.O_CREATE)
+	if err != nil {
+		return nil, err
+	}
+	if !direct {
+		return f, nil
+	}
+	return &directFile{
+		f:        f,
+		buf:      alignedBuffer(directIOBufferSize),
+		writable: true,
+	}, nil
+}
+
+func (directFS) Open(name string) (File, error) {
+	f, direct, err := openDirect(name, os.O_RDONLY)
+	if err != nil {
+		return nil, err
+	}
+	if !direct {
+		return f, nil
+	}
+	return &directFile{f: f}, nil
+}
+
+// alignedBuffer returns a buffer of the specified size whose address is
+// aligned to directIOAlignment.
+func alignedBuffer(size int) []byte {
+	b := make([]byte, size+directIOAlignment)
+	offset := 0
+	if rem := int(uintptr(unsafe.Pointer(&b[0])) & (directIOAlignment - 1)); rem != 0 {
+		offset = directIOAlignment - rem
+	}
+	return b[offset : offset+size : offset+size]
+}
+
+func alignDown(n int64) int64 {
+	return n &^ (directIOAlignment - 1)
+}
+
+func alignUp(n int64) int64 {
+	return alignDown(n + directIOAlignment - 1)
+}
+
+// osFile is the subset of the methods of *os.File used by directFile.
+type osFile interface {
+	io.ReaderAt
+	io.WriterAt
+	io.Closer
+	Stat() (os.FileInfo, error)
+	Sync() error
+	Truncate(size int64) error
+}
+
+// directFile is a File opened for direct I/O. Writes are accumulated in an
+// aligned buffer which is written to the file when full. Sync and Close write
+// the partially filled tail of the buffer padded to the alignment with
+// zeroes, and retain the partial final block in the buffer so that it is
+// rewritten along with subsequent writes. Close truncates the file to its
+// logical size and syncs the truncation, so that a closed file never ends in
+// padding, even after a crash. A synced file which is not closed, such as a
+// log file after a crash, may end with up to one block of padding, which
+// readers of log files skip. Reads are performed through temporary aligned
+// buffers.
+type directFile struct {
+	f osFile
+
+	// buf holds the data which has not yet been written to the file, starting
+	// at file offset bufOffset. bufOffset is always aligned.
+	buf       []byte
+	n         int
+	bufOffset int64
+	writable  bool
+
+	// rpos is the offset of the next Read.
+	rpos int64
+}
+
+func (f *directFile) Close() error {
+	var err error
+	if f.writable && f.n > 0 {
+		// Remove the padding of the final block. The file may already have been
+		// synced with the padding, so the truncation must be synced as well.
+		err = f.flushTail()
+		if err == nil {
+			err = f.f.Truncate(f.size())
+		}
+		if err == nil {
+			err = f.f.Sync()
+		}
+	}
+	if err1 := f.f.Close(); err == nil {
+		err = err1
+	}
+	return err
+}
+
+func (f *directFile) Read(p []byte) (int, error) {
+	n, err := f.ReadAt(p, f.rpos)
+	f.rpos += int64(n)
+	if n > 0 && err == io.EOF {
+		err = nil
+	}
+	return n, err
+}
+
+func (f *directFile) ReadAt(p []byte, off int64) (int, error) {
+	if len(p) == 0 {
+		return 0, nil
+	}
+	start := alignDown(off)
+	end := alignUp(off + int64(len(p)))
+	tmp := alignedBuffer(int(end - start))
+	k, err := f.f.ReadAt(tmp, start)
+	if err != nil && err != io.EOF {
+		return 0, err
+	}
+	skip := int(off - start)
+	if k <= skip {
+		return 0, io.EOF
+	}
+	n := copy(p, tmp[skip:k])
+	if n < len(p) {
+		return n, io.EOF
+	}
+	return n, nil
+}
+
+func (f *directFile) Write(p []byte) (int, error) {
+	written := len(p)
+	for len(p) > 0 {
+		k := copy(f.buf[f.n:], p)
+		f.n += k
+		p = p[k:]
+		if f.n == len(f.buf) {
+			if _, err := f.f.WriteAt(f.buf, f.bufOffset); err != nil {
+				return written - len(p), err
+			}
+			f.bufOffset += int64(f.n)
+			f.n = 0
+		}
+	}
+	return written, nil
+}
+
+// flushTail writes the buffered data to the file, padding the final block to
+// the alignment.
+func (f *directFile) flushTail() error {
+	if f.n == 0 {
+		return nil
+	}
+	padded := int(alignUp(int64(f.n)))
+	for i := f.n; i < padded; i++ {
+		f.buf[i] = 0
+	}
+	if _, err := f.f.WriteAt(f.buf[:padded], f.bufOffset); err != nil {
+		return err
+	}
+	// Retain the partial final block, which will be rewritten by the next
+	// flush.
+	if full := int(alignDown(int64(f.n))); full > 0 {
+		f.n = copy(f.buf, f.buf[full:f.n])
+		f.bufOffset += int64(full)
+	}
+	return nil
+}
+
+// size returns the logical size of a file opened for writing.
+func (f *directFile) size() int64 {
+	return f.bufOffset + int64(f.n)
+}
+
+func (f *directFile) Stat() (os.FileInfo, error) {
+	fi, err := f.f.Stat()
+	if err != nil || !f.writable {
+		return fi, err
+	}
+	// The file may contain padding beyond the data written to it.
+	return directFileInfo{FileInfo: fi, size: f.size()}, nil
+}
+
+// directFileInfo is the FileInfo of a file opened for writing with direct
+// I/O, which reports the logical size of the file.
+type directFileInfo struct {
+	os.FileInfo
+	size int64
+}
+
+func (fi directFileInfo) Size() int64 {
+	return fi.size
+}
+
+func (f *directFile) Sync() error {
+	if err := f.flushTail(); err != nil {
+		return err
+	}
+	return f.f.Sync()
+}
@@ -0,0 +1,16 @@
+// Copyright 2018 The LevelDB-Go and Pebble Authors. All rights reserved. Use
+// of this source code is governed by a BSD-style license that can be found in
+// the LICENSE file.
+
+// +build !linux
+
+package storage
+
+import "os"
+
+// openDirect opens the named file normally: direct I/O is only supported on
+// Linux.
+func openDirect(name string, flag int) (*os.File, bool, error) {
+	f, err := os.OpenFile(name, flag, 0666)
+	return f, false, err
+}
@@ -0,0 +1,27 @@
+// Copyright 2018 The LevelDB-Go and Pebble Authors. All rights reserved. Use
+// of this source code is governed by a BSD-style license that can be found in
+// the LICENSE file.
+
+// +build linux
+
+package storage
+
+import (
+	"os"
+	"syscall"
+)
+
+// openDirect opens the named file with O_DIRECT, returning true if the file
+// was opened for direct I/O. If the file system does not support O_DIRECT the
+// file is opened normally.
+func openDirect(name string, flag int) (*os.File, bool, error) {
+	f, err := os.OpenFile(name, flag|syscall.O_DIRECT, 0666)
+	if err == nil {
+		return f, true, nil
+	}
+	if pe, ok := err.(*os.PathError); !ok || pe.Err != syscall.EINVAL {
+		return nil, false, err
+	}
+	f, err = os.OpenFile(name, flag, 0666)
+	return f, false, err
+}
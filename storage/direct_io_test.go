@@ -0,0 +1,186 @@
+// Copyright 2018 The LevelDB-Go and Pebble Authors. All rights reserved. Use
+// of this source code is governed by a BSD-style license that can be found in
+// the LICENSE file.
+
+package storage
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"testing"
+	"unsafe"
+)
+
+func TestDirectIO(t *testing.T) {
+	dir, err := ioutil.TempDir("", "pebble-direct-io")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	name := filepath.Join(dir, "test")
+
+	rng := rand.New(rand.NewSource(1))
+	var expected []byte
+	f, err := DirectIO.Create(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := f.(*directFile); !ok {
+		t.Logf("direct I/O is not supported by %s", dir)
+	}
+	for i := 0; i < 200; i++ {
+		p := make([]byte, rng.Intn(2*directIOAlignment))
+		rng.Read(p)
+		if _, err := f.Write(p); err != nil {
+			t.Fatal(err)
+		}
+		expected = append(expected, p...)
+		if rng.Intn(10) == 0 {
+			if err := f.Sync(); err != nil {
+				t.Fatal(err)
+			}
+			if stat, err := f.Stat(); err != nil {
+				t.Fatal(err)
+			} else if stat.Size() != int64(len(expected)) {
+				t.Fatalf("expected size %d, but found %d", len(expected), stat.Size())
+			}
+			// Syncing does not truncate the padding of the final block.
+			if stat, err := os.Stat(name); err != nil {
+				t.Fatal(err)
+			} else if stat.Size() < int64(len(expected)) {
+				t.Fatalf("expected size >= %d, but found %d", len(expected), stat.Size())
+			}
+		}
+	}
+	if err := f.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	f, err = DirectIO.Open(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	if stat, err := f.Stat(); err != nil {
+		t.Fatal(err)
+	} else if stat.Size() != int64(len(expected)) {
+		t.Fatalf("expected size %d, but found %d", len(expected), stat.Size())
+	}
+
+	// Read the file sequentially with odd sized reads.
+	var got []byte
+	buf := make([]byte, 3001)
+	for {
+		n, err := f.Read(buf)
+		got = append(got, buf[:n]...)
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			t.Fatal(err)
+		}
+	}
+	if !bytes.Equal(expected, got) {
+		t.Fatalf("sequential read mismatch")
+	}
+
+	// Read the file at random offsets.
+	for i := 0; i < 100; i++ {
+		off := rng.Intn(len(expected))
+		p := make([]byte, rng.Intn(3*directIOAlignment))
+		n, err := f.ReadAt(p, int64(off))
+		if want := len(expected) - off; want < len(p) {
+			if n != want || err != io.EOF {
+				t.Fatalf("expected %d, io.EOF, but found %d, %v", want, n, err)
+			}
+		} else if n != len(p) || err != nil {
+			t.Fatalf("expected %d, nil, but found %d, %v", len(p), n, err)
+		}
+		if !bytes.Equal(expected[off:off+n], p[:n]) {
+			t.Fatalf("read mismatch at offset %d", off)
+		}
+	}
+}
+
+// durableFile is an osFile which records the contents of the file when it was
+// last synced.
+type durableFile struct {
+	*os.File
+	durable []byte
+}
+
+func (f *durableFile) Sync() error {
+	if err := f.File.Sync(); err != nil {
+		return err
+	}
+	data, err := ioutil.ReadFile(f.Name())
+	f.durable = data
+	return err
+}
+
+func TestDirectIOCloseDurable(t *testing.T) {
+	dir, err := ioutil.TempDir("", "pebble-direct-io")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	osf, err := os.Create(filepath.Join(dir, "test"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	df := &durableFile{File: osf}
+	f := &directFile{
+		f:        df,
+		buf:      alignedBuffer(directIOBufferSize),
+		writable: true,
+	}
+
+	// Write a file in the manner of an sstable: the data is followed by a
+	// footer which ends in a partial block, and the file is synced before it
+	// is closed.
+	footer := []byte("footer-magic")
+	data := make([]byte, 3*directIOAlignment+100)
+	rand.New(rand.NewSource(1)).Read(data)
+	expected := append(append([]byte(nil), data...), footer...)
+	if _, err := f.Write(expected); err != nil {
+		t.Fatal(err)
+	}
+	if err := f.Sync(); err != nil {
+		t.Fatal(err)
+	}
+	if len(df.durable) != int(alignUp(int64(len(expected)))) {
+		t.Fatalf("expected synced size %d, but found %d",
+			alignUp(int64(len(expected))), len(df.durable))
+	}
+	if err := f.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// The durable contents of the closed file must not end in padding.
+	if len(df.durable) != len(expected) {
+		t.Fatalf("expected durable size %d, but found %d", len(expected), len(df.durable))
+	}
+	if !bytes.HasSuffix(df.durable, footer) {
+		t.Fatalf("durable file does not end with the footer: %q",
+			df.durable[len(df.durable)-len(footer):])
+	}
+	if !bytes.Equal(expected, df.durable) {
+		t.Fatalf("durable contents mismatch")
+	}
+}
+
+func TestAlignedBuffer(t *testing.T) {
+	for _, size := range []int{1, directIOAlignment, directIOBufferSize} {
+		b := alignedBuffer(size)
+		if len(b) != size {
+			t.Fatalf("expected length %d, but found %d", size, len(b))
+		}
+		if addr := uintptr(unsafe.Pointer(&b[0])); addr%directIOAlignment != 0 {
+			t.Fatalf("buffer of size %d is not aligned: %x", size, addr)
+		}
+	}
+}
@@ -0,0 +1,217 @@
+// Copyright 2018 The LevelDB-Go and Pebble Authors. All rights reserved. Use
+// of this source code is governed by a BSD-style license that can be found in
+// the LICENSE file.
+
+package storage
+
+import (
+	"sync"
+	"time"
+)
+
+// DiskHealthOptions configures the disk health checks performed by a Storage
+// returned by WithDiskHealthChecks.
+type DiskHealthOptions struct {
+	// SlowThreshold is the duration after which a write or sync is considered
+	// slow. It must be positive.
+	SlowThreshold time.Duration
+	// OnSlow is invoked once for each write or sync which has been in progress
+	// for at least SlowThreshold, either when the operation completes or, if
+	// it has not completed, when it is noticed to be slow.
+	OnSlow func(name string, op string, duration time.Duration)
+	// StallTimeout is the duration after which a write or sync which has not
+	// completed is considered to be stalled. Zero disables stall detection.
+	StallTimeout time.Duration
+	// OnStall is invoked once for each write or sync which has been in
+	// progress for at least StallTimeout. It is invoked while the operation is
+	// still in progress.
+	OnStall func(name string, op string, duration time.Duration)
+}
+
+// WithDiskHealthChecks returns a Storage which times the writes and syncs of
+// the files created through fs, reporting operations which are slow or have
+// stalled. The open files created through the returned Storage are monitored
+// by a single goroutine, which exits when they have all been closed.
+func WithDiskHealthChecks(fs Storage, opts DiskHealthOptions) Storage {
+	return &diskHealthFS{Storage: fs, opts: opts}
+}
+
+type diskHealthFS struct {
+	Storage
+	opts DiskHealthOptions
+
+	mu struct {
+		sync.Mutex
+		// files holds the open files being monitored.
+		files map[*diskHealthFile]struct{}
+		// stopper is closed to stop the monitor goroutine, which runs while
+		// files is non-empty.
+		stopper chan struct{}
+	}
+}
+
+func (fs *diskHealthFS) Create(name string) (File, error) {
+	f, err := fs.Storage.Create(name)
+	if err != nil {
+		return nil, err
+	}
+	return fs.monitor(f, name), nil
+}
+
+func (fs *diskHealthFS) ReuseForWrite(oldname, newname string) (File, error) {
+	f, err := fs.Storage.ReuseForWrite(oldname, newname)
+	if err != nil {
+		return nil, err
+	}
+	return fs.monitor(f, newname), nil
+}
+
+// monitor returns a File which times the writes and syncs of f, and adds it
+// to the files checked by the monitor goroutine, starting the goroutine if
+// necessary.
+func (fs *diskHealthFS) monitor(f File, name string) File {
+	hf := &diskHealthFile{
+		File: f,
+		name: name,
+		fs:   fs,
+	}
+	fs.mu.Lock()
+	if fs.mu.files == nil {
+		fs.mu.files = make(map[*diskHealthFile]struct{})
+	}
+	fs.mu.files[hf] = struct{}{}
+	if fs.mu.stopper == nil {
+		fs.mu.stopper = make(chan struct{})
+		go fs.run(fs.mu.stopper)
+	}
+	fs.mu.Unlock()
+	return hf
+}
+
+// remove removes a closed file from the files checked by the monitor
+// goroutine, stopping the goroutine if no files remain.
+func (fs *diskHealthFS) remove(f *diskHealthFile) {
+	fs.mu.Lock()
+	delete(fs.mu.files, f)
+	if len(fs.mu.files) == 0 && fs.mu.stopper != nil {
+		close(fs.mu.stopper)
+		fs.mu.stopper = nil
+	}
+	fs.mu.Unlock()
+}
+
+// run periodically checks whether the operations in progress on the open
+// files are slow or have stalled, until stopper is closed.
+func (fs *diskHealthFS) run(stopper chan struct{}) {
+	interval := fs.opts.SlowThreshold
+	if fs.opts.StallTimeout > 0 && fs.opts.StallTimeout < interval {
+		interval = fs.opts.StallTimeout
+	}
+	ticker := time.NewTicker(interval / 4)
+	defer ticker.Stop()
+
+	var files []*diskHealthFile
+	for {
+		select {
+		case <-stopper:
+			return
+		case <-ticker.C:
+			fs.mu.Lock()
+			files = files[:0]
+			for f := range fs.mu.files {
+				files = append(files, f)
+			}
+			fs.mu.Unlock()
+			for _, f := range files {
+				f.check()
+			}
+		}
+	}
+}
+
+// diskHealthFile is a File whose writes and syncs are timed.
+type diskHealthFile struct {
+	File
+	name      string
+	fs        *diskHealthFS
+	closeOnce sync.Once
+
+	mu struct {
+		sync.Mutex
+		// op is the operation in progress, or "" if there is none.
+		op            string
+		start         time.Time
+		slowReported  bool
+		stallReported bool
+	}
+}
+
+func (f *diskHealthFile) Write(p []byte) (n int, err error) {
+	f.begin("write")
+	n, err = f.File.Write(p)
+	f.end()
+	return n, err
+}
+
+func (f *diskHealthFile) Sync() error {
+	f.begin("sync")
+	err := f.File.Sync()
+	f.end()
+	return err
+}
+
+func (f *diskHealthFile) Close() error {
+	f.closeOnce.Do(func() {
+		f.fs.remove(f)
+	})
+	return f.File.Close()
+}
+
+func (f *diskHealthFile) begin(op string) {
+	f.mu.Lock()
+	f.mu.op = op
+	f.mu.start = time.Now()
+	f.mu.slowReported = false
+	f.mu.stallReported = false
+	f.mu.Unlock()
+}
+
+func (f *diskHealthFile) end() {
+	f.mu.Lock()
+	op := f.mu.op
+	d := time.Since(f.mu.start)
+	report := d >= f.fs.opts.SlowThreshold && !f.mu.slowReported
+	f.mu.op = ""
+	f.mu.Unlock()
+	if report && f.fs.opts.OnSlow != nil {
+		f.fs.opts.OnSlow(f.name, op, d)
+	}
+}
+
+// check reports the operation in progress if it has become slow or has
+// stalled.
+func (f *diskHealthFile) check() {
+	f.mu.Lock()
+	op := f.mu.op
+	if op == "" {
+		f.mu.Unlock()
+		return
+	}
+	d := time.Since(f.mu.start)
+	slow := d >= f.fs.opts.SlowThreshold && !f.mu.slowReported
+	if slow {
+		f.mu.slowReported = true
+	}
+	stall := f.fs.opts.StallTimeout > 0 && d >= f.fs.opts.StallTimeout && !f.mu.stallReported
+	if stall {
+		f.mu.stallReported = true
+	}
+	f.mu.Unlock()
+
+	if slow && f.fs.opts.OnSlow != nil {
+		f.fs.opts.OnSlow(f.name, op, d)
+	}
+	if stall && f.fs.opts.OnStall != nil {
+		f.fs.opts.OnStall(f.name, op, d)
+	}
+}
@@ -0,0 +1,164 @@
+// Copyright 2018 The LevelDB-Go and Pebble Authors. All rights reserved. Use
+// of this source code is governed by a BSD-style license that can be found in
+// the LICENSE file.
+
+package storage
+
+import (
+	"sync"
+	"testing"
+	"time"
+)
+
+// blockingStorage creates files whose syncs block until unblocked.
+type blockingStorage struct {
+	Storage
+	unblock chan struct{}
+}
+
+func (fs *blockingStorage) Create(name string) (File, error) {
+	f, err := fs.Storage.Create(name)
+	if err != nil {
+		return nil, err
+	}
+	return &blockingFile{File: f, unblock: fs.unblock}, nil
+}
+
+type blockingFile struct {
+	File
+	unblock chan struct{}
+}
+
+func (f *blockingFile) Sync() error {
+	<-f.unblock
+	return f.File.Sync()
+}
+
+func TestDiskHealthChecks(t *testing.T) {
+	type event struct {
+		kind string
+		name string
+		op   string
+	}
+	var mu sync.Mutex
+	var events []event
+	record := func(kind string) func(name, op string, d time.Duration) {
+		return func(name, op string, d time.Duration) {
+			mu.Lock()
+			events = append(events, event{kind, name, op})
+			mu.Unlock()
+		}
+	}
+	numEvents := func() int {
+		mu.Lock()
+		defer mu.Unlock()
+		return len(events)
+	}
+
+	unblock := make(chan struct{})
+	fs := WithDiskHealthChecks(&blockingStorage{Storage: NewMem(), unblock: unblock}, DiskHealthOptions{
+		SlowThreshold: 10 * time.Millisecond,
+		OnSlow:        record("slow"),
+		StallTimeout:  50 * time.Millisecond,
+		OnStall:       record("stall"),
+	})
+	f, err := fs.Create("foo")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// A fast operation is not reported.
+	if _, err := f.Write([]byte("foo")); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(20 * time.Millisecond)
+	if n := numEvents(); n != 0 {
+		t.Fatalf("expected no events, but found %d", n)
+	}
+
+	// A sync which does not complete is reported as slow and then stalled
+	// while it is in progress.
+	done := make(chan error)
+	go func() {
+		done <- f.Sync()
+	}()
+	deadline := time.Now().Add(10 * time.Second)
+	for numEvents() < 2 {
+		if time.Now().After(deadline) {
+			t.Fatal("timed out waiting for events")
+		}
+		time.Sleep(time.Millisecond)
+	}
+	close(unblock)
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+	if err := f.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// The completion of the sync is not reported again.
+	expected := []event{
+		{"slow", "foo", "sync"},
+		{"stall", "foo", "sync"},
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	if len(events) != len(expected) {
+		t.Fatalf("expected %v, but found %v", expected, events)
+	}
+	for i := range expected {
+		if events[i] != expected[i] {
+			t.Fatalf("expected %v, but found %v", expected, events)
+		}
+	}
+}
+
+func TestDiskHealthChecksClose(t *testing.T) {
+	fs := WithDiskHealthChecks(NewMem(), DiskHealthOptions{
+		SlowThreshold: time.Second,
+	}).(*diskHealthFS)
+	running := func() bool {
+		fs.mu.Lock()
+		defer fs.mu.Unlock()
+		return fs.mu.stopper != nil
+	}
+
+	// The files share a single monitor goroutine, which stops once they have
+	// all been closed.
+	var files []File
+	for _, name := range []string{"a", "b"} {
+		f, err := fs.Create(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		files = append(files, f)
+	}
+	if !running() {
+		t.Fatal("expected the monitor to be running")
+	}
+	files[0].Close()
+	if !running() {
+		t.Fatal("expected the monitor to be running")
+	}
+	// Closing a file twice does not panic or stop the monitor of the other
+	// files.
+	files[0].Close()
+	if !running() {
+		t.Fatal("expected the monitor to be running")
+	}
+	files[1].Close()
+	if running() {
+		t.Fatal("expected the monitor to be stopped")
+	}
+
+	// The monitor is restarted when a file is created.
+	f, err := fs.Create("c")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !running() {
+		t.Fatal("expected the monitor to be running")
+	}
+	f.Close()
+}
@@ -0,0 +1,435 @@
+// Copyright 2018 The LevelDB-Go and Pebble Authors. All rights reserved. Use
+// of this source code is governed by a BSD-style license that can be found in
+// the LICENSE file.
+
+package storage
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+)
+
+const (
+	// encryptedFileMagic is the magic number at the start of the header of an
+	// encrypted file.
+	encryptedFileMagic = "pebbleEF"
+
+	// encryptedHeaderLen is the length of the header of an encrypted file:
+	//
+	//	[magic (8 bytes)][key ID (8 bytes)][IV (16 bytes)]
+	//
+	// The encrypted contents of the file follow the header.
+	encryptedHeaderLen = 8 + 8 + aes.BlockSize
+
+	// keyRegistryMagic is the magic number at the start of a key registry.
+	keyRegistryMagic = "pebbleKR"
+
+	// encryptionKeyLen is the length of the data keys used to encrypt files,
+	// which are AES-256 keys.
+	encryptionKeyLen = 32
+
+	// keyRegistryEntryLen is the length of an entry in the key registry:
+	//
+	//	[key ID (8 bytes)][IV (16 bytes)][encrypted key (32 bytes)][encrypted checksum (4 bytes)]
+	keyRegistryEntryLen = 8 + aes.BlockSize + encryptionKeyLen + 4
+)
+
+var crcTable = crc32.MakeTable(crc32.Castagnoli)
+
+// EncryptedStorage is a Storage which encrypts the contents of the files
+// stored in an underlying Storage using AES-CTR. Each file is encrypted with
+// one of a set of data keys and a random IV, both of which are recorded in a
+// header at the start of the file. CTR mode allows any offset of a file to be
+// decrypted independently, so reads remain random access.
+//
+// The data keys are stored in a key registry file, encrypted with a master
+// key supplied by the caller. New files are encrypted with the active data
+// key. RotateKey adds a new data key to the registry and makes it the active
+// key; existing files continue to be readable with the key they were written
+// with.
+//
+// The names of files and directories are not encrypted. Lock files are passed
+// through to the underlying Storage.
+type EncryptedStorage struct {
+	Storage
+	registry string
+	master   cipher.Block
+
+	mu struct {
+		sync.Mutex
+		// keys maps the IDs of the data keys in the registry to the keys.
+		keys   map[uint64][]byte
+		blocks map[uint64]cipher.Block
+		active uint64
+	}
+}
+
+// NewEncrypted returns a Storage which encrypts the files stored in fs. The
+// data keys are stored in the key registry file with the specified name in
+// fs, encrypted with masterKey, which must be a 16, 24 or 32 byte AES key. If
+// the registry does not exist it is created containing a single data key.
+func NewEncrypted(fs Storage, registry string, masterKey []byte) (*EncryptedStorage, error) {
+	master, err := aes.NewCipher(masterKey)
+	if err != nil {
+		return nil, err
+	}
+	e := &EncryptedStorage{
+		Storage:  fs,
+		registry: registry,
+		master:   master,
+	}
+	e.mu.keys = make(map[uint64][]byte)
+	e.mu.blocks = make(map[uint64]cipher.Block)
+
+	if _, err := fs.Stat(registry); os.IsNotExist(err) {
+		if err := e.RotateKey(); err != nil {
+			return nil, err
+		}
+		return e, nil
+	} else if err != nil {
+		return nil, err
+	}
+	if err := e.loadRegistry(); err != nil {
+		return nil, err
+	}
+	return e, nil
+}
+
+// ActiveKeyID returns the ID of the data key used to encrypt new files.
+func (e *EncryptedStorage) ActiveKeyID() uint64 {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	return e.mu.active
+}
+
+// RotateKey generates a new data key, durably adds it to the key registry and
+// makes it the key used to encrypt new files.
+func (e *EncryptedStorage) RotateKey() error {
+	key := make([]byte, encryptionKeyLen)
+	if _, err := io.ReadFull(rand.Reader, key); err != nil {
+		return err
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return err
+	}
+
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	id := e.mu.active + 1
+	for existing := range e.mu.keys {
+		if existing >= id {
+			id = existing + 1
+		}
+	}
+	keys := make(map[uint64][]byte, len(e.mu.keys)+1)
+	for existing, k := range e.mu.keys {
+		keys[existing] = k
+	}
+	keys[id] = key
+	if err := e.writeRegistry(keys, id); err != nil {
+		return err
+	}
+	e.mu.keys = keys
+	e.mu.blocks[id] = block
+	e.mu.active = id
+	return nil
+}
+
+// loadRegistry reads the data keys from the key registry.
+func (e *EncryptedStorage) loadRegistry() error {
+	f, err := e.Storage.Open(e.registry)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	data, err := ioutil.ReadAll(f)
+	if err != nil {
+		return err
+	}
+
+	corrupt := fmt.Errorf("pebble/storage: corrupt key registry %q", e.registry)
+	if len(data) < len(keyRegistryMagic)+8+4+4 || string(data[:len(keyRegistryMagic)]) != keyRegistryMagic {
+		return corrupt
+	}
+	body, sum := data[:len(data)-4], binary.LittleEndian.Uint32(data[len(data)-4:])
+	if crc32.Checksum(body, crcTable) != sum {
+		return corrupt
+	}
+	body = body[len(keyRegistryMagic):]
+	active := binary.LittleEndian.Uint64(body)
+	n := binary.LittleEndian.Uint32(body[8:])
+	body = body[12:]
+	if uint64(len(body)) != uint64(n)*keyRegistryEntryLen {
+		return corrupt
+	}
+
+	for ; len(body) > 0; body = body[keyRegistryEntryLen:] {
+		id := binary.LittleEndian.Uint64(body)
+		iv := body[8 : 8+aes.BlockSize]
+		plain := make([]byte, encryptionKeyLen+4)
+		cipher.NewCTR(e.master, iv).XORKeyStream(plain, body[8+aes.BlockSize:keyRegistryEntryLen])
+		key := plain[:encryptionKeyLen]
+		if crc32.Checksum(key, crcTable) != binary.LittleEndian.Uint32(plain[encryptionKeyLen:]) {
+			return fmt.Errorf("pebble/storage: key registry %q: incorrect master key", e.registry)
+		}
+		block, err := aes.NewCipher(key)
+		if err != nil {
+			return err
+		}
+		e.mu.keys[id] = key
+		e.mu.blocks[id] = block
+	}
+	if _, ok := e.mu.keys[active]; !ok {
+		return corrupt
+	}
+	e.mu.active = active
+	return nil
+}
+
+// writeRegistry atomically replaces the key registry with one containing the
+// specified data keys.
+func (e *EncryptedStorage) writeRegistry(keys map[uint64][]byte, active uint64) error {
+	ids := make([]uint64, 0, len(keys))
+	for id := range keys {
+		ids = append(ids, id)
+	}
+	sort.Slice(ids, func(i, j int) bool { return ids[i] < ids[j] })
+
+	buf := make([]byte, 0, len(keyRegistryMagic)+12+len(ids)*keyRegistryEntryLen+4)
+	buf = append(buf, keyRegistryMagic...)
+	var tmp [8]byte
+	binary.LittleEndian.PutUint64(tmp[:], active)
+	buf = append(buf, tmp[:8]...)
+	binary.LittleEndian.PutUint32(tmp[:], uint32(len(ids)))
+	buf = append(buf, tmp[:4]...)
+	for _, id := range ids {
+		key := keys[id]
+		iv := make([]byte, aes.BlockSize)
+		if _, err := io.ReadFull(rand.Reader, iv); err != nil {
+			return err
+		}
+		plain := make([]byte, encryptionKeyLen+4)
+		copy(plain, key)
+		binary.LittleEndian.PutUint32(plain[encryptionKeyLen:], crc32.Checksum(key, crcTable))
+		cipher.NewCTR(e.master, iv).XORKeyStream(plain, plain)
+
+		binary.LittleEndian.PutUint64(tmp[:], id)
+		buf = append(buf, tmp[:8]...)
+		buf = append(buf, iv...)
+		buf = append(buf, plain...)
+	}
+	binary.LittleEndian.PutUint32(tmp[:], crc32.Checksum(buf, crcTable))
+	buf = append(buf, tmp[:4]...)
+
+	tmpName := e.registry + ".tmp"
+	f, err := e.Storage.Create(tmpName)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(buf); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	if err := e.Storage.Rename(tmpName, e.registry); err != nil {
+		return err
+	}
+	dirname := filepath.Dir(e.registry)
+	if dirname == "." {
+		dirname = ""
+	}
+	dir, err := e.Storage.OpenDir(dirname)
+	if err != nil {
+		return err
+	}
+	if err := dir.Sync(); err != nil {
+		dir.Close()
+		return err
+	}
+	return dir.Close()
+}
+
+// Create implements Storage.Create. The file is encrypted with the active
+// data key.
+func (e *EncryptedStorage) Create(name string) (File, error) {
+	f, err := e.Storage.Create(name)
+	if err != nil {
+		return nil, err
+	}
+	return e.newFile(f)
+}
+
+// ReuseForWrite implements Storage.ReuseForWrite. The file is encrypted with
+// the active data key and a new IV, so the keystream used for its previous
+// contents is never reused, and those contents decrypt to garbage.
+func (e *EncryptedStorage) ReuseForWrite(oldname, newname string) (File, error) {
+	f, err := e.Storage.ReuseForWrite(oldname, newname)
+	if err != nil {
+		return nil, err
+	}
+	return e.newFile(f)
+}
+
+// newFile writes the encryption header of a file opened for writing.
+func (e *EncryptedStorage) newFile(f File) (File, error) {
+	var iv [aes.BlockSize]byte
+	if _, err := io.ReadFull(rand.Reader, iv[:]); err != nil {
+		f.Close()
+		return nil, err
+	}
+	e.mu.Lock()
+	id := e.mu.active
+	block := e.mu.blocks[id]
+	e.mu.Unlock()
+
+	var hdr [encryptedHeaderLen]byte
+	copy(hdr[:], encryptedFileMagic)
+	binary.LittleEndian.PutUint64(hdr[8:], id)
+	copy(hdr[16:], iv[:])
+	if _, err := f.Write(hdr[:]); err != nil {
+		f.Close()
+		return nil, err
+	}
+	return &encryptedFile{f: f, block: block, iv: iv}, nil
+}
+
+// Open implements Storage.Open.
+func (e *EncryptedStorage) Open(name string) (File, error) {
+	f, err := e.Storage.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	var hdr [encryptedHeaderLen]byte
+	if n, _ := f.ReadAt(hdr[:], 0); n != len(hdr) || string(hdr[:8]) != encryptedFileMagic {
+		f.Close()
+		return nil, fmt.Errorf("pebble/storage: %q is not an encrypted file", name)
+	}
+	id := binary.LittleEndian.Uint64(hdr[8:])
+	e.mu.Lock()
+	block := e.mu.blocks[id]
+	e.mu.Unlock()
+	if block == nil {
+		f.Close()
+		return nil, fmt.Errorf("pebble/storage: %q is encrypted with unknown key %d", name, id)
+	}
+	ef := &encryptedFile{f: f, block: block}
+	copy(ef.iv[:], hdr[16:])
+	return ef, nil
+}
+
+// Stat implements Storage.Stat. The size of a file excludes its encryption
+// header.
+func (e *EncryptedStorage) Stat(name string) (os.FileInfo, error) {
+	info, err := e.Storage.Stat(name)
+	if err != nil {
+		return nil, err
+	}
+	return encryptedFileInfo{info}, nil
+}
+
+// xorKeyStreamAt XORs src with the AES-CTR key stream for the specified IV,
+// starting at offset bytes into the key stream, and stores the result in dst.
+func xorKeyStreamAt(block cipher.Block, iv *[aes.BlockSize]byte, dst, src []byte, offset int64) {
+	// Add the number of blocks preceding offset to the big-endian counter.
+	ctr := *iv
+	n := uint64(offset) / aes.BlockSize
+	for i := aes.BlockSize - 1; i >= 0 && n > 0; i-- {
+		sum := uint64(ctr[i]) + n&0xff
+		ctr[i] = byte(sum)
+		n = n>>8 + sum>>8
+	}
+	stream := cipher.NewCTR(block, ctr[:])
+	if skip := int(offset % aes.BlockSize); skip > 0 {
+		var discard [aes.BlockSize]byte
+		stream.XORKeyStream(discard[:skip], discard[:skip])
+	}
+	stream.XORKeyStream(dst, src)
+}
+
+// encryptedFile is a File whose contents are encrypted with AES-CTR. Offsets
+// are relative to the end of the encryption header.
+type encryptedFile struct {
+	f     File
+	block cipher.Block
+	iv    [aes.BlockSize]byte
+	rpos  int64
+	wpos  int64
+	buf   []byte
+}
+
+func (f *encryptedFile) Close() error {
+	return f.f.Close()
+}
+
+func (f *encryptedFile) Read(p []byte) (int, error) {
+	n, err := f.ReadAt(p, f.rpos)
+	f.rpos += int64(n)
+	if n > 0 && err == io.EOF {
+		err = nil
+	}
+	return n, err
+}
+
+func (f *encryptedFile) ReadAt(p []byte, off int64) (int, error) {
+	if off < 0 {
+		return 0, errors.New("pebble/storage: negative offset")
+	}
+	n, err := f.f.ReadAt(p, off+encryptedHeaderLen)
+	xorKeyStreamAt(f.block, &f.iv, p[:n], p[:n], off)
+	return n, err
+}
+
+func (f *encryptedFile) Write(p []byte) (int, error) {
+	if cap(f.buf) < len(p) {
+		f.buf = make([]byte, len(p))
+	}
+	buf := f.buf[:len(p)]
+	xorKeyStreamAt(f.block, &f.iv, buf, p, f.wpos)
+	n, err := f.f.Write(buf)
+	f.wpos += int64(n)
+	return n, err
+}
+
+func (f *encryptedFile) Stat() (os.FileInfo, error) {
+	info, err := f.f.Stat()
+	if err != nil {
+		return nil, err
+	}
+	return encryptedFileInfo{info}, nil
+}
+
+func (f *encryptedFile) Sync() error {
+	return f.f.Sync()
+}
+
+// encryptedFileInfo adjusts the size of a file to exclude the encryption
+// header.
+type encryptedFileInfo struct {
+	os.FileInfo
+}
+
+func (info encryptedFileInfo) Size() int64 {
+	size := info.FileInfo.Size()
+	if info.IsDir() || size < encryptedHeaderLen {
+		return size
+	}
+	return size - encryptedHeaderLen
+}
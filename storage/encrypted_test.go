@@ -0,0 +1,162 @@
+// Copyright 2018 The LevelDB-Go and Pebble Authors. All rights reserved. Use
+// of this source code is governed by a BSD-style license that can be found in
+// the LICENSE file.
+
+package storage
+
+import (
+	"bytes"
+	"io/ioutil"
+	"math/rand"
+	"testing"
+)
+
+func TestEncrypted(t *testing.T) {
+	mem := NewMem()
+	masterKey := bytes.Repeat([]byte("k"), 32)
+	fs, err := NewEncrypted(mem, "KEYS", masterKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rng := rand.New(rand.NewSource(1))
+	data := make([]byte, 10000)
+	rng.Read(data)
+
+	f, err := fs.Create("foo")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Write the data in pieces which are not aligned to the AES block size.
+	for b := data; len(b) > 0; {
+		n := 1 + rng.Intn(100)
+		if n > len(b) {
+			n = len(b)
+		}
+		if _, err := f.Write(b[:n]); err != nil {
+			t.Fatal(err)
+		}
+		b = b[n:]
+	}
+	if err := f.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// The underlying file contains the header followed by the ciphertext.
+	raw, err := mem.Open("foo")
+	if err != nil {
+		t.Fatal(err)
+	}
+	rawData, err := ioutil.ReadAll(raw)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(rawData) != encryptedHeaderLen+len(data) {
+		t.Fatalf("expected %d bytes, but found %d", encryptedHeaderLen+len(data), len(rawData))
+	}
+	if bytes.Contains(rawData, data[:64]) {
+		t.Fatal("expected the file contents to be encrypted")
+	}
+
+	if info, err := fs.Stat("foo"); err != nil {
+		t.Fatal(err)
+	} else if info.Size() != int64(len(data)) {
+		t.Fatalf("expected size %d, but found %d", len(data), info.Size())
+	}
+
+	f, err = fs.Open("foo")
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := ioutil.ReadAll(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(data, got) {
+		t.Fatal("data read does not match data written")
+	}
+	for i := 0; i < 100; i++ {
+		off := rng.Intn(len(data))
+		n := rng.Intn(len(data) - off + 1)
+		buf := make([]byte, n)
+		if _, err := f.ReadAt(buf, int64(off)); err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(data[off:off+n], buf) {
+			t.Fatalf("ReadAt(%d, %d): data does not match", off, n)
+		}
+	}
+	if err := f.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := mem.Create("plain"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := fs.Open("plain"); err == nil {
+		t.Fatal("expected error opening unencrypted file")
+	}
+}
+
+func TestEncryptedKeyRotation(t *testing.T) {
+	mem := NewMem()
+	masterKey := bytes.Repeat([]byte("k"), 16)
+	fs, err := NewEncrypted(mem, "KEYS", masterKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	writeFile := func(fs Storage, name string) {
+		f, err := fs.Create(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := f.Write([]byte(name)); err != nil {
+			t.Fatal(err)
+		}
+		if err := f.Close(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	readFile := func(fs Storage, name string) {
+		f, err := fs.Open(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer f.Close()
+		data, err := ioutil.ReadAll(f)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(data) != name {
+			t.Fatalf("expected %q, but found %q", name, data)
+		}
+	}
+
+	writeFile(fs, "a")
+	if id := fs.ActiveKeyID(); id != 1 {
+		t.Fatalf("expected key 1, but found %d", id)
+	}
+	if err := fs.RotateKey(); err != nil {
+		t.Fatal(err)
+	}
+	if id := fs.ActiveKeyID(); id != 2 {
+		t.Fatalf("expected key 2, but found %d", id)
+	}
+	writeFile(fs, "b")
+
+	// Files written with both keys are readable after reloading the registry.
+	fs, err = NewEncrypted(mem, "KEYS", masterKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if id := fs.ActiveKeyID(); id != 2 {
+		t.Fatalf("expected key 2, but found %d", id)
+	}
+	readFile(fs, "a")
+	readFile(fs, "b")
+
+	if _, err := NewEncrypted(mem, "KEYS", bytes.Repeat([]byte("x"), 16)); err == nil {
+		t.Fatal("expected error loading the registry with the wrong master key")
+	}
+}
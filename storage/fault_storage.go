@@ -0,0 +1,494 @@
+// Copyright 2018 The LevelDB-Go and Pebble Authors. All rights reserved. Use
+// of this source code is governed by a BSD-style license that can be found in
+// the LICENSE file.
+
+package storage
+
+import (
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+)
+
+// FaultOp identifies an operation performed through a FaultStorage, for the
+// purpose of error injection.
+type FaultOp int
+
+// The operations which are passed to a FaultInjector.
+const (
+	FaultCreate FaultOp = iota
+	FaultLink
+	FaultOpen
+	FaultOpenDir
+	FaultRemove
+	FaultRename
+	FaultMkdirAll
+	FaultList
+	FaultStat
+	FaultRead
+	FaultWrite
+	FaultSync
+	FaultReuseForWrite
+)
+
+var faultOpNames = [...]string{
+	FaultCreate:   "create",
+	FaultLink:     "link",
+	FaultOpen:     "open",
+	FaultOpenDir:  "open-dir",
+	FaultRemove:   "remove",
+	FaultRename:   "rename",
+	FaultMkdirAll: "mkdir-all",
+	FaultList:     "list",
+	FaultStat:     "stat",
+	FaultRead:     "read",
+	FaultWrite:    "write",
+	FaultSync:     "sync",
+
+	FaultReuseForWrite: "reuse-for-write",
+}
+
+func (op FaultOp) String() string {
+	if op < 0 || int(op) >= len(faultOpNames) {
+		return "unknown"
+	}
+	return faultOpNames[op]
+}
+
+// ErrInjected is an error which may be returned by a FaultInjector.
+var ErrInjected = errors.New("pebble/storage: injected error")
+
+// A FaultInjector is called before each operation performed through a
+// FaultStorage with the operation and the name of the file or directory it
+// applies to (for a rename or link, the new name). A non-nil return value
+// fails the operation with that error. The injector is not called while any
+// lock internal to the FaultStorage is held, so it may call Crash.
+type FaultInjector func(op FaultOp, name string) error
+
+// FaultStorage is a memory-backed Storage for testing the handling of I/O
+// errors and crashes. It tracks the data written to each file which has not
+// been synced, and the creations, links and renames within each directory
+// which have not been made durable by syncing the directory. Crash returns
+// the state the storage would be left in by a crash, and SetInjector
+// configures the operations which fail.
+//
+// Removals are treated as durable as soon as they are performed.
+type FaultStorage struct {
+	mem *memStorage
+
+	mu struct {
+		sync.Mutex
+		// files maps the canonical names of the files written through the
+		// storage to their state. Files which are not present have no unsynced
+		// data.
+		files map[string]*faultFileState
+		// ops holds the directory operations which have not been synced, in
+		// the order they were performed.
+		ops      []faultDirOp
+		injector FaultInjector
+	}
+}
+
+type faultFileState struct {
+	size   int64
+	synced int64
+	// base holds the durable contents of a file opened by ReuseForWrite when
+	// it was opened. A crash reverts the data beyond synced to base.
+	base []byte
+}
+
+type faultDirOpKind int
+
+const (
+	faultDirOpCreate faultDirOpKind = iota
+	faultDirOpLink
+	faultDirOpRename
+)
+
+type faultDirOp struct {
+	kind faultDirOpKind
+	// dir is the cleaned name of the directory containing name.
+	dir  string
+	name string
+	// oldname is the source of a rename.
+	oldname string
+	// replaced holds the durable contents of the file overwritten by a
+	// rename, or nil if the rename did not overwrite a file.
+	replaced []byte
+}
+
+// NewFaultMem returns a new, empty, memory-backed FaultStorage.
+func NewFaultMem() *FaultStorage {
+	return newFaultStorage(NewMem().(*memStorage))
+}
+
+func newFaultStorage(mem *memStorage) *FaultStorage {
+	fs := &FaultStorage{mem: mem}
+	fs.mu.files = make(map[string]*faultFileState)
+	return fs
+}
+
+// SetInjector sets the function consulted before each operation to determine
+// whether the operation fails. A nil injector disables error injection.
+func (fs *FaultStorage) SetInjector(injector FaultInjector) {
+	fs.mu.Lock()
+	fs.mu.injector = injector
+	fs.mu.Unlock()
+}
+
+func (fs *FaultStorage) inject(op FaultOp, name string) error {
+	fs.mu.Lock()
+	injector := fs.mu.injector
+	fs.mu.Unlock()
+	if injector == nil {
+		return nil
+	}
+	return injector(op, name)
+}
+
+// Crash returns a new FaultStorage holding the durable state of fs: the data
+// which has not been synced is discarded from every file, and the creations,
+// links and renames which have not been synced are undone. fs itself is
+// unchanged, so a crash may be simulated in the middle of an operation by
+// calling Crash from a FaultInjector, and the process using fs may continue
+// to run.
+func (fs *FaultStorage) Crash() *FaultStorage {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	fs.mem.mu.Lock()
+	clone := &memStorage{root: cloneNode(fs.mem.root, make(map[*node]*node))}
+	fs.mem.mu.Unlock()
+
+	for name, state := range fs.mu.files {
+		if state.synced >= state.size {
+			continue
+		}
+		_ = clone.walk(name, func(dir *node, frag string, final bool) error {
+			if final {
+				if n := dir.children[frag]; n != nil && int64(len(n.data)) > state.synced {
+					n.data = n.data[:state.synced]
+					if int64(len(state.base)) > state.synced {
+						n.data = append(n.data, state.base[state.synced:]...)
+					}
+				}
+			}
+			return nil
+		})
+	}
+
+	// Undo the unsynced directory operations, most recent first. An operation
+	// may not be undoable if a later operation removed the file it applied to,
+	// in which case it is skipped.
+	for i := len(fs.mu.ops) - 1; i >= 0; i-- {
+		op := &fs.mu.ops[i]
+		switch op.kind {
+		case faultDirOpCreate, faultDirOpLink:
+			_ = clone.Remove(op.name)
+		case faultDirOpRename:
+			if err := clone.Rename(op.name, op.oldname); err != nil {
+				continue
+			}
+			if op.replaced != nil {
+				if f, err := clone.Create(op.name); err == nil {
+					_, _ = f.Write(op.replaced)
+					_ = f.Close()
+				}
+			}
+		}
+	}
+	return newFaultStorage(clone)
+}
+
+func cloneNode(n *node, cloned map[*node]*node) *node {
+	if c := cloned[n]; c != nil {
+		// Hard links share a node.
+		return c
+	}
+	c := &node{
+		name:    n.name,
+		modTime: n.modTime,
+		isDir:   n.isDir,
+	}
+	cloned[n] = c
+	if n.isDir {
+		c.children = make(map[string]*node, len(n.children))
+		for name, child := range n.children {
+			c.children[name] = cloneNode(child, cloned)
+		}
+	} else {
+		c.data = append([]byte(nil), n.data...)
+	}
+	return c
+}
+
+// durableContentsLocked returns the durable contents of the named file, or
+// nil if the file does not exist. fs.mu must be held.
+func (fs *FaultStorage) durableContentsLocked(name string) []byte {
+	f, err := fs.mem.Open(name)
+	if err != nil {
+		return nil
+	}
+	data := f.(*file).n.data
+	if state := fs.mu.files[faultClean(name)]; state != nil && state.synced < int64(len(data)) {
+		data = data[:state.synced]
+	}
+	return append([]byte{}, data...)
+}
+
+// faultClean returns the canonical form of a name. As with memStorage, names
+// are relative to the root directory whether or not they begin with a
+// separator.
+func faultClean(name string) string {
+	return filepath.Clean(strings.TrimLeft(name, sep))
+}
+
+// faultDir returns the canonical name of the directory containing name.
+func faultDir(name string) string {
+	return filepath.Dir(faultClean(name))
+}
+
+// Create implements Storage.Create.
+func (fs *FaultStorage) Create(name string) (File, error) {
+	if err := fs.inject(FaultCreate, name); err != nil {
+		return nil, err
+	}
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	_, statErr := fs.mem.Stat(name)
+	f, err := fs.mem.Create(name)
+	if err != nil {
+		return nil, err
+	}
+	if statErr != nil {
+		fs.mu.ops = append(fs.mu.ops, faultDirOp{
+			kind: faultDirOpCreate,
+			dir:  faultDir(name),
+			name: name,
+		})
+	}
+	state := &faultFileState{}
+	fs.mu.files[faultClean(name)] = state
+	return &faultFile{fs: fs, f: f, name: name, state: state}, nil
+}
+
+// ReuseForWrite implements Storage.ReuseForWrite. The rename is undone by a
+// crash until the directory is synced, and the overwritten data of the file
+// is restored by a crash until the file is synced.
+func (fs *FaultStorage) ReuseForWrite(oldname, newname string) (File, error) {
+	if err := fs.inject(FaultReuseForWrite, newname); err != nil {
+		return nil, err
+	}
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	replaced := fs.durableContentsLocked(newname)
+	base := fs.durableContentsLocked(oldname)
+	f, err := fs.mem.ReuseForWrite(oldname, newname)
+	if err != nil {
+		return nil, err
+	}
+	fs.mu.ops = append(fs.mu.ops, faultDirOp{
+		kind:     faultDirOpRename,
+		dir:      faultDir(newname),
+		name:     newname,
+		oldname:  oldname,
+		replaced: replaced,
+	})
+	delete(fs.mu.files, faultClean(oldname))
+	state := &faultFileState{base: base}
+	fs.mu.files[faultClean(newname)] = state
+	return &faultFile{fs: fs, f: f, name: newname, state: state}, nil
+}
+
+// Link implements Storage.Link.
+func (fs *FaultStorage) Link(oldname, newname string) error {
+	if err := fs.inject(FaultLink, newname); err != nil {
+		return err
+	}
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	if err := fs.mem.Link(oldname, newname); err != nil {
+		return err
+	}
+	fs.mu.ops = append(fs.mu.ops, faultDirOp{
+		kind: faultDirOpLink,
+		dir:  faultDir(newname),
+		name: newname,
+	})
+	if state := fs.mu.files[faultClean(oldname)]; state != nil {
+		fs.mu.files[faultClean(newname)] = state
+	} else {
+		delete(fs.mu.files, faultClean(newname))
+	}
+	return nil
+}
+
+// Open implements Storage.Open.
+func (fs *FaultStorage) Open(name string) (File, error) {
+	if err := fs.inject(FaultOpen, name); err != nil {
+		return nil, err
+	}
+	f, err := fs.mem.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	return &faultFile{fs: fs, f: f, name: name}, nil
+}
+
+// OpenDir implements Storage.OpenDir. Syncing the returned File makes the
+// unsynced operations on the entries of the directory durable.
+func (fs *FaultStorage) OpenDir(name string) (File, error) {
+	if err := fs.inject(FaultOpenDir, name); err != nil {
+		return nil, err
+	}
+	f, err := fs.mem.OpenDir(name)
+	if err != nil {
+		return nil, err
+	}
+	return &faultFile{fs: fs, f: f, name: name, dir: true}, nil
+}
+
+// Remove implements Storage.Remove.
+func (fs *FaultStorage) Remove(name string) error {
+	if err := fs.inject(FaultRemove, name); err != nil {
+		return err
+	}
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	if err := fs.mem.Remove(name); err != nil {
+		return err
+	}
+	delete(fs.mu.files, faultClean(name))
+	return nil
+}
+
+// Rename implements Storage.Rename.
+func (fs *FaultStorage) Rename(oldname, newname string) error {
+	if err := fs.inject(FaultRename, newname); err != nil {
+		return err
+	}
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	replaced := fs.durableContentsLocked(newname)
+	if err := fs.mem.Rename(oldname, newname); err != nil {
+		return err
+	}
+	fs.mu.ops = append(fs.mu.ops, faultDirOp{
+		kind:     faultDirOpRename,
+		dir:      faultDir(newname),
+		name:     newname,
+		oldname:  oldname,
+		replaced: replaced,
+	})
+	if state := fs.mu.files[faultClean(oldname)]; state != nil {
+		fs.mu.files[faultClean(newname)] = state
+	} else {
+		delete(fs.mu.files, faultClean(newname))
+	}
+	delete(fs.mu.files, faultClean(oldname))
+	return nil
+}
+
+// MkdirAll implements Storage.MkdirAll. The creation of directories is
+// durable as soon as it is performed.
+func (fs *FaultStorage) MkdirAll(dir string, perm os.FileMode) error {
+	if err := fs.inject(FaultMkdirAll, dir); err != nil {
+		return err
+	}
+	return fs.mem.MkdirAll(dir, perm)
+}
+
+// Lock implements Storage.Lock.
+func (fs *FaultStorage) Lock(name string) (io.Closer, error) {
+	return fs.mem.Lock(name)
+}
+
+// List implements Storage.List.
+func (fs *FaultStorage) List(dir string) ([]string, error) {
+	if err := fs.inject(FaultList, dir); err != nil {
+		return nil, err
+	}
+	return fs.mem.List(dir)
+}
+
+// Stat implements Storage.Stat.
+func (fs *FaultStorage) Stat(name string) (os.FileInfo, error) {
+	if err := fs.inject(FaultStat, name); err != nil {
+		return nil, err
+	}
+	return fs.mem.Stat(name)
+}
+
+// faultFile is a File opened through a FaultStorage.
+type faultFile struct {
+	fs   *FaultStorage
+	f    File
+	name string
+	// state is the state of a file opened for writing, and nil otherwise.
+	state *faultFileState
+	// dir is true if the file is a directory opened by OpenDir.
+	dir bool
+}
+
+func (f *faultFile) Close() error {
+	return f.f.Close()
+}
+
+func (f *faultFile) Read(p []byte) (int, error) {
+	if err := f.fs.inject(FaultRead, f.name); err != nil {
+		return 0, err
+	}
+	return f.f.Read(p)
+}
+
+func (f *faultFile) ReadAt(p []byte, off int64) (int, error) {
+	if err := f.fs.inject(FaultRead, f.name); err != nil {
+		return 0, err
+	}
+	return f.f.ReadAt(p, off)
+}
+
+func (f *faultFile) Write(p []byte) (int, error) {
+	if err := f.fs.inject(FaultWrite, f.name); err != nil {
+		return 0, err
+	}
+	f.fs.mu.Lock()
+	defer f.fs.mu.Unlock()
+	n, err := f.f.Write(p)
+	if f.state != nil {
+		f.state.size += int64(n)
+	}
+	return n, err
+}
+
+func (f *faultFile) Stat() (os.FileInfo, error) {
+	return f.f.Stat()
+}
+
+func (f *faultFile) Sync() error {
+	if err := f.fs.inject(FaultSync, f.name); err != nil {
+		return err
+	}
+	f.fs.mu.Lock()
+	defer f.fs.mu.Unlock()
+	if err := f.f.Sync(); err != nil {
+		return err
+	}
+	if f.state != nil {
+		f.state.synced = f.state.size
+	}
+	if f.dir {
+		dir := faultClean(f.name)
+		ops := f.fs.mu.ops[:0]
+		for _, op := range f.fs.mu.ops {
+			if op.dir != dir {
+				ops = append(ops, op)
+			}
+		}
+		f.fs.mu.ops = ops
+	}
+	return nil
+}
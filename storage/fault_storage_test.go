@@ -0,0 +1,240 @@
+// Copyright 2018 The LevelDB-Go and Pebble Authors. All rights reserved. Use
+// of this source code is governed by a BSD-style license that can be found in
+// the LICENSE file.
+
+package storage
+
+import (
+	"io/ioutil"
+	"os"
+	"sort"
+	"strings"
+	"testing"
+)
+
+func faultWriteFile(t *testing.T, fs Storage, name, data string, sync bool) {
+	f, err := fs.Create(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := f.Write([]byte(data)); err != nil {
+		t.Fatal(err)
+	}
+	if sync {
+		if err := f.Sync(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := f.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func faultReadFile(t *testing.T, fs Storage, name string) string {
+	f, err := fs.Open(name)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return "<missing>"
+		}
+		t.Fatal(err)
+	}
+	defer f.Close()
+	data, err := ioutil.ReadAll(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(data)
+}
+
+func faultSyncDir(t *testing.T, fs Storage, name string) {
+	d, err := fs.OpenDir(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := d.Sync(); err != nil {
+		t.Fatal(err)
+	}
+	if err := d.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestFaultStorageCrash(t *testing.T) {
+	fs := NewFaultMem()
+	if err := fs.MkdirAll("a", 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	// A file whose data and directory entry are both durable.
+	faultWriteFile(t, fs, "a/synced", "synced", true)
+	faultSyncDir(t, fs, "a")
+
+	// A file with a durable directory entry and partially durable data.
+	f, err := fs.Create("b")
+	if err != nil {
+		t.Fatal(err)
+	}
+	faultSyncDir(t, fs, "")
+	if _, err := f.Write([]byte("foo")); err != nil {
+		t.Fatal(err)
+	}
+	if err := f.Sync(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := f.Write([]byte("bar")); err != nil {
+		t.Fatal(err)
+	}
+
+	// An unsynced rename overwriting a durable file.
+	faultWriteFile(t, fs, "a/tmp", "new", true)
+	faultSyncDir(t, fs, "a")
+	faultWriteFile(t, fs, "a/current", "old", true)
+	faultSyncDir(t, fs, "a")
+	if err := fs.Rename("a/tmp", "a/current"); err != nil {
+		t.Fatal(err)
+	}
+
+	// A file whose data is durable, but whose directory entry is not.
+	faultWriteFile(t, fs, "a/unlinked", "unlinked", true)
+
+	// An unsynced link.
+	if err := fs.Link("a/synced", "a/link"); err != nil {
+		t.Fatal(err)
+	}
+
+	crashed := fs.Crash()
+
+	// The original storage is unaffected by the crash.
+	if got := faultReadFile(t, fs, "b"); got != "foobar" {
+		t.Fatalf("expected foobar, but found %q", got)
+	}
+	if got := faultReadFile(t, fs, "a/current"); got != "new" {
+		t.Fatalf("expected new, but found %q", got)
+	}
+
+	expected := map[string]string{
+		"a/synced":   "synced",
+		"a/unlinked": "<missing>",
+		"b":          "foo",
+		"a/tmp":      "new",
+		"a/current":  "old",
+		"a/link":     "<missing>",
+	}
+	for name, want := range expected {
+		if got := faultReadFile(t, crashed, name); got != want {
+			t.Errorf("%s: expected %q, but found %q", name, want, got)
+		}
+	}
+
+	names, err := crashed.List("a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	sort.Strings(names)
+	if got, want := strings.Join(names, ","), "current,synced,tmp"; got != want {
+		t.Fatalf("expected %s, but found %s", want, got)
+	}
+}
+
+func TestFaultStorageSyncDir(t *testing.T) {
+	fs := NewFaultMem()
+	if err := fs.MkdirAll("a", 0755); err != nil {
+		t.Fatal(err)
+	}
+	faultWriteFile(t, fs, "a/x", "x", true)
+	faultWriteFile(t, fs, "y", "y", true)
+
+	// Syncing a directory only makes the operations in that directory
+	// durable.
+	faultSyncDir(t, fs, "a")
+	crashed := fs.Crash()
+	if got := faultReadFile(t, crashed, "a/x"); got != "x" {
+		t.Fatalf("expected x, but found %q", got)
+	}
+	if got := faultReadFile(t, crashed, "y"); got != "<missing>" {
+		t.Fatalf("expected <missing>, but found %q", got)
+	}
+
+	// A crashed storage can itself be crashed.
+	faultWriteFile(t, crashed, "a/z", "z", false)
+	faultSyncDir(t, crashed, "a")
+	if got := faultReadFile(t, crashed.Crash(), "a/z"); got != "" {
+		t.Fatalf("expected empty file, but found %q", got)
+	}
+}
+
+func TestFaultStorageReuseForWrite(t *testing.T) {
+	fs := NewFaultMem()
+	faultWriteFile(t, fs, "old", "0123456789", true)
+	faultSyncDir(t, fs, "")
+
+	f, err := fs.ReuseForWrite("old", "new")
+	if err != nil {
+		t.Fatal(err)
+	}
+	faultSyncDir(t, fs, "")
+	if _, err := f.Write([]byte("abc")); err != nil {
+		t.Fatal(err)
+	}
+	if err := f.Sync(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := f.Write([]byte("def")); err != nil {
+		t.Fatal(err)
+	}
+
+	// The unsynced write reverts to the previous contents of the file.
+	if got := faultReadFile(t, fs, "new"); got != "abcdef6789" {
+		t.Fatalf("expected abcdef6789, but found %q", got)
+	}
+	crashed := fs.Crash()
+	if got := faultReadFile(t, crashed, "new"); got != "abc3456789" {
+		t.Fatalf("expected abc3456789, but found %q", got)
+	}
+	if got := faultReadFile(t, crashed, "old"); got != "<missing>" {
+		t.Fatalf("expected <missing>, but found %q", got)
+	}
+}
+
+func TestFaultStorageInjector(t *testing.T) {
+	fs := NewFaultMem()
+	var ops []string
+	fs.SetInjector(func(op FaultOp, name string) error {
+		ops = append(ops, op.String()+" "+name)
+		if op == FaultSync && name == "fail" {
+			return ErrInjected
+		}
+		return nil
+	})
+
+	faultWriteFile(t, fs, "ok", "ok", true)
+	f, err := fs.Create("fail")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := f.Write([]byte("data")); err != nil {
+		t.Fatal(err)
+	}
+	if err := f.Sync(); err != ErrInjected {
+		t.Fatalf("expected %v, but found %v", ErrInjected, err)
+	}
+	faultSyncDir(t, fs, "")
+
+	expected := "create ok,write ok,sync ok,create fail,write fail,sync fail,open-dir ,sync "
+	if got := strings.Join(ops, ","); got != expected {
+		t.Fatalf("expected\n%s\nbut found\n%s", expected, got)
+	}
+
+	// The failed sync did not make the data durable.
+	if got := faultReadFile(t, fs.Crash(), "fail"); got != "" {
+		t.Fatalf("expected empty file, but found %q", got)
+	}
+
+	fs.SetInjector(nil)
+	if err := f.Sync(); err != nil {
+		t.Fatal(err)
+	}
+	if got := faultReadFile(t, fs.Crash(), "fail"); got != "data" {
+		t.Fatalf("expected data, but found %q", got)
+	}
+}
@@ -131,6 +131,26 @@ func (y *memStorage) Create(fullname string) (File, error) {
 	return ret, nil
 }
 
+func (y *memStorage) ReuseForWrite(oldname, newname string) (File, error) {
+	if err := y.Rename(oldname, newname); err != nil {
+		return nil, err
+	}
+	var ret *file
+	err := y.walk(newname, func(dir *node, frag string, final bool) error {
+		if final {
+			ret = &file{
+				n:     dir.children[frag],
+				write: true,
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return ret, nil
+}
+
 func (y *memStorage) Link(oldname, newname string) error {
 	var n *node
 	err := y.walk(oldname, func(dir *node, frag string, final bool) error {
@@ -188,6 +208,37 @@ func (y *memStorage) Open(fullname string) (File, error) {
 	return ret, nil
 }
 
+func (y *memStorage) OpenDir(fullname string) (File, error) {
+	var ret *file
+	err := y.walk(fullname, func(dir *node, frag string, final bool) error {
+		if final {
+			n := dir
+			if frag != "" {
+				n = dir.children[frag]
+			}
+			if n == nil {
+				return &os.PathError{
+					Op:   "open",
+					Path: fullname,
+					Err:  os.ErrNotExist,
+				}
+			}
+			if !n.isDir {
+				return errors.New("pebble/storage: not a directory")
+			}
+			ret = &file{
+				n:    n,
+				read: true,
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return ret, nil
+}
+
 func (y *memStorage) Remove(fullname string) error {
 	return y.walk(fullname, func(dir *node, frag string, final bool) error {
 		if final {
@@ -361,6 +412,7 @@ func (f *node) dump(w *bytes.Buffer, level int) {
 type file struct {
 	n           *node
 	rpos        int
+	wpos        int
 	read, write bool
 }
 
@@ -404,7 +456,10 @@ func (f *file) Write(p []byte) (int, error) {
 		return 0, errors.New("pebble/storage: cannot write a directory")
 	}
 	f.n.modTime = time.Now()
-	f.n.data = append(f.n.data, p...)
+	// Overwrite the existing data of a file opened by ReuseForWrite.
+	n := copy(f.n.data[f.wpos:], p)
+	f.n.data = append(f.n.data, p[n:]...)
+	f.wpos += len(p)
 	return len(p), nil
 }
 
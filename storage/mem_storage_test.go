@@ -238,3 +238,42 @@ func TestList(t *testing.T) {
 		}
 	}
 }
+
+func TestMemReuseForWrite(t *testing.T) {
+	fs := NewMem()
+	f, err := fs.Create("a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := f.Write([]byte("0123456789")); err != nil {
+		t.Fatal(err)
+	}
+	if err := f.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// Writes overwrite the start of the reused file and extend it once they
+	// pass its end.
+	f, err = fs.ReuseForWrite("a", "b")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := f.Write([]byte("abc")); err != nil {
+		t.Fatal(err)
+	}
+	if got := faultReadFile(t, fs, "b"); got != "abc3456789" {
+		t.Fatalf("expected abc3456789, but found %q", got)
+	}
+	if _, err := f.Write([]byte("defghijk")); err != nil {
+		t.Fatal(err)
+	}
+	if err := f.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if got := faultReadFile(t, fs, "b"); got != "abcdefghijk" {
+		t.Fatalf("expected abcdefghijk, but found %q", got)
+	}
+	if _, err := fs.Stat("a"); !os.IsNotExist(err) {
+		t.Fatalf("expected a to not exist, but found %v", err)
+	}
+}
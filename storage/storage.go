@@ -31,12 +31,24 @@ type Storage interface {
 	// exists.
 	Create(name string) (File, error)
 
+	// ReuseForWrite renames oldname to newname and opens it for writing,
+	// without truncating it. Writes begin at the start of the file and
+	// overwrite its existing contents. Reusing a file in place of creating a
+	// new one avoids the cost of allocating the file's blocks and updating its
+	// metadata when it is synced.
+	ReuseForWrite(oldname, newname string) (File, error)
+
 	// Link creates newname as a hard link to the oldname file.
 	Link(oldname, newname string) error
 
 	// Open opens the named file for reading.
 	Open(name string) (File, error)
 
+	// OpenDir opens the named directory for syncing. Syncing the returned
+	// File makes the creation, linking, renaming and removal of the entries
+	// of the directory durable.
+	OpenDir(name string) (File, error)
+
 	// Remove removes the named file or directory.
 	Remove(name string) error
 
@@ -87,6 +99,13 @@ func (defaultFS) Create(name string) (File, error) {
 	return os.Create(name)
 }
 
+func (defaultFS) ReuseForWrite(oldname, newname string) (File, error) {
+	if err := os.Rename(oldname, newname); err != nil {
+		return nil, err
+	}
+	return os.OpenFile(newname, os.O_RDWR|os.O_CREATE, 0666)
+}
+
 func (defaultFS) Link(oldname, newname string) error {
 	return os.Link(oldname, newname)
 }
@@ -95,6 +114,13 @@ func (defaultFS) Open(name string) (File, error) {
 	return os.Open(name)
 }
 
+func (defaultFS) OpenDir(name string) (File, error) {
+	if name == "" {
+		name = "."
+	}
+	return os.Open(name)
+}
+
 func (defaultFS) Remove(name string) error {
 	return os.Remove(name)
 }
@@ -31,6 +31,9 @@ type tableCache struct {
 		iters     map[*sstable.Iter][]byte
 		dummy     tableCacheNode
 		releasing int
+		// l0 holds the file numbers of the L0 tables in the current version.
+		// It is only maintained if Options.PinL0IndexAndFilterBlocks is set.
+		l0 map[uint64]struct{}
 	}
 }
 
@@ -96,6 +99,38 @@ func (c *tableCache) newIter(meta *fileMetadata) (internalIterator, error) {
 	return iter, nil
 }
 
+// setL0Tables records the tables in L0 of the current version. The index and
+// filter blocks of L0 tables are pinned when the table is opened if
+// Options.PinL0IndexAndFilterBlocks is set, and are unpinned when the table
+// leaves L0, such as when it is moved to L1 by a compaction.
+func (c *tableCache) setL0Tables(files []fileMetadata) {
+	if !c.opts.PinL0IndexAndFilterBlocks {
+		return
+	}
+	l0 := make(map[uint64]struct{}, len(files))
+	for i := range files {
+		l0[files[i].fileNum] = struct{}{}
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for fileNum := range c.mu.l0 {
+		if _, ok := l0[fileNum]; ok {
+			continue
+		}
+		if n := c.mu.nodes[fileNum]; n != nil && n.reader != nil {
+			n.reader.UnpinMetadata()
+		}
+	}
+	c.mu.l0 = l0
+}
+
+func (c *tableCache) isL0Table(fileNum uint64) bool {
+	c.mu.Lock()
+	_, ok := c.mu.l0[fileNum]
+	c.mu.Unlock()
+	return ok
+}
+
 // releaseNode releases a node from the tableCache.
 //
 // c.mu must be held when calling this.
@@ -152,7 +187,12 @@ func (c *tableCache) evict(fileNum uint64) {
 	}
 	c.mu.Unlock()
 
-	c.opts.Cache.EvictFile(fileNum)
+	if c.opts.Cache != nil {
+		c.opts.Cache.EvictFile(fileNum)
+	}
+	if c.opts.SecondaryCache != nil {
+		c.opts.SecondaryCache.EvictFile(fileNum)
+	}
 }
 
 func (c *tableCache) Close() error {
@@ -201,6 +241,8 @@ type tableCacheNode struct {
 
 	next, prev *tableCacheNode
 	refCount   int
+	// reader is the table's reader once it has been loaded successfully.
+	reader *sstable.Reader
 }
 
 func (n *tableCacheNode) load(c *tableCache) {
@@ -214,6 +256,21 @@ func (n *tableCacheNode) load(c *tableCache) {
 	if n.meta.smallestSeqNum == n.meta.largestSeqNum {
 		r.Properties.GlobalSeqNum = n.meta.largestSeqNum
 	}
+	pinned := c.isL0Table(n.meta.fileNum)
+	if pinned {
+		if err := r.PinMetadata(); err != nil {
+			_ = r.Close()
+			n.result <- tableReaderOrError{err: err}
+			return
+		}
+	}
+	c.mu.Lock()
+	n.reader = r
+	if _, ok := c.mu.l0[n.meta.fileNum]; pinned && !ok {
+		// The table left L0 while it was being loaded.
+		r.UnpinMetadata()
+	}
+	c.mu.Unlock()
 	n.result <- tableReaderOrError{reader: r}
 }
 
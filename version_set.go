@@ -5,8 +5,10 @@
 package pebble
 
 import (
+	"bytes"
 	"fmt"
 	"io"
+	"math"
 	"os"
 	"sync"
 	"sync/atomic"
@@ -44,8 +46,17 @@ type versionSet struct {
 	manifestFile storage.File
 	manifest     *record.Writer
 
+	// The manifest file last read by load or catchUp, and the offset of the
+	// end of the last versionEdit read from it.
+	loadedManifest       string
+	loadedManifestOffset int64
+
 	writing    bool
 	writerCond sync.Cond
+
+	// tableCache, if non-nil, is notified of the L0 tables of each version as
+	// it is installed.
+	tableCache *tableCache
 }
 
 // load loads the version set from the manifest file.
@@ -63,37 +74,16 @@ func (vs *versionSet) load(dirname string, opts *db.Options, mu *sync.Mutex) err
 	vs.nextFileNumber = 2
 
 	// Read the CURRENT file to find the current manifest file.
-	current, err := vs.fs.Open(dbFilename(dirname, fileTypeCurrent, 0))
-	if err != nil {
-		return fmt.Errorf("pebble: could not open CURRENT file for DB %q: %v", dirname, err)
-	}
-	defer current.Close()
-	stat, err := current.Stat()
+	manifestName, err := readCurrentFile(vs.fs, dirname)
 	if err != nil {
 		return err
 	}
-	n := stat.Size()
-	if n == 0 {
-		return fmt.Errorf("pebble: CURRENT file for DB %q is empty", dirname)
-	}
-	if n > 4096 {
-		return fmt.Errorf("pebble: CURRENT file for DB %q is too large", dirname)
-	}
-	b := make([]byte, n)
-	_, err = current.ReadAt(b, 0)
-	if err != nil {
-		return err
-	}
-	if b[n-1] != '\n' {
-		return fmt.Errorf("pebble: CURRENT file for DB %q is malformed", dirname)
-	}
-	b = b[:n-1]
 
 	// Read the versionEdits in the manifest file.
 	var bve bulkVersionEdit
-	manifest, err := vs.fs.Open(dirname + string(os.PathSeparator) + string(b))
+	manifest, err := vs.fs.Open(dirname + string(os.PathSeparator) + manifestName)
 	if err != nil {
-		return fmt.Errorf("pebble: could not open manifest file %q for DB %q: %v", b, dirname, err)
+		return fmt.Errorf("pebble: could not open manifest file %q for DB %q: %v", manifestName, dirname, err)
 	}
 	defer manifest.Close()
 	rr := record.NewReader(manifest)
@@ -110,32 +100,17 @@ func (vs *versionSet) load(dirname string, opts *db.Options, mu *sync.Mutex) err
 		if err != nil {
 			return err
 		}
-		if ve.comparatorName != "" {
-			if ve.comparatorName != vs.cmpName {
-				return fmt.Errorf("pebble: manifest file %q for DB %q: "+
-					"comparer name from file %q != comparer name from db.Options %q",
-					b, dirname, ve.comparatorName, vs.cmpName)
-			}
-		}
-		bve.accumulate(&ve)
-		if ve.logNumber != 0 {
-			vs.logNumber = ve.logNumber
-		}
-		if ve.prevLogNumber != 0 {
-			vs.prevLogNumber = ve.prevLogNumber
-		}
-		if ve.nextFileNumber != 0 {
-			vs.nextFileNumber = ve.nextFileNumber
-		}
-		if ve.lastSequence != 0 {
-			vs.logSeqNum = ve.lastSequence
+		if err := vs.accumulate(&bve, &ve, manifestName); err != nil {
+			return err
 		}
 	}
+	vs.loadedManifest = manifestName
+	vs.loadedManifestOffset = rr.Offset()
 	if vs.logNumber == 0 || vs.nextFileNumber == 0 {
 		if vs.nextFileNumber == 2 {
 			// We have a freshly created DB.
 		} else {
-			return fmt.Errorf("pebble: incomplete manifest file %q for DB %q", b, dirname)
+			return fmt.Errorf("pebble: incomplete manifest file %q for DB %q", manifestName, dirname)
 		}
 	}
 	vs.markFileNumUsed(vs.logNumber)
@@ -150,6 +125,140 @@ func (vs *versionSet) load(dirname string, opts *db.Options, mu *sync.Mutex) err
 	return nil
 }
 
+// readCurrentFile returns the name of the manifest file named by the CURRENT
+// file of the DB in dirname.
+func readCurrentFile(fs storage.Storage, dirname string) (string, error) {
+	current, err := fs.Open(dbFilename(dirname, fileTypeCurrent, 0))
+	if err != nil {
+		return "", fmt.Errorf("pebble: could not open CURRENT file for DB %q: %v", dirname, err)
+	}
+	defer current.Close()
+	stat, err := current.Stat()
+	if err != nil {
+		return "", err
+	}
+	n := stat.Size()
+	if n == 0 {
+		return "", fmt.Errorf("pebble: CURRENT file for DB %q is empty", dirname)
+	}
+	if n > 4096 {
+		return "", fmt.Errorf("pebble: CURRENT file for DB %q is too large", dirname)
+	}
+	b := make([]byte, n)
+	_, err = current.ReadAt(b, 0)
+	if err != nil {
+		return "", err
+	}
+	if b[n-1] != '\n' {
+		return "", fmt.Errorf("pebble: CURRENT file for DB %q is malformed", dirname)
+	}
+	return string(b[:n-1]), nil
+}
+
+// accumulate adds a versionEdit read from the named manifest file to bve and
+// updates the log and file numbers and the sequence number of vs.
+func (vs *versionSet) accumulate(bve *bulkVersionEdit, ve *versionEdit, manifestName string) error {
+	if ve.comparatorName != "" {
+		if ve.comparatorName != vs.cmpName {
+			return fmt.Errorf("pebble: manifest file %q for DB %q: "+
+				"comparer name from file %q != comparer name from db.Options %q",
+				manifestName, vs.dirname, ve.comparatorName, vs.cmpName)
+		}
+	}
+	bve.accumulate(ve)
+	if ve.logNumber != 0 {
+		vs.logNumber = ve.logNumber
+	}
+	if ve.prevLogNumber != 0 {
+		vs.prevLogNumber = ve.prevLogNumber
+	}
+	if ve.nextFileNumber != 0 {
+		vs.nextFileNumber = ve.nextFileNumber
+	}
+	if ve.lastSequence != 0 {
+		atomic.StoreUint64(&vs.logSeqNum, ve.lastSequence)
+	}
+	return nil
+}
+
+// catchUp reads the versionEdits appended to the manifest since it was last
+// read by load or catchUp, and installs the resulting version. If the CURRENT
+// file names a different manifest, the new manifest is read in full. A
+// truncated record at the end of the manifest, which may still be being
+// written, is ignored and read again by the next call. It returns whether a
+// new version was installed.
+//
+// catchUp is used by DBs opened read-only to follow the primary, and must be
+// called with vs.mu held.
+func (vs *versionSet) catchUp() (bool, error) {
+	manifestName, err := readCurrentFile(vs.fs, vs.dirname)
+	if err != nil {
+		return false, err
+	}
+	base, offset := vs.currentVersion(), vs.loadedManifestOffset
+	if manifestName != vs.loadedManifest {
+		base, offset = nil, 0
+	}
+
+	manifest, err := vs.fs.Open(vs.dirname + string(os.PathSeparator) + manifestName)
+	if err != nil {
+		return false, fmt.Errorf("pebble: could not open manifest file %q for DB %q: %v",
+			manifestName, vs.dirname, err)
+	}
+	defer manifest.Close()
+	// The reader must be an io.Seeker in order to resume reading at the
+	// offset of the last record read.
+	rr := record.NewReader(io.NewSectionReader(manifest, 0, math.MaxInt64))
+	if offset > 0 {
+		if err := rr.SeekRecord(offset); err == io.EOF {
+			return false, nil
+		} else if err != nil {
+			return false, err
+		}
+	}
+
+	var bve bulkVersionEdit
+	var n int
+	for {
+		r, err := rr.Next()
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			// The primary may be in the middle of appending a record.
+			break
+		} else if err != nil {
+			return false, err
+		}
+		var buf bytes.Buffer
+		if _, err := io.Copy(&buf, r); err == io.ErrUnexpectedEOF {
+			break
+		} else if err != nil {
+			return false, err
+		}
+		var ve versionEdit
+		if err := ve.decode(&buf); err != nil {
+			return false, err
+		}
+		if err := vs.accumulate(&bve, &ve, manifestName); err != nil {
+			return false, err
+		}
+		offset = rr.Offset()
+		n++
+	}
+	if n == 0 {
+		return false, nil
+	}
+
+	newVersion, err := bve.apply(vs.opts, base, vs.cmp)
+	if err != nil {
+		return false, err
+	}
+	vs.append(newVersion)
+	vs.markFileNumUsed(vs.logNumber)
+	vs.markFileNumUsed(vs.prevLogNumber)
+	vs.loadedManifest = manifestName
+	vs.loadedManifestOffset = offset
+	return true, nil
+}
+
 // logAndApply logs the version edit to the manifest, applies the version edit
 // to the current version, and installs the new version. DB.mu must be held
 // when calling this method and will be released temporarily while performing
@@ -171,6 +280,18 @@ func (vs *versionSet) logAndApply(ve *versionEdit) error {
 			panic(fmt.Sprintf("pebble: inconsistent versionEdit logNumber %d", ve.logNumber))
 		}
 	}
+
+	// A new manifest is started if there is none, or if the current manifest
+	// has grown too large. The new manifest begins with a snapshot of the
+	// current version, and replaces the current manifest once the edit has
+	// been logged to it.
+	manifestFileNumber := vs.manifestFileNumber
+	newManifest := vs.manifest == nil
+	if !newManifest && vs.manifest.Size() >= vs.opts.MaxManifestFileSize {
+		manifestFileNumber = vs.nextFileNum()
+		newManifest = true
+	}
+
 	ve.nextFileNumber = vs.nextFileNumber
 	ve.lastSequence = atomic.LoadUint64(&vs.logSeqNum)
 
@@ -182,33 +303,54 @@ func (vs *versionSet) logAndApply(ve *versionEdit) error {
 	}
 
 	var picker *compactionPicker
-	if err := func() error {
+	manifestFile, manifest := vs.manifestFile, vs.manifest
+	if err := func() (err error) {
 		vs.mu.Unlock()
 		defer vs.mu.Lock()
 
-		// TODO(peter): if vs.manifest becomes too large, create a new one.
-		if vs.manifest == nil {
-			if err := vs.createManifest(vs.dirname); err != nil {
+		if newManifest {
+			manifestFile, manifest, err = vs.createManifest(vs.dirname, manifestFileNumber)
+			if err != nil {
 				return err
 			}
+			defer func() {
+				if err != nil {
+					// The new manifest is not installed, and is deleted by
+					// deleteObsoleteFiles once a later manifest is installed.
+					manifest.Close()
+					manifestFile.Close()
+				}
+			}()
+		}
+
+		// The files added by the edit must be durably present in the directory
+		// before the edit referencing them is.
+		if err := syncDir(vs.fs, vs.dirname); err != nil {
+			return err
 		}
 
-		w, err := vs.manifest.Next()
+		w, err := manifest.Next()
 		if err != nil {
 			return err
 		}
 		if err := ve.encode(w); err != nil {
 			return err
 		}
-		if err := vs.manifest.Flush(); err != nil {
+		if err := manifest.Flush(); err != nil {
 			return err
 		}
-		if err := vs.manifestFile.Sync(); err != nil {
+		if err := manifestFile.Sync(); err != nil {
 			return err
 		}
-		if err := setCurrentFile(vs.dirname, vs.fs, vs.manifestFileNumber); err != nil {
+		if err := setCurrentFile(vs.dirname, vs.fs, manifestFileNumber); err != nil {
 			return err
 		}
+		if newManifest && vs.manifest != nil {
+			// The previous manifest is no longer written, and is deleted by
+			// deleteObsoleteFiles.
+			vs.manifest.Close()
+			vs.manifestFile.Close()
+		}
 		picker = newCompactionPicker(newVersion, vs.opts)
 		return nil
 	}(); err != nil {
@@ -223,14 +365,19 @@ func (vs *versionSet) logAndApply(ve *versionEdit) error {
 	if ve.prevLogNumber != 0 {
 		vs.prevLogNumber = ve.prevLogNumber
 	}
+	vs.manifestFileNumber = manifestFileNumber
+	vs.manifestFile, vs.manifest = manifestFile, manifest
 	vs.picker = picker
 	return nil
 }
 
-// createManifest creates a manifest file that contains a snapshot of vs.
-func (vs *versionSet) createManifest(dirname string) (err error) {
+// createManifest creates a manifest file with the given number, containing a
+// snapshot of vs.
+func (vs *versionSet) createManifest(
+	dirname string, fileNum uint64,
+) (_ storage.File, _ *record.Writer, err error) {
 	var (
-		filename     = dbFilename(dirname, fileTypeManifest, vs.manifestFileNumber)
+		filename     = dbFilename(dirname, fileTypeManifest, fileNum)
 		manifestFile storage.File
 		manifest     *record.Writer
 	)
@@ -248,12 +395,16 @@ func (vs *versionSet) createManifest(dirname string) (err error) {
 	}()
 	manifestFile, err = vs.fs.Create(filename)
 	if err != nil {
-		return err
+		return nil, nil, err
 	}
 	manifest = record.NewWriter(manifestFile)
 
+	// The snapshot includes the log numbers, which the edits of flushes and
+	// compactions which follow it in the manifest do not.
 	snapshot := versionEdit{
 		comparatorName: vs.cmpName,
+		logNumber:      vs.logNumber,
+		prevLogNumber:  vs.prevLogNumber,
 	}
 	for level, fileMetadata := range vs.currentVersion().files {
 		for _, meta := range fileMetadata {
@@ -266,15 +417,15 @@ func (vs *versionSet) createManifest(dirname string) (err error) {
 
 	w, err1 := manifest.Next()
 	if err1 != nil {
-		return err1
+		return nil, nil, err1
 	}
 	if err := snapshot.encode(w); err != nil {
-		return err
+		return nil, nil, err
 	}
 
-	vs.manifest, manifest = manifest, nil
-	vs.manifestFile, manifestFile = manifestFile, nil
-	return nil
+	f, m := manifestFile, manifest
+	manifestFile, manifest = nil, nil
+	return f, m, nil
 }
 
 func (vs *versionSet) markFileNumUsed(fileNum uint64) {
@@ -298,6 +449,9 @@ func (vs *versionSet) append(v *version) {
 	}
 	v.ref()
 	vs.versions.pushBack(v)
+	if vs.tableCache != nil {
+		vs.tableCache.setL0Tables(v.files[0])
+	}
 }
 
 func (vs *versionSet) currentVersion() *version {